@@ -0,0 +1,34 @@
+package cache
+
+// An Admission decides whether a key that isn't resident is given an entry,
+// as WithAdmission arranges. A key that isn't is loaded for its reader
+// without being kept.
+type Admission interface {
+	Admit(c Candidate) bool
+}
+
+// A Candidate is a key that's been read but isn't resident, as an Admission
+// sees it. Frequencies are estimates of how often keys have been read
+// recently, this read included; they're small numbers, and only relative.
+type Candidate struct {
+	Key       Key
+	Frequency int
+	// Whether an entry would have to be evicted to make room for it; if so,
+	// the Victim the eviction policy chooses, and how often it's been read.
+	Full            bool
+	Victim          Key
+	VictimFrequency int
+}
+
+// An AdmissionFunc is an Admission.
+type AdmissionFunc func(c Candidate) bool
+
+func (f AdmissionFunc) Admit(c Candidate) bool {
+	return f(c)
+}
+
+// The admission of WithTinyLFU: a newcomer may only displace a key that's
+// read less often than it is.
+func frequent(c Candidate) bool {
+	return !c.Full || c.Frequency > c.VictimFrequency
+}
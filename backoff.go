@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"time"
+)
+
+// A Backoff schedules refreshes: the positive backoff after a successful
+// load, the negative one after a failure. Reset is called on both after each
+// success. The Delay of github.com/jan-g/delay is a Backoff as it stands,
+// but keeps its own time; the delay package here makes ones that keep the
+// cache's.
+//
+// A Backoff may keep state between delays, and is used by one goroutine at a
+// time. The cache is therefore given functions that make them, rather than
+// Backoffs themselves, and makes a fresh one for each key.
+type Backoff interface {
+	Delay() <-chan time.Time
+	Reset()
+}
+
+// A Schedule produces successive intervals. It matches the BackOff of
+// github.com/cenkalti/backoff, amongst others.
+type Schedule interface {
+	NextBackOff() time.Duration
+	Reset()
+}
+
+type schedule struct {
+	Schedule
+}
+
+// FromSchedule adapts Schedules to Backoffs, one for each Schedule made. A
+// negative interval means that no refresh is scheduled.
+func FromSchedule(s func() Schedule) func() Backoff {
+	return func() Backoff {
+		return schedule{Schedule: s()}
+	}
+}
+
+func (s schedule) Delay() <-chan time.Time {
+	return s.delayOn(systemClock{})
+}
+
+func (s schedule) delayOn(clock Clock) <-chan time.Time {
+	d := s.NextBackOff()
+	if d < 0 {
+		return nil
+	}
+	return clock.After(d)
+}
+
+type every time.Duration
+
+// Every makes Backoffs with a fixed interval.
+func Every(interval time.Duration) func() Backoff {
+	return func() Backoff {
+		return every(interval)
+	}
+}
+
+func (e every) Delay() <-chan time.Time {
+	return e.delayOn(systemClock{})
+}
+
+func (e every) delayOn(clock Clock) <-chan time.Time {
+	return clock.After(time.Duration(e))
+}
+
+func (e every) Reset() {}
@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jan-g/delay"
+)
+
+var _ Backoff = delay.New(period)
+
+// Doubles each time, up to max if there is one, in the manner of
+// cenkalti/backoff
+type doubling struct {
+	initial, next, max time.Duration
+}
+
+func (d *doubling) NextBackOff() time.Duration {
+	next := d.next
+	d.next *= 2
+	if d.max > 0 && d.next > d.max {
+		d.next = d.max
+	}
+	return next
+}
+
+func (d *doubling) Reset() {
+	d.next = d.initial
+}
+
+func TestFromSchedule(t *testing.T) {
+	b := FromSchedule(func() Schedule { return &doubling{initial: period, next: period} })()
+	clock := newFakeClock()
+
+	start := clock.Now()
+	clock.During(func() {
+		<-delayOn(clock, b)
+		<-delayOn(clock, b)
+	})
+	assert.Equal(t, 3*period, clock.Now().Sub(start))
+
+	b.Reset()
+	start = clock.Now()
+	clock.During(func() {
+		<-delayOn(clock, b)
+	})
+	assert.Equal(t, period, clock.Now().Sub(start))
+}
+
+func TestEvery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, clock: clock}).refresh, Every(2*period), Every(period), WithClock(clock))
+
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	clock.Sleep(4 * period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+
+	cancel()
+}
+
+func TestWithBackoffs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	r := &refresher{period: period / 4, clock: clock}
+	c := New(ctx, r.refresh, positive, negative, WithClock(clock), WithBackoffs(func(key Key) (func() Backoff, func() Backoff) {
+		if key == "volatile" {
+			return Every(period), nil
+		}
+		return nil, nil
+	}))
+
+	v, e := getOn(clock, c, "volatile")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+	v, e = getOn(clock, c, "static")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+
+	// The volatile key refreshes before the static one
+	clock.Sleep(3 * period / 2)
+	v, e = c.Get(context.Background(), "volatile")
+	assert.Nil(t, e)
+	assert.Equal(t, 3, v)
+	v, e = c.Get(context.Background(), "static")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+
+	cancel()
+}
+
+func TestWithErrorBackoffs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	attempts := map[Key]int{}
+	transient := errors.New("transient")
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[key]++
+		if key == "missing" {
+			return nil, ErrNotFound
+		}
+		return nil, transient
+	}, Every(period), Every(period/2), WithErrorBackoffs(func(err error) func() Backoff {
+		if errors.Is(err, ErrNotFound) {
+			return Every(10 * period)
+		}
+		return nil
+	}), WithKeepUnused(), WithClock(clock))
+
+	_, e := c.Get(context.Background(), "missing")
+	assert.ErrorIs(t, e, ErrNotFound)
+	_, e = c.Get(context.Background(), "flaky")
+	assert.ErrorIs(t, e, transient)
+
+	// The missing key waits a long while before trying again; the other doesn't
+	clock.Sleep(9 * period / 4)
+	mu.Lock()
+	assert.Equal(t, 1, attempts["missing"])
+	assert.Equal(t, 5, attempts["flaky"])
+	mu.Unlock()
+
+	cancel()
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"context"
+	"sync"
+)
+
+// A Removal is an entry that left the cache, as OnRemoveBatch reports it.
+type Removal struct {
+	Key    Key
+	Value  Value // The last value it held
+	Reason Reason
+}
+
+// The removals of one pass over the cache, gathered for OnRemoveBatch
+type batch struct {
+	mu        sync.Mutex
+	removals  []Removal
+	waits     []<-chan struct{} // Closed as the maintainers of its entries exit
+	delivered bool
+}
+
+// A batch for a pass over the cache, if removals are to be batched; nil if
+// not.
+func (cache *cache) newBatch() *batch {
+	if cache.hooks.OnRemoveBatch == nil {
+		return nil
+	}
+	return &batch{}
+}
+
+// Add a removal, reporting whether it's in time to be delivered.
+func (b *batch) add(removal Removal) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.delivered {
+		return false
+	}
+	b.removals = append(b.removals, removal)
+	return true
+}
+
+// Have an entry's maintainer report its removal in a batch, once it's
+// stopped.
+func (e *entry) join(b *batch) {
+	if b == nil || e.extras == nil {
+		return
+	}
+	b.mu.Lock()
+	b.waits = append(b.waits, e.done)
+	b.mu.Unlock()
+	e.extras.batch.Store(b)
+}
+
+// Report the removal of an entry, as part of a batch if there is one.
+func (cache *cache) removed(key Key, value Value, reason Reason, b *batch) {
+	if !b.add(Removal{Key: key, Value: value, Reason: reason}) {
+		cache.hooks.removed(key, value, reason)
+	}
+}
+
+// Deliver a batch once the maintainers of its entries have exited, or ctx
+// is done; any that are later still are reported alone.
+func (cache *cache) deliver(ctx context.Context, b *batch) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	waits := b.waits
+	b.mu.Unlock()
+	for _, done := range waits {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+	b.mu.Lock()
+	b.delivered = true
+	removals := b.removals
+	b.mu.Unlock()
+	if len(removals) > 0 {
+		cache.hooks.removedBatch(ctx, removals)
+	}
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"time"
+)
+
+// A Blackout describes periods during which background refreshes are held
+// off. Given a time, it reports when the period that covers it ends, or the
+// zero time if there's none.
+type Blackout func(t time.Time) (end time.Time)
+
+// Daily makes a Blackout for the same period each day, from and to being
+// offsets from local midnight. A period may run past midnight, from 23:00
+// to 01:00 say.
+func Daily(from, to time.Duration) Blackout {
+	return func(t time.Time) time.Time {
+		y, m, d := t.Date()
+		midnight := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+		offset := t.Sub(midnight)
+		switch {
+		case from <= to:
+			if offset >= from && offset < to {
+				return midnight.Add(to)
+			}
+		case offset >= from:
+			return midnight.AddDate(0, 0, 1).Add(to)
+		case offset < to:
+			return midnight.Add(to)
+		}
+		return time.Time{}
+	}
+}
+
+// How long until the blackout now in force is over; zero if there's none.
+func (cache *cache) blackout() time.Duration {
+	if len(cache.blackouts) == 0 {
+		return 0
+	}
+	now := cache.clock.Now()
+	var end time.Time
+	for _, b := range cache.blackouts {
+		if e := b(now); e.After(end) {
+			end = e
+		}
+	}
+	if end.IsZero() {
+		return 0
+	}
+	return end.Sub(now)
+}
+
+func (cache *cache) blackedOut() bool {
+	return cache.blackout() > 0
+}
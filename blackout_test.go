@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDaily(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return day.Add(d) }
+
+	nightly := Daily(2*time.Hour, 4*time.Hour)
+	assert.True(t, nightly(at(time.Hour)).IsZero())
+	assert.Equal(t, at(4*time.Hour), nightly(at(3*time.Hour)))
+	assert.True(t, nightly(at(4*time.Hour)).IsZero())
+
+	midnight := Daily(23*time.Hour, time.Hour)
+	assert.Equal(t, at(25*time.Hour), midnight(at(23*time.Hour+30*time.Minute)))
+	assert.Equal(t, at(time.Hour), midnight(at(30*time.Minute)))
+	assert.True(t, midnight(at(12*time.Hour)).IsZero())
+}
+
+func TestBlackouts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls, dark int32
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return int(atomic.AddInt32(&calls, 1)), nil
+	}, Every(period), Every(period), WithKeepUnused(), WithClock(clock), WithBlackouts(func(t time.Time) time.Time {
+		if atomic.LoadInt32(&dark) == 1 {
+			return t.Add(period / 4)
+		}
+		return time.Time{}
+	}))
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// No refreshes happen while it's dark; the value is served as it stands
+	atomic.StoreInt32(&dark, 1)
+	clock.Sleep(5 * period / 2)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// They resume afterwards
+	atomic.StoreInt32(&dark, 0)
+	clock.Sleep(period / 2)
+	v, _ = c.Get(context.Background(), "foo")
+	assert.Equal(t, 2, v)
+
+	cancel()
+}
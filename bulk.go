@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"context"
+)
+
+// A BulkRefresher loads the values of many keys in one call, as
+// WithBulkRefresher arranges. It reports each key's value or error in one
+// of the maps; a key it reports in neither is taken not to exist upstream,
+// and fails with ErrNotFound.
+type BulkRefresher func(ctx context.Context, keys []Key) (map[Key]Value, map[Key]error)
+
+// A refresh claimed for a bulk call
+type bulkLoad struct {
+	due
+	gen uint32
+}
+
+// Divide the entries that have fallen due between the workers: one at a
+// time, or, given a BulkRefresher, in batches of up to bulkMax.
+func (c *onDemand) batches(ready []due) [][]due {
+	size := 1
+	if c.cache.bulk != nil {
+		size = len(ready)
+		if c.cache.bulkMax > 0 {
+			size = minInt(size, c.cache.bulkMax)
+		}
+	}
+	var batches [][]due
+	for len(ready) > 0 {
+		n := minInt(size, len(ready))
+		batches = append(batches, ready[:n:n])
+		ready = ready[n:]
+	}
+	return batches
+}
+
+// Refresh a batch of entries that have fallen due with one call to the
+// BulkRefresher, leaving out those that shouldn't be refreshed after all.
+func (c *onDemand) refreshBulk(batch []due) {
+	var claimed []bulkLoad
+	var keys []Key
+	for _, next := range batch {
+		if !c.claim(next) {
+			continue
+		}
+		c.cache.closing.RLock()
+		_, ctx, gen := c.begin(next.d)
+		c.cache.closing.RUnlock()
+		next.d.mu.Unlock()
+		if ctx == nil {
+			continue
+		}
+		claimed = append(claimed, bulkLoad{due: next, gen: gen})
+		keys = append(keys, next.key)
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	ctx := c.cache.ctx
+	if c.cache.refreshTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cache.refreshTimeout)
+		defer cancel()
+	}
+	began := c.cache.clock.Now()
+	values, errs := c.cache.bulk(ctx, keys)
+	took := c.cache.since(began)
+	for _, b := range claimed {
+		// Each key's refresh took as long as the call
+		c.cache.stats.took(took)
+		c.land(b.key, b.d, b.gen, c.cache.bulkResult(b.key, values, errs))
+	}
+}
+
+// A key's outcome from a bulk call.
+func (cache *cache) bulkResult(key Key, values map[Key]Value, errs map[Key]error) r {
+	if err := errs[key]; err != nil {
+		return cache.result(nil, &RefreshError{Key: key, Err: err})
+	}
+	if value, ok := values[key]; ok {
+		return cache.result(value, nil)
+	}
+	return r{Err: &RefreshError{Key: key, Err: ErrNotFound}}
+}
@@ -2,12 +2,11 @@ package cache
 
 import (
 	"context"
+	"math"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/sirupsen/logrus"
-
-	"github.com/jan-g/delay"
 )
 
 type Key interface{}
@@ -15,131 +14,1799 @@ type Value interface{}
 type Refresher func(ctx context.Context, key Key) (value Value, err error)
 
 type Cache interface {
-	Get(context.Context, Key) (Value, error)
+	Get(ctx context.Context, key Key, opts ...GetOption) (Value, error)
+	// GetIfPresent returns the value for a key only if one has already been
+	// successfully loaded; it never blocks nor starts a load.
+	GetIfPresent(Key) (Value, bool)
+	// GetOrLoad is Get, but a key that isn't resident is loaded, and
+	// subsequently refreshed, using the given loader rather than the cache's
+	// refresher. The loader also replaces that of a resident key for its
+	// future refreshes.
+	GetOrLoad(ctx context.Context, key Key, loader Refresher) (Value, error)
+	// GetWithInfo is Get, additionally describing the state of the entry.
+	GetWithInfo(ctx context.Context, key Key) (Value, Info, error)
+	// Set seeds or overwrites the value for a key without waiting for the refresher.
+	Set(ctx context.Context, key Key, value Value) error
+	// SetWithError is Set for a value, error pair; a non-nil error is negatively cached.
+	SetWithError(ctx context.Context, key Key, value Value, err error) error
+	// Update applies fn to the current value for a key, serialized with the
+	// key's refreshes, and returns the outcome. If fn returns an error, or the
+	// current result is itself an error, the entry is left unchanged.
+	Update(ctx context.Context, key Key, fn func(old Value) (Value, error)) (Value, error)
+	// Subscribe delivers each successfully loaded value for a key (including
+	// the current one) until ctx is done. An active subscription keeps the key
+	// resident; the channel is closed if the key is nevertheless dropped.
+	Subscribe(ctx context.Context, key Key) (<-chan Value, error)
+	// Warm loads the given keys concurrently, returning once every load has
+	// completed or ctx is done. It reports the first error encountered.
+	Warm(ctx context.Context, keys ...Key) error
+	// Invalidate drops a key, waiting for its maintainer to exit, so that
+	// the next Get loads it afresh.
+	Invalidate(ctx context.Context, key Key) error
+	// Pin keeps a key resident until it's unpinned: it's loaded if need be,
+	// and never dropped for want of use nor evicted to make room. Should it
+	// be dropped regardless, by Invalidate or after too many failures, say,
+	// it's loaded afresh. Pinned keys don't count towards WithMaxEntries and
+	// the like.
+	Pin(ctx context.Context, key Key) error
+	// Unpin lets a pinned key be dropped again.
+	Unpin(key Key)
+	// Refresh triggers an immediate background refresh of a key, superseding
+	// any already in flight.
+	Refresh(ctx context.Context, key Key) error
+	// RefreshAndGet is Refresh, but waits for the refreshed value to land.
+	RefreshAndGet(ctx context.Context, key Key) (Value, error)
+	// Purge drops every key. The cache remains usable afterwards.
+	Purge()
+	// SetMaxEntries changes the bound set by WithMaxEntries, evicting at once
+	// as many entries as it takes to keep within it; zero lifts it. It
+	// returns ErrUnbounded if the cache was made without any bound.
+	SetMaxEntries(n int) error
+	// SetMaxWeight is SetMaxEntries for the budget set by WithMaxWeight. It
+	// returns ErrUnbounded if the cache doesn't weigh its entries.
+	SetMaxWeight(budget int64) error
+	// Keys lists the keys currently resident, including those still loading.
+	Keys() []Key
+	// Len counts the keys currently resident.
+	Len() int
+	// Range calls f for each loaded entry until f returns false. It neither
+	// triggers refreshes nor counts as a use of the entries it visits.
+	Range(f func(key Key, value Value, err error) bool)
+	// Snapshot copies the successfully loaded values currently held. Like
+	// Range, it doesn't count as a use of those entries.
+	Snapshot() map[Key]Value
+	// SizeOf reports the size of a key's successfully loaded value, as the
+	// cache's Weigher reckons it or, failing that, as EstimateSize does. Like
+	// Range, it doesn't count as a use of the entry.
+	SizeOf(key Key) (int64, bool)
+	// Sizes reports the size of each successfully loaded value, as SizeOf
+	// would, and their total.
+	Sizes() (sizes map[Key]int64, total int64)
+	// Stats reports cumulative counts of the cache's activity.
+	Stats() Stats
+	// Close stops every maintainer and waits for them, and any refreshes they
+	// have in flight, to finish; or for ctx to expire. A closed cache returns
+	// ErrShutdown from its methods.
+	Close(ctx context.Context) error
 }
 
 type cache struct {
-	ctx       context.Context
-	refresher Refresher
-	positive  delay.Delay
-	negative  delay.Delay
-	kv        sync.Map // Key: <-chan r
+	stats counters // First, for the alignment of its atomics
+
+	ctx           context.Context
+	cancel        context.CancelFunc
+	refresher     Refresher
+	positive      func() Backoff
+	negative      func() Backoff
+	backoffs      func(key Key) (positive, negative func() Backoff) // Chooses per-key backoffs, if set
+	errorBackoffs func(err error) func() Backoff                    // Chooses negative backoffs by error, if set
+	kv            shardedMap                                        // Key: *entry
+	clock         Clock
+	timers        Clock     // Times the maintainers' deadlines: the clock, or a coarser one that shares timers between them
+	scheduler     Scheduler // Times their refreshes: on the timers, unless WithScheduler says otherwise
+	idleTimers    sync.Pool // Of stopped Timers on the clock, for reuse
+
+	// Options
+	hooks                Hooks
+	staleIfError         bool                      // Keep serving the last good value when a refresh fails
+	staleWhileRevalidate bool                      // Get behaves as if AllowStale were always given
+	hardTTL              time.Duration             // How long an unrefreshed value may be served; zero for ever
+	expireAfterWrite     time.Duration             // How long an entry lives, regardless; zero for ever
+	maxAge               time.Duration             // How old a value may be and still be served; zero for any age
+	idleTimeout          time.Duration             // How long an entry may go unused; zero to judge that by the refresh schedule
+	maxWaiters           int32                     // How many readers may wait on a key's load; zero for any number
+	oneShotTimeout       time.Duration             // How long an entry that's been read just once may go unused; zero for no different
+	earlyRefresh         float64                   // XFetch's beta; zero to refresh only on schedule
+	jitter               time.Duration             // Upper bound on a random delay added to each positive refresh
+	noRefresh            bool                      // Good values are kept as they are rather than refreshed
+	refreshAhead         int                       // Unused refresh cycles to keep an entry warm across
+	refreshAheadKeys     func(key Key) bool        // Which keys refreshAhead applies to; nil for all
+	unchanged            func(old, new Value) bool // Whether a refresh left the value as it was, for adaptive refresh
+	adaptiveMin          time.Duration             // The shortest adaptive refresh interval
+	adaptiveMax          time.Duration             // And the longest
+	keepUnused           bool                      // Entries are never dropped for want of use
+	parking              bool                      // Maintainers of entries that go unused park, rather than exit or refresh
+	maxErrors            int                       // Consecutive failures after which an entry is dropped; zero for never
+	quarantine           int                       // Consecutive failures after which an entry is quarantined; zero for never
+	probation            time.Duration             // How long a quarantined entry waits for a probing refresh; zero for ever
+	blackouts            []Blackout                // Periods during which background refreshes are held off
+	limiter              Limiter                   // Rations background refreshes, if they're rationed
+	limitRetry           time.Duration             // How long a refresh it refuses is put off for
+	maxEntries           int                       // How many entries may be resident; zero for any number
+	maxWeight            int64                     // The total weight of the entries that may be resident; zero for any
+	weigher              Weigher                   // Weighs entries against that
+	namespace            func(key Key) string      // Divides keys between quotas
+	quotas               map[string]Quota
+	interner             *Interner                      // Keeps a single copy of each string key, if it should
+	canon                func(Key) Key                  // Maps keys to those their entries are kept under; nil to keep them as they are
+	coldStore            Store                          // Keeps entries evicted for room, if there's one
+	sweepEvery           time.Duration                  // How often the sweeper reaps expired and quarantined entries; zero for never
+	reap                 func(b *batch) int             // Reaps them, reporting how many
+	pressure             *pressure                      // Sheds entries as the process nears its memory limit, if it should
+	cardinality          *cardinality                   // Limits the distinct keys read in a window, if there's a limit
+	lazy                 *lazy                          // Remembers the keys read once, if only those read again are kept
+	priority             func(key Key, value Value) int // Ranks entries for eviction; nil to rank them all alike
+	policy               func() Policy                  // Makes the policy that chooses which to evict; nil for LRU
+	admission            Admission                      // Decides whether newcomers are kept; nil to keep them all
+	capacity             *capacity                      // Bounds the number and weight of entries, if there are limits
+	evict                func(key Key, b *batch)        // Drops an entry to make room for others
+	refreshTimeout       time.Duration                  // How long a refresher may take; zero for as long as it likes
+	hedge                time.Duration                  // How long a refresher call may take before a second is made alongside it; zero for never
+	retries              int                            // How many times a failed refresh is retried before its failure is published
+	retryBackoff         func() Backoff                 // The delays between those retries; nil for none
+	maxMaintainers       int32                          // How many maintainers may run at once; zero for any number
+	shards               int                            // How many shards the entries are divided between; zero for one
+	snapshotMap          bool                           // Whether those shards are copied on write, for reads without locking
+	codec                Codec                          // Encodes values to be kept off the heap as Blobs; nil to keep them as they are
+	tracer               Tracer                         // Follows loads; nil for none
+	logger               Logger                         // Told of the cache's workings; nil to say nothing
+	export               *exported                      // How the cache's stats are published with expvar; nil if they aren't
+	timerResolution      time.Duration                  // How finely the maintainers' deadlines are timed; zero for exactly
+	refreshWorkers       int                            // How many loads may run at once; zero for any number
+	workers              *workQueue                     // Queues loads for those workers, if there's a limit
+	adaptiveWorkers      bool                           // Whether how many of them run at once adapts to how the refresher fares
+	workerLatency        time.Duration                  // How long a load may take before that counts against it; zero for any time
+	standby              int                            // How many goroutines stand by to run loads, if they aren't run by workers
+	expiryHeap           int                            // How many workers refresh the entries of New's, kept in an expiry heap; zero for a maintainer each
+	standingBy           chan func()                    // Hands loads to those that are idle; nil if there are none
+	bulk                 BulkRefresher                  // Refreshes the entries of NewScheduled that fall due together in one call; nil for one at a time
+	bulkMax              int                            // How many keys it's given at once; zero for any number
+
+	closing     sync.RWMutex          // Held for writing while the cache is being closed
+	running     sync.WaitGroup        // Maintainers and refreshes
+	maintainers int32                 // How many maintainers are running, counted atomically
+	pinned      sync.Map              // Of Key to struct{}
+	shutdown    atomic.Pointer[batch] // The batch that Close reports the removals of its maintainers in
+
+	flights []flightStripe // Loads for readers that aren't given an entry, a stripe per shard
 }
 
 // Package up a result, error pair.
 type r struct {
 	Value
 	Err error
+	ttl time.Duration // Until the next refresh, if the value dictates it
+}
+
+// An externally-supplied result; done is closed once it has been published.
+type setting struct {
+	r
+	done chan struct{}
+}
+
+// A mutation to apply to the current value; the outcome is delivered on reply.
+type update struct {
+	fn    func(old Value) (Value, error)
+	reply chan r
+}
+
+// A forced refresh. Its outcome is delivered on reply, if that's non-nil
+// (and buffered); started is closed once the refresh is under way, and
+// readers see as much.
+type forced struct {
+	reply   chan<- r
+	started chan struct{}
+	reader  context.Context // Whoever forced it
+}
+
+// What callers share with the maintainer of a key. It's kept compact, since
+// there may be very many: readers are served from the state the maintainer
+// last published, and anything else is asked of it by posting a request and
+// nudging it, on the one channel it listens to for callers.
+type entry struct {
+	current atomic.Pointer[published] // Swapped by the maintainer, for readers
+	nudge   chan struct{}             // Buffered: nudged once there's a request, signal or flag for the maintainer to look at
+	done    chan struct{}             // Closed when the maintainer exits
+	flags   uint32                    // Set atomically: touches, signals and why it's stopped; see below
+	heat    int32                     // Reads of late, counted atomically if refreshes are queued
+	extras  *entryExtras              // What only some caches need, if this one does
+
+	mu        sync.Mutex
+	refresher Refresher
+	mail      []interface{} // Requests for the maintainer: a *setting, *forced, *subscriber or *update
+	gate      *gate         // At which readers wait for a value, if any are
+}
+
+// The parts of an entry that only some caches need, made along with it if
+// the cache's options call for them
+type entryExtras struct {
+	dueAt   int64                 // When the next refresh is due, in Unix nanoseconds, for early refreshes; zero if that's unknown
+	cost    int64                 // How long the latest refresh took, in nanoseconds, likewise
+	readAt  int64                 // When a reader last touched the entry, in Unix nanoseconds, if the cache times reads
+	waiters int32                 // Readers waiting on a load, counted atomically if they're limited
+	batch   atomic.Pointer[batch] // The batch its removal is reported in, if removals are batched
+}
+
+// The flags of an entry. The touches are counted in the lowest bits, up to
+// two; the Reason it's stopped for, if it's told, in the highest.
+const (
+	touchMask    uint32 = 3
+	admittedFlag uint32 = 1 << 2 // The read that admitted it was counted then, and has yet to find it
+	earlyFlag    uint32 = 1 << 3 // A reader would have the value refreshed early
+	wakeFlag     uint32 = 1 << 4 // A reader would have a parked maintainer load the value again
+	stoppedFlag  uint32 = 1 << 5 // The maintainer's to exit
+	toldFlag     uint32 = 1 << 6 // And it's been told why
+	reasonShift         = 8
+	reasonMask   uint32 = 0xff << reasonShift
+)
+
+// The extras an entry needs, if the cache's options call for any.
+func (cache *cache) entryExtras() *entryExtras {
+	if cache.earlyRefresh > 0 || cache.idleTimeout > 0 || cache.oneShotTimeout > 0 || cache.maxWaiters > 0 || cache.hooks.OnRemoveBatch != nil {
+		return &entryExtras{}
+	}
+	return nil
+}
+
+// Set flags, returning them as they were.
+func (e *entry) set(flags uint32) uint32 {
+	for {
+		old := atomic.LoadUint32(&e.flags)
+		if old&flags == flags || atomic.CompareAndSwapUint32(&e.flags, old, old|flags) {
+			return old
+		}
+	}
+}
+
+// Clear flags, returning them as they were.
+func (e *entry) clear(flags uint32) uint32 {
+	for {
+		old := atomic.LoadUint32(&e.flags)
+		if old&flags == 0 || atomic.CompareAndSwapUint32(&e.flags, old, old&^flags) {
+			return old
+		}
+	}
+}
+
+// Nudge the maintainer, unless it's been nudged already and has yet to look.
+func (e *entry) poke() {
+	select {
+	case e.nudge <- struct{}{}:
+	default:
+	}
+}
+
+// Raise a flag for the maintainer, nudging it unless it's raised already:
+// the maintainer clears the flags it heeds once it's been nudged.
+func (e *entry) signal(flag uint32) {
+	if e.set(flag)&flag == 0 {
+		e.poke()
+	}
+}
+
+// Post a request for the maintainer.
+func (e *entry) post(req interface{}) {
+	e.mu.Lock()
+	e.mail = append(e.mail, req)
+	e.mu.Unlock()
+	e.poke()
+}
+
+// Take back a request, reporting false if the maintainer took it first.
+func (e *entry) withdraw(req interface{}) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, posted := range e.mail {
+		if posted == req {
+			e.mail = append(e.mail[:i], e.mail[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
-func New(ctx context.Context, refresher Refresher, positive delay.Delay, negative delay.Delay) Cache {
-	return &cache{
+// Take the next request the maintainer can deal with: any but an update,
+// which waits until there's a value to update. If there are more, the
+// maintainer is nudged to look again.
+func (e *entry) next(serving bool) (interface{}, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, req := range e.mail {
+		if _, ok := req.(*update); ok && !serving {
+			continue
+		}
+		e.mail = append(e.mail[:i], e.mail[i+1:]...)
+		if len(e.mail) == 0 {
+			e.mail = nil
+		} else {
+			e.poke()
+		}
+		return req, true
+	}
+	return nil, false
+}
+
+// Nudge the maintainer if requests are waiting, now that it may be able to
+// deal with them.
+func (e *entry) remind() {
+	e.mu.Lock()
+	waiting := len(e.mail) > 0
+	e.mu.Unlock()
+	if waiting {
+		e.poke()
+	}
+}
+
+// Post a request and wait for the maintainer to take it, as taken reports,
+// or for ctx to be done. It reports false if the maintainer exits without
+// taking it, so that it can be posted to its successor.
+func (e *entry) send(ctx context.Context, req interface{}, taken <-chan struct{}) (bool, error) {
+	e.post(req)
+	select {
+	case <-taken:
+		return true, nil
+	case <-ctx.Done():
+		if e.withdraw(req) {
+			return false, ctx.Err()
+		}
+	case <-e.done:
+		if e.withdraw(req) {
+			return false, nil
+		}
+	}
+	// It was taken in the meantime
+	<-taken
+	return true, nil
+}
+
+// The state of an entry as its maintainer last published it
+type published struct {
+	result r
+	info   Info
+	loaded bool // Whether there's a result to hand out
+}
+
+func (e *entry) publish(result *r, info Info) {
+	// A copy: the maintainer carries on updating its own
+	p := &published{info: info}
+	if result != nil {
+		p.result, p.loaded = *result, true
+	}
+	e.current.Store(p)
+}
+
+func (e *entry) status() (r, Info, bool) {
+	p := e.current.Load()
+	if p == nil {
+		return r{}, Info{}, false
+	}
+	return p.result, p.info, p.loaded
+}
+
+func (e *entry) result() (r, bool) {
+	p := e.current.Load()
+	if p == nil || !p.loaded {
+		return r{}, false
+	}
+	return p.result, true
+}
+
+func (e *entry) loaded() bool {
+	_, ok := e.result()
+	return ok
+}
+
+func (e *entry) loader() Refresher {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.refresher
+}
+
+func (e *entry) setLoader(loader Refresher) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.refresher = loader
+}
+
+func (e *entry) touch() {
+	// Once it's been counted twice, there's no need to write to it again
+	for {
+		old := atomic.LoadUint32(&e.flags)
+		if old&touchMask >= 2 || atomic.CompareAndSwapUint32(&e.flags, old, old+1) {
+			return
+		}
+	}
+}
+
+// Touch an entry for a reader, noting the time if the maintainer goes by
+// how long it's been unused.
+func (cache *cache) touch(e *entry) {
+	if cache.idleTimeout > 0 || cache.oneShotTimeout > 0 {
+		atomic.StoreInt64(&e.extras.readAt, cache.clock.Now().UnixNano())
+	}
+	cache.heatUp(e)
+	e.touch()
+}
+
+// Whether an entry's maintainer is on its way out, having been stopped or
+// because the cache is closing.
+func (cache *cache) stopping(e *entry) bool {
+	if atomic.LoadUint32(&e.flags)&stoppedFlag != 0 {
+		return true
+	}
+	select {
+	case <-cache.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// When a reader last touched the entry, in Unix nanoseconds, if the cache
+// times reads; zero otherwise.
+func (e *entry) readAt() int64 {
+	if e.extras == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&e.extras.readAt)
+}
+
+// Stop the maintainer.
+func (e *entry) stop() {
+	e.signal(stoppedFlag)
+}
+
+// Stop the maintainer, saying why.
+func (e *entry) stopFor(reason Reason) {
+	for {
+		old := atomic.LoadUint32(&e.flags)
+		flags := old&^reasonMask | stoppedFlag | toldFlag | uint32(reason)<<reasonShift
+		if atomic.CompareAndSwapUint32(&e.flags, old, flags) {
+			break
+		}
+	}
+	e.poke()
+}
+
+// Why the maintainer was stopped, if it was told.
+func (e *entry) stoppedFor() (Reason, bool) {
+	flags := atomic.LoadUint32(&e.flags)
+	return Reason(flags & reasonMask >> reasonShift), flags&toldFlag != 0
+}
+
+// Report, and clear, how many times readers have touched the entry, up to
+// two.
+func (e *entry) touches() int32 {
+	return int32(e.clear(touchMask) & touchMask)
+}
+
+func New(ctx context.Context, refresher Refresher, positive func() Backoff, negative func() Backoff, opts ...Option) Cache {
+	c := newCache(ctx, refresher, positive, negative, opts...)
+	if c.expiryHeap > 0 {
+		// Its entries' refreshes are paced by the backoffs still
+		return scheduled(c, 0, 0, c.expiryHeap)
+	}
+	// Before anything starts, as it may panic
+	c.publish(c)
+	c.background()
+	return c
+}
+
+// Construct a cache, without starting anything in the background.
+func newCache(ctx context.Context, refresher Refresher, positive func() Backoff, negative func() Backoff, opts ...Option) *cache {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &cache{
 		ctx:       ctx,
+		cancel:    cancel,
 		refresher: refresher,
 		positive:  positive,
 		negative:  negative,
+		clock:     systemClock{},
+	}
+	c.evict = c.evictEntry
+	c.reap = c.reapEntries
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.kv.init(c.shards, c.snapshotMap)
+	c.flights = make([]flightStripe, len(c.kv.shards))
+	c.timers = c.clock
+	if c.timerResolution > 0 {
+		c.timers = newCoarseClock(c.clock, c.timerResolution)
+	}
+	if c.scheduler == nil {
+		c.scheduler = timerScheduler{c.timers}
+	}
+	if c.refreshWorkers > 0 {
+		c.workers = newWorkQueue(c.refreshWorkers, c.adaptiveWorkers, c.workerLatency)
+	} else if c.standby > 0 {
+		c.standingBy = make(chan func())
+	}
+	c.bound()
+	return c
+}
+
+// Start the goroutines that look after the cache as a whole.
+func (cache *cache) background() {
+	if cache.pressure != nil {
+		cache.running.Add(1)
+		go cache.shed()
+	}
+	if cache.sweepEvery > 0 {
+		cache.running.Add(1)
+		go cache.sweeper()
+	}
+	if coarse, ok := cache.timers.(*coarseClock); ok {
+		cache.running.Add(1)
+		go func() {
+			defer cache.running.Done()
+			coarse.run(cache.ctx)
+		}()
+	}
+	if cache.workers != nil {
+		cache.running.Add(cache.refreshWorkers)
+		for i := 0; i < cache.refreshWorkers; i++ {
+			go cache.work()
+		}
+	}
+	if cache.standingBy != nil {
+		cache.running.Add(cache.standby)
+		for i := 0; i < cache.standby; i++ {
+			go cache.standBy()
+		}
+	}
+}
+
+// Locate the entry for a key, starting a maintainer if there isn't one.
+// A new maintainer begins with the initial result, if one is given;
+// otherwise it computes one.
+func (cache *cache) entry(key Key, initial *r) (e *entry, started bool, err error) {
+	return cache.entryWith(nil, key, initial, cache.refresher)
+}
+
+// Locate the entry for a key on behalf of a reader, as entryWith does; but
+// a reader that's given up already doesn't start a maintainer, and a load,
+// for nobody.
+func (cache *cache) entryFor(ctx context.Context, key Key, refresher Refresher) (*entry, bool, error) {
+	if c, ok := cache.kv.Load(key); ok {
+		cache.found(key, c.(*entry))
+		return c.(*entry), false, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return cache.entryWith(ctx, key, nil, refresher)
+}
+
+// Locate the entry for a key as entry does; a new maintainer will use the
+// given refresher, and make its first load for the reader, if there is one.
+func (cache *cache) entryWith(reader context.Context, key Key, initial *r, refresher Refresher) (e *entry, started bool, err error) {
+	if c, ok := cache.kv.Load(key); ok {
+		cache.found(key, c.(*entry))
+		return c.(*entry), false, nil
+	}
+
+	cache.closing.RLock()
+	defer cache.closing.RUnlock()
+	if cache.ctx.Err() != nil {
+		return nil, false, ErrShutdown
+	}
+
+	newE := &entry{
+		nudge:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		extras:    cache.entryExtras(),
+		refresher: refresher,
+	}
+	key = cache.intern(key)
+	c, loaded := cache.kv.LoadOrStore(key, newE)
+	e = c.(*entry)
+	if loaded {
+		cache.unintern(key)
+		cache.found(key, e)
+	} else {
+		cache.admit(key)
+		if initial != nil {
+			var info Info
+			info.record(*initial, cache.clock.Now())
+			e.publish(initial, info)
+		}
+		cache.running.Add(1)
+		atomic.AddInt32(&cache.maintainers, 1)
+		go cache.maintain(key, e, initial, reader)
+	}
+	return e, !loaded, nil
+}
+
+func (cache *cache) Get(ctx context.Context, key Key, opts ...GetOption) (Value, error) {
+	key = cache.canonical(key)
+	if len(opts) == 0 {
+		// Which is to say, as the defaults have it
+		return cache.get(ctx, key)
+	}
+	o := getOptions{allowStale: cache.staleWhileRevalidate}.with(opts)
+
+	switch {
+	case o.forceRefresh && !o.allowStale:
+		return cache.RefreshAndGet(ctx, key)
+	case o.forceRefresh:
+		if err := cache.Refresh(ctx, key); err != nil {
+			return nil, err
+		}
+	case o.maxAge > 0:
+		value, info, err := cache.GetWithInfo(ctx, key)
+		if info.Refreshed.IsZero() || info.Age <= o.maxAge {
+			return value, err
+		}
+		if !o.allowStale {
+			return cache.RefreshAndGet(ctx, key)
+		}
+		if !info.Refreshing {
+			// Don't supersede a refresh that's already on its way
+			if err := cache.Refresh(ctx, key); err != nil {
+				return nil, err
+			}
+		}
+		return value, err
+	}
+	return cache.get(ctx, key)
+}
+
+func (cache *cache) get(ctx context.Context, key Key) (Value, error) {
+	if refuse, err := cache.refuse(key); err != nil {
+		return nil, err
+	} else if refuse {
+		return cache.loadOnce(ctx, key, cache.refresher)
+	}
+	for {
+		e, started, err := cache.entryFor(ctx, key, cache.refresher)
+		if err != nil {
+			return nil, err
+		}
+		if !started {
+			if p, ok := cache.hit(e); ok {
+				return p.result.Value, p.result.Err
+			}
+		}
+		result, ok, err := cache.receive(ctx, key, e, started)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// The maintainer exited, removing its entry from the store on the way out.
+			// Go round again to locate (or start) its successor.
+			continue
+		}
+		return result.Value, result.Err
+	}
+}
+
+// Serve a reader the value the maintainer last published, without troubling
+// it, unless there's none or the maintainer's on its way out. That counts as
+// a hit, and may prompt an early refresh.
+func (cache *cache) hit(e *entry) (*published, bool) {
+	p := e.current.Load()
+	if p == nil || !p.loaded || cache.stopping(e) {
+		return nil, false
+	}
+	cache.touch(e)
+	cache.stats.read(true)
+	if cache.refreshEarly(e, &p.info) {
+		e.signal(earlyFlag)
+	}
+	return p, true
+}
+
+// Have an entry's maintainer load its value again, if it's parked.
+func (cache *cache) wake(e *entry) {
+	if cache.parking {
+		e.signal(wakeFlag)
+	}
+}
+
+// XFetch: the nearer a refresh is due, and the longer it takes, the likelier
+// a read is to trigger it early.
+func (cache *cache) refreshEarly(e *entry, info *Info) bool {
+	if cache.earlyRefresh <= 0 || info.Refreshing || cache.blackedOut() {
+		return false
+	}
+	due, cost := atomic.LoadInt64(&e.extras.dueAt), atomic.LoadInt64(&e.extras.cost)
+	if due == 0 || cost == 0 {
+		return false
 	}
+	gap := float64(cost) * cache.earlyRefresh * math.Log(1-rand.Float64())
+	return cache.since(time.Unix(0, due)) >= time.Duration(gap)
 }
 
-func (cache *cache) Get(ctx context.Context, key Key) (Value, error) {
+// Receive the result a maintainer publishes, counting the read. It reports
+// false if the maintainer exits first. Readers that must wait for a load
+// may be turned away, if too many are waiting already; the rest wait at a
+// gate, and are released together.
+func (cache *cache) receive(ctx context.Context, key Key, e *entry, started bool) (r, bool, error) {
+	hit := !started && e.loaded()
+	if !hit {
+		cache.wake(e)
+	}
+	if !hit && cache.maxWaiters > 0 {
+		defer atomic.AddInt32(&e.extras.waiters, -1)
+		if atomic.AddInt32(&e.extras.waiters, 1) > cache.maxWaiters {
+			return r{}, false, &OverloadedError{Key: key, Waiters: int(cache.maxWaiters)}
+		}
+	}
+	for !cache.stopping(e) {
+		if g, ok := e.await(); ok {
+			return cache.queue(ctx, e, g)
+		}
+		// Unless it's been withdrawn again since
+		if result, ok := e.result(); ok {
+			cache.touch(e)
+			cache.stats.read(hit)
+			return result, true, nil
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return r{}, false, ctx.Err()
+	case <-e.done:
+		return r{}, false, nil
+	}
+}
+
+func (cache *cache) GetOrLoad(ctx context.Context, key Key, loader Refresher) (Value, error) {
+	key = cache.canonical(key)
+	if refuse, err := cache.refuse(key); err != nil {
+		return nil, err
+	} else if refuse {
+		return cache.loadOnce(ctx, key, loader)
+	}
 	for {
-		newCh := make(chan r)
-		c, loaded := cache.kv.LoadOrStore(key, newCh)
-		ch := c.(chan r)
-		if !loaded {
-			go cache.maintain(cache.ctx, key, ch)
+		e, started, err := cache.entryFor(ctx, key, loader)
+		if err != nil {
+			return nil, err
 		}
+		if !started {
+			e.setLoader(loader)
+			if p, ok := cache.hit(e); ok {
+				return p.result.Value, p.result.Err
+			}
+		}
+		result, ok, err := cache.receive(ctx, key, e, started)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		return result.Value, result.Err
+	}
+}
+
+func (cache *cache) GetIfPresent(key Key) (Value, bool) {
+	key = cache.canonical(key)
+	c, ok := cache.kv.Load(key)
+	if !ok {
+		cache.stats.read(false)
+		return nil, false
+	}
+	e := c.(*entry)
+	result, ok := e.result()
+	if !ok || result.Err != nil {
+		cache.stats.read(false)
+		return nil, false
+	}
+	cache.touch(e)
+	cache.stats.read(true)
+	return result.Value, true
+}
+
+func (cache *cache) Set(ctx context.Context, key Key, value Value) error {
+	return cache.SetWithError(ctx, key, value, nil)
+}
+
+func (cache *cache) SetWithError(ctx context.Context, key Key, value Value, err error) error {
+	key = cache.canonical(key)
+	set := &setting{r: cache.result(value, err), done: make(chan struct{})}
+	for {
+		e, started, err := cache.entry(key, &set.r)
+		if err != nil || started {
+			return err
+		}
+		// It's taken once it's been published
+		if ok, err := e.send(ctx, set, set.done); ok || err != nil {
+			return err
+		}
+	}
+}
+
+func (cache *cache) Update(ctx context.Context, key Key, fn func(old Value) (Value, error)) (Value, error) {
+	key = cache.canonical(key)
+	u := &update{fn: fn, reply: newReply()}
+	for {
+		e, _, err := cache.entryWith(ctx, key, nil, cache.refresher)
+		if err != nil {
+			return nil, err
+		}
+		cache.wake(e)
+		// The maintainer replies as soon as it has applied the update
+		e.post(u)
+		var result r
 		select {
+		case result = <-u.reply:
 		case <-ctx.Done():
-			return nil, ctx.Err()
-		case result, ok := <-ch:
-			if ok {
-				return result.Value, result.Err
-			}
-			// The channel was closed; we need to update the store with a new maintainer
-			// If two Get calls race here, one will come out the victor; the other maintenance
-			// loop will time out after a refresh
-			cache.kv.Delete(key)
-			continue
+			if e.withdraw(u) {
+				recycleReply(u.reply)
+				return nil, ctx.Err()
+			}
+			result = <-u.reply
+		case <-e.done:
+			if e.withdraw(u) {
+				continue
+			}
+			result = <-u.reply
 		}
+		recycleReply(u.reply)
+		return result.Value, result.Err
 	}
 }
 
-func (cache *cache) maintain(ctx context.Context, key Key, ch chan<- r) {
-	log := logrus.WithField("key", key)
+func (cache *cache) Warm(ctx context.Context, keys ...Key) error {
+	return warm(ctx, cache, keys)
+}
 
-	refreshCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// Get each of the keys from c concurrently, reporting the first error.
+func warm(ctx context.Context, c Cache, keys []Key) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(keys))
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key Key) {
+			defer wg.Done()
+			if _, err := c.Get(ctx, key); err != nil {
+				errs <- err
+			}
+		}(key)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func (cache *cache) Invalidate(ctx context.Context, key Key) error {
+	key = cache.canonical(key)
+	cache.discard(key)
+	c, ok := cache.kv.Load(key)
+	if !ok {
+		return nil
+	}
+	e := c.(*entry)
+	e.stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-e.done:
+		return nil
+	}
+}
+
+func (cache *cache) Pin(ctx context.Context, key Key) error {
+	key = cache.canonical(key)
+	cache.pinned.Store(key, struct{}{})
+	if _, _, err := cache.entryWith(ctx, key, nil, cache.refresher); err != nil {
+		cache.pinned.Delete(key)
+		return err
+	}
+	// It no longer counts towards the cache's bounds
+	cache.forget(key)
+	return nil
+}
+
+func (cache *cache) Unpin(key Key) {
+	key = cache.canonical(key)
+	cache.pinned.Delete(key)
+	if _, ok := cache.kv.Load(key); ok {
+		cache.admit(key)
+	}
+}
+
+func (cache *cache) isPinned(key Key) bool {
+	_, ok := cache.pinned.Load(key)
+	return ok
+}
+
+func (cache *cache) Refresh(ctx context.Context, key Key) error {
+	key = cache.canonical(key)
+	_, _, err := cache.forceRefresh(ctx, key, nil)
+	return err
+}
+
+func (cache *cache) RefreshAndGet(ctx context.Context, key Key) (Value, error) {
+	key = cache.canonical(key)
+	reply := newReply()
+	e, started, err := cache.forceRefresh(ctx, key, reply)
+	if err != nil || started {
+		// Nothing will be delivered
+		recycleReply(reply)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if started {
+		// The key is being loaded afresh anyway
+		return cache.get(ctx, key)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-reply:
+		recycleReply(reply)
+		return result.Value, result.Err
+	case <-e.done:
+		// The maintainer went away before the refresh landed; its successor loads afresh
+		return cache.get(ctx, key)
+	}
+}
+
+// Ask the maintainer for a key to refresh it, delivering the outcome to reply
+// if that's non-nil. A key that isn't resident is loaded instead, and nothing
+// is delivered.
+func (cache *cache) forceRefresh(ctx context.Context, key Key, reply chan<- r) (*entry, bool, error) {
+	for {
+		e, started, err := cache.entryWith(ctx, key, nil, cache.refresher)
+		if err != nil || started {
+			return e, started, err
+		}
+		// Readers are to see the refresh once we return
+		f := &forced{reply: reply, started: make(chan struct{}), reader: ctx}
+		if ok, err := e.send(ctx, f, f.started); err != nil {
+			return nil, false, err
+		} else if ok {
+			return e, false, nil
+		}
+	}
+}
+
+func (cache *cache) Purge() {
+	b := cache.newBatch()
+	var stopped []*entry
+	cache.kv.Range(func(_, c interface{}) bool {
+		e := c.(*entry)
+		e.join(b)
+		e.stop()
+		stopped = append(stopped, e)
+		return true
+	})
+	// Maintainers exit promptly once stopped; their refreshes are left to wind down
+	for _, e := range stopped {
+		<-e.done
+	}
+	cache.deliver(cache.ctx, b)
+}
+
+func (cache *cache) Keys() []Key {
+	var keys []Key
+	cache.kv.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+func (cache *cache) Len() int {
+	return cache.kv.Len()
+}
+
+func (cache *cache) Range(f func(key Key, value Value, err error) bool) {
+	// Gather everything first so that f sees a single view of the cache,
+	// and can call back into it freely.
+	type kr struct {
+		key Key
+		r
+	}
+	var entries []kr
+	cache.kv.Range(func(k, c interface{}) bool {
+		if result, ok := c.(*entry).result(); ok {
+			entries = append(entries, kr{key: k, r: result})
+		}
+		return true
+	})
+	for _, e := range entries {
+		if !f(e.key, e.Value, e.Err) {
+			return
+		}
+	}
+}
+
+func (cache *cache) Snapshot() map[Key]Value {
+	return snapshot(cache)
+}
+
+func (cache *cache) SizeOf(key Key) (int64, bool) {
+	key = cache.canonical(key)
+	c, ok := cache.kv.Load(key)
+	if !ok {
+		return 0, false
+	}
+	result, ok := c.(*entry).result()
+	if !ok || result.Err != nil {
+		return 0, false
+	}
+	return cache.size(key, result.Value), true
+}
+
+func (cache *cache) Sizes() (map[Key]int64, int64) {
+	return sizes(cache, cache.size)
+}
 
-	// Initialise the refresh loop
-	refresh := make(chan r, 1)
-	refreshing := false
+// Copy the successfully loaded values from c.
+func snapshot(c Cache) map[Key]Value {
+	snapshot := map[Key]Value{}
+	c.Range(func(key Key, value Value, err error) bool {
+		if err == nil {
+			snapshot[key] = value
+		}
+		return true
+	})
+	return snapshot
+}
+
+func (cache *cache) Close(ctx context.Context) error {
+	// Once the lock is released, no new maintainers can start
+	cache.unpublish()
+	b := cache.newBatch()
+	cache.shutdown.Store(b)
+	cache.closing.Lock()
+	cache.cancel()
+	cache.closing.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		cache.running.Wait()
+		close(stopped)
+	}()
+	defer cache.deliver(ctx, b)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stopped:
+		return nil
+	}
+}
+
+func (cache *cache) maintain(key Key, e *entry, initial *r, reader context.Context) {
+	defer cache.running.Done()
+	defer cache.scheduler.Cancel(key)
+	log := keyLogger{logger: cache.logger, key: key}
+
+	var result r  // What we hand out
+	var outcome r // The latest load, which differs from result when serving stale values
+	var info Info
+	serving := false // Whether we have a result to hand out, and to update
+	publish := func() {
+		if !serving {
+			e.publish(nil, info)
+		} else {
+			e.publish(&result, info)
+			cache.weigh(key, result)
+			e.release(result)
+			// Updates may have been waiting for it
+			e.remind()
+		}
+	}
+
+	// Refreshes run in the background, each reporting back on its own channel.
+	// A refresh that's overtaken by a Set is cancelled and its channel forgotten;
+	// the others' go back to the pool.
+	var refresh chan r
+	var began time.Time // When the latest refresh started
+	cancelRefresh := func() {}
+	startRefresh := func() {
+		began = cache.clock.Now()
+		refreshCtx, cancel := context.WithCancel(cache.ctx)
+		refresh, cancelRefresh = newReply(), cancel
+		var refreshed time.Time
+		if result.Err == nil {
+			refreshed = info.Refreshed
+		}
+		// The reader, if any, is that of this refresh alone
+		refreshCtx, reader = cache.traceFor(refreshCtx, reader, refreshed), nil
+		loader, landed := e.loader(), refresh
+		cache.spawn(refreshCtx, e.cool(), func() r {
+			return cache.load(refreshCtx, key, loader)
+		}, func(outcome r) {
+			landed <- outcome
+		})
+		info.Refreshing = true
+		publish()
+	}
+	abandonRefresh := func() {
+		cancelRefresh()
+		refresh = nil
+		info.Refreshing = false
+	}
+	defer func() { cancelRefresh() }()
+
+	var waiting []chan<- r // Callers awaiting the outcome of a forced refresh
+	deliver := func(outcome r) {
+		for _, reply := range waiting {
+			reply <- outcome
+		}
+		waiting = nil
+	}
+	var subscribers []subscriber
+	// Forget subscribers who've gone away
+	prune := func() {
+		live := subscribers[:0]
+		for _, sub := range subscribers {
+			if sub.ctx.Err() == nil {
+				live = append(live, sub)
+			} else {
+				close(sub.in)
+			}
+		}
+		subscribers = live
+	}
+	// Deliver the current value to subscribers
+	notify := func() {
+		if result.Err != nil {
+			return
+		}
+		for _, sub := range subscribers {
+			select {
+			case sub.in <- result.Value:
+			case <-sub.ctx.Done():
+			}
+		}
+		prune()
+	}
+	defer func() {
+		for _, sub := range subscribers {
+			close(sub.in)
+		}
+	}()
+
+	positive, negative := cache.backoffsFor(key)
+	failing := negative  // The backoff governing the latest run of failures
+	quarantined := false // Whether failures have stopped refreshes, bar probes
+	parked := false      // Whether the value's been withdrawn, and refreshes stopped, for want of use
+	var reason Reason    // Why we exit, once we do
+	// Why we're to exit, once we're stopped or the cache is closing
+	stopped := func() Reason {
+		if why, told := e.stoppedFor(); told {
+			return why
+		}
+		if cache.ctx.Err() != nil {
+			return ReasonShutdown
+		}
+		return ReasonInvalidated
+	}
 	var nextRefresh <-chan time.Time
+	refreshes := cache.refreshClock(key) // Times nextRefresh
+	// Stop refreshing, until schedule is next called
+	unschedule := func() {
+		nextRefresh = nil
+		cache.scheduler.Cancel(key)
+	}
+	jitter := false // Whether nextRefresh still has some jitter to add once it fires
+	// For early refreshes: when the next is due, and what we know of the refresh interval and cost.
+	// Readers see the due time and cost as they're published to the entry.
+	var due, scheduled time.Time
+	var interval, cost time.Duration
+	adaptive := cache.adaptiveMin // The refresh interval, when that follows how often the value changes
+	timed := false                // Whether nextRefresh is a positive delay, to be timed as it fires
+	schedule := func() {
+		jitter, timed, parked = false, false, false
+		scheduled, due = cache.clock.Now(), time.Time{}
+		if quarantined {
+			unschedule()
+			if cache.probation > 0 {
+				nextRefresh = refreshes.After(cache.probation)
+			}
+		} else if outcome.Err == nil {
+			positive.Reset()
+			negative.Reset()
+			failing.Reset()
+			if cache.noRefresh {
+				unschedule()
+			} else if outcome.ttl > 0 {
+				nextRefresh = refreshes.After(outcome.ttl)
+				due = scheduled.Add(outcome.ttl)
+			} else if cache.unchanged != nil {
+				nextRefresh = refreshes.After(adaptive)
+				jitter = cache.jitter > 0
+				due = scheduled.Add(adaptive)
+			} else {
+				nextRefresh = delayOn(refreshes, positive)
+				jitter, timed = cache.jitter > 0, true
+				if interval > 0 {
+					due = scheduled.Add(interval)
+				}
+			}
+		} else if wait, ok := retryAfter(outcome.Err); ok {
+			// The error says when to come back
+			nextRefresh = refreshes.After(wait)
+		} else {
+			failing = cache.negativeFor(outcome.Err, negative)
+			nextRefresh = delayOn(refreshes, failing)
+		}
+		if cache.earlyRefresh > 0 {
+			var at int64
+			if !due.IsZero() {
+				at = due.UnixNano()
+			}
+			atomic.StoreInt64(&e.extras.dueAt, at)
+			atomic.StoreInt64(&e.extras.cost, int64(cost))
+		}
+	}
+
+	// A value that's gone unrefreshed for too long is withdrawn, or refused
+	var expiry, tooOld <-chan time.Time
+	expire := func() {
+		expiry, tooOld = nil, nil
+		if result.Err != nil {
+			return
+		}
+		if cache.hardTTL > 0 {
+			expiry = cache.timers.After(cache.hardTTL)
+		}
+		if cache.maxAge > 0 {
+			tooOld = cache.timers.After(cache.maxAge)
+		}
+	}
 
-	// Generate the initial value
-	value, err := cache.refresher(ctx, key)
-	log.WithField("value", value).WithError(err).Debug("initialised value")
-	if err == nil {
-		cache.positive.Reset()
-		cache.negative.Reset()
-		nextRefresh = cache.positive.Delay()
+	// Generate the initial value, unless we were given one or it was demoted
+	if initial == nil {
+		if promoted, ok := cache.promote(key); ok {
+			info.record(promoted, cache.clock.Now())
+			e.publish(&promoted, info)
+			initial = &promoted
+		}
+	}
+	if initial != nil {
+		// The entry was published with this as it was created
+		result, info, _ = e.status()
+		outcome = result
+		log.Debug("initial value set", "value", result.Value, "error", result.Err)
+		serving = true
+		e.release(result)
+		expire()
+		schedule()
 	} else {
-		nextRefresh = cache.negative.Delay()
+		startRefresh()
 	}
-	result := r{Value: value, Err: err}
 
 	// Keep tabs on whether this value has been recently referred to
 	used := false
+	quiet, ahead := 0, cache.refreshAheadFor(key) // Refresh cycles gone unused, and how many we'll put up with
+	lastUsed := cache.clock.Now()
+	reads := 0 // Counted up to two, to tell keys read just once from the rest
+	markUsed := func() {
+		used = true
+		lastUsed = cache.clock.Now()
+		if reads < 2 {
+			reads++
+		}
+	}
+	// Take account of the uses that readers have counted
+	checkUsed := func() {
+		prune()
+		touches := e.touches()
+		if len(subscribers) > 0 || cache.isPinned(key) {
+			markUsed()
+		} else if touches > 0 {
+			last := lastUsed
+			markUsed()
+			// It was last used when it was read, rather than now
+			if at := e.readAt(); at != 0 {
+				if read := time.Unix(0, at); read.After(last) {
+					lastUsed = read
+				} else {
+					lastUsed = last
+				}
+			}
+		}
+		if touches > 1 {
+			reads = 2
+		}
+	}
+	// With an idle timeout, it's that rather than the refresh schedule which decides when to exit
+	var idle <-chan time.Time
+	if cache.idleTimeout > 0 {
+		idle = cache.timers.After(cache.idleTimeout)
+	}
+	// Keys read just once may go sooner
+	var oneShot <-chan time.Time
+	if cache.oneShotTimeout > 0 && !cache.keepUnused {
+		oneShot = cache.timers.After(cache.oneShotTimeout)
+	}
+	// A parked entry is loaded again once it's wanted; meanwhile, the old value is served if stale values are
+	unpark := func() {
+		log.Debug("unparking")
+		parked, quiet = false, 0
+		if cache.staleWhileRevalidate {
+			serving = true
+		}
+		if refresh == nil {
+			startRefresh()
+		} else {
+			publish()
+		}
+	}
+	// Or whether we've given up on it
+	failed := false
+	// However it's used, the entry may have a fixed lifetime
+	var lifetime <-chan time.Time
+	if cache.expireAfterWrite > 0 {
+		lifetime = cache.timers.After(cache.expireAfterWrite)
+	}
 loop:
 	for {
 		select {
-		case <-ctx.Done():
+		case <-cache.ctx.Done():
 			log.Debug("maintenance loop exits")
+			reason = stopped()
 			break loop
-		case ch <- result:
-			// We just send the updated r
-			used = true
-			log.WithField("value", result.Value).WithError(result.Err).Debug("value returned")
+		case <-e.nudge:
+			flags := e.clear(earlyFlag | wakeFlag)
+			if flags&stoppedFlag != 0 {
+				log.Debug("maintenance loop exits")
+				reason = stopped()
+				break loop
+			}
+			if flags&wakeFlag != 0 && parked {
+				unpark()
+			}
+			if flags&earlyFlag != 0 && refresh == nil && !cache.blackedOut() && cache.allowed() {
+				log.Debug("refreshing early")
+				unschedule()
+				startRefresh()
+			}
+			req, ok := e.next(serving)
+			if !ok {
+				continue loop
+			}
+			switch req := req.(type) {
+			case *setting:
+				// An externally-supplied value supersedes any refresh in flight
+				abandonRefresh()
+				result, outcome = req.r, req.r
+				failed, quarantined = false, false
+				info.Quarantined = false
+				log.Debug("value set", "value", result.Value, "error", result.Err)
+				info.record(result, cache.clock.Now())
+				serving = true
+				expire()
+				publish()
+				close(req.done)
+				deliver(result)
+				notify()
+				goto timer_reset
+			case *forced:
+				// So does a forced refresh: the one in flight may predate whatever prompted this
+				abandonRefresh()
+				log.Debug("forced refresh")
+				reader = req.reader
+				startRefresh()
+				close(req.started)
+				if req.reply != nil {
+					waiting = append(waiting, req.reply)
+				}
+			case *subscriber:
+				close(req.taken)
+				subscribers = append(subscribers, *req)
+				if parked {
+					unpark()
+				}
+				if serving && result.Err == nil {
+					select {
+					case req.in <- result.Value:
+					case <-req.ctx.Done():
+					}
+				}
+			case *update:
+				markUsed()
+				if result.Err != nil {
+					req.reply <- result
+					continue loop
+				}
+				value, err := req.fn(result.Value)
+				if err != nil {
+					req.reply <- r{Err: err}
+					continue loop
+				}
+				stowed := cache.stow(r{Value: value, ttl: result.ttl})
+				if stowed.Err != nil {
+					req.reply <- stowed
+					continue loop
+				}
+				result = stowed
+				log.Debug("value updated", "value", result.Value)
+				publish()
+				req.reply <- result
+				notify()
+			}
 		case <-nextRefresh:
-			if !used {
+			if timed {
+				timed = false
+				interval = cache.since(scheduled)
+			}
+			if jitter {
+				jitter = false
+				nextRefresh = refreshes.After(time.Duration(rand.Int63n(int64(cache.jitter))))
+				continue loop
+			}
+			checkUsed()
+			if used {
+				quiet = 0
+			} else {
+				quiet++
+			}
+			if quiet > ahead && cache.parking && !quarantined && !failed && serving && result.Err == nil {
+				// Withdraw the value, rather than refresh it for nobody, until it's read again
+				log.Debug("refresh on unused value, parking")
+				parked, expiry, tooOld = true, nil, nil
+				unschedule()
+				serving = false
+				publish()
+				continue loop
+			}
+			if quiet > ahead && cache.idleTimeout == 0 && !cache.keepUnused && !quarantined {
 				// We've not been requested for an entire refresh positive
 				log.Debug("refresh on unused value, exiting")
+				cache.stats.evicted()
+				cache.hooks.evicted(key, result.Value)
+				reason = ReasonUnused
 				break loop
 			}
+			if failed {
+				log.Debug("too many failed refreshes, exiting", "error", outcome.Err)
+				cache.stats.evicted()
+				cache.hooks.evicted(key, result.Value)
+				reason = ReasonFailure
+				break loop
+			}
+			if refresh == nil && !cache.blackedOut() && !cache.allowed() {
+				// Try again shortly, without counting that as another cycle
+				log.Debug("refresh postponed by rate limit")
+				nextRefresh = refreshes.After(cache.limitRetry)
+				continue loop
+			}
 			used = false
+			if wait := cache.blackout(); wait > 0 {
+				log.Debug("refresh postponed by blackout")
+				nextRefresh = refreshes.After(wait)
+				continue loop
+			}
 			// We may already be refreshing; don't do it twice
-			if !refreshing {
-				refreshing = true
+			if refresh == nil {
 				log.Debug("triggering a refresh")
-				go cache.refresh(refreshCtx, key, refresh)
+				startRefresh()
 				goto timer_reset
 			} else {
 				// If we've waited twice the refresh amount, warn
 				log.Warn("second time refreshing without value")
 			}
-		case result = <-refresh:
+		case <-idle:
+			checkUsed()
+			if quarantined {
+				// Stay put, so as to keep turning readers away
+				markUsed()
+			}
+			if remaining := cache.idleTimeout - cache.since(lastUsed); remaining > 0 {
+				idle = cache.timers.After(remaining)
+				continue loop
+			}
+			log.Debug("idle value, exiting")
+			cache.stats.evicted()
+			cache.hooks.evicted(key, result.Value)
+			reason = ReasonUnused
+			break loop
+		case <-oneShot:
+			checkUsed()
+			if reads > 1 || quarantined {
+				// The usual rules apply from here on
+				oneShot = nil
+				continue loop
+			}
+			if remaining := cache.oneShotTimeout - cache.since(lastUsed); remaining > 0 {
+				oneShot = cache.timers.After(remaining)
+				continue loop
+			}
+			log.Debug("value read just once, exiting")
+			cache.stats.evicted()
+			cache.hooks.evicted(key, result.Value)
+			reason = ReasonUnused
+			break loop
+		case <-lifetime:
+			log.Debug("entry lifetime over, exiting")
+			cache.stats.evicted()
+			cache.hooks.evicted(key, result.Value)
+			reason = ReasonExpired
+			break loop
+		case <-expiry:
+			if wait := cache.blackout(); wait > 0 {
+				// Carry on serving the value until we can refresh it
+				expiry = cache.timers.After(wait)
+				continue loop
+			}
+			if refresh == nil && !cache.allowed() {
+				// Likewise until the rate limit allows it
+				expiry = cache.timers.After(cache.limitRetry)
+				continue loop
+			}
+			// Readers wait for a fresh value from here on
+			expiry = nil
+			log.Debug("value expired", "value", result.Value)
+			serving = false
+			if refresh == nil {
+				startRefresh()
+			} else {
+				publish()
+			}
+		case <-tooOld:
+			// Readers are told the value is stale until a refresh succeeds
+			tooOld = nil
+			log.Debug("value too old to serve", "value", result.Value)
+			result = r{Err: ErrStale}
+			publish()
+			if refresh == nil && !cache.blackedOut() && cache.allowed() {
+				startRefresh()
+			}
+		case outcome = <-refresh:
+			recycleReply(refresh)
+			refresh = nil
+			cost = cache.since(began)
+			info.Refreshing = false
 			goto refresh
 		}
 		continue loop
 
 	refresh:
-		refreshing = false
-		log.WithField("value", result.Value).WithError(result.Err).Debug("refreshed value")
-	timer_reset:
-		if result.Err == nil {
-			cache.positive.Reset()
-			cache.negative.Reset()
-			nextRefresh = cache.positive.Delay()
-		} else {
-			nextRefresh = cache.negative.Delay()
+		log.Debug("refreshed value", "value", outcome.Value, "error", outcome.Err)
+		cache.landed(key, outcome)
+		info.record(outcome, cache.clock.Now())
+		deliver(outcome)
+		// Once we've given up, the error is served until the entry is dropped in place of the next refresh
+		failed = cache.maxErrors > 0 && info.Errors >= cache.maxErrors
+		// Past the quarantine threshold, refreshes stop and readers are turned away
+		quarantined = cache.quarantine > 0 && info.Errors >= cache.quarantine
+		info.Quarantined = quarantined
+		if quarantined {
+			log.Debug("quarantined", "error", outcome.Err)
+			result = r{Err: &QuarantineError{Key: key, Err: outcome.Err}}
+			serving = true
+			expire()
+			publish()
+			goto timer_reset
+		}
+		if outcome.Err != nil && cache.staleIfError && serving && result.Err == nil {
+			// Hang on to the last good value
+			log.Debug("serving stale value", "value", result.Value)
+			publish()
+			goto timer_reset
+		}
+		if outcome.Err != nil && result.Err == ErrStale {
+			// Carry on refusing the old value, rather than reporting this failure
+			publish()
+			goto timer_reset
+		}
+		if cache.unchanged != nil && outcome.Err == nil && serving && result.Err == nil {
+			// Back off from values that stay the same; close in on those that don't
+			if cache.unchanged(result.Value, outcome.Value) {
+				adaptive = minDuration(2*adaptive, cache.adaptiveMax)
+			} else {
+				adaptive = maxDuration(adaptive/2, cache.adaptiveMin)
+			}
 		}
+		result = outcome
+		serving = true
+		expire()
+		publish()
+		notify()
+	timer_reset:
+		schedule()
 	}
 
+	cache.forget(key)
 	cache.kv.Delete(key)
-	close(ch)
+	cache.unintern(key)
+	var b *batch
+	if e.extras != nil {
+		b = e.extras.batch.Load()
+	}
+	if b == nil && reason == ReasonShutdown {
+		b = cache.shutdown.Load()
+	}
+	cache.removed(key, result.Value, reason, b)
+	atomic.AddInt32(&cache.maintainers, -1)
+	close(e.done)
+	if cache.isPinned(key) {
+		// Start a successor straight away; this fails harmlessly once the cache is closed
+		cache.entryWith(nil, key, nil, e.loader())
+	}
 }
 
-func (cache *cache) refresh(ctx context.Context, key Key, refresh chan<- r) {
-	value, err := cache.refresher(ctx, key)
-	refresh <- r{Value: value, Err: err}
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// How many unused refresh cycles a key is kept warm across.
+func (cache *cache) refreshAheadFor(key Key) int {
+	if cache.refreshAheadKeys != nil && !cache.refreshAheadKeys(key) {
+		return 0
+	}
+	return cache.refreshAhead
+}
+
+// Choose the negative backoff for an error, falling back to the key's own.
+func (cache *cache) negativeFor(err error, negative Backoff) Backoff {
+	if cache.errorBackoffs != nil {
+		if b := cache.errorBackoffs(err); b != nil {
+			return b()
+		}
+	}
+	return negative
+}
+
+// Choose the backoffs for a key, falling back to the cache's own.
+func (cache *cache) backoffsFor(key Key) (positive, negative Backoff) {
+	var makePositive, makeNegative func() Backoff
+	if cache.backoffs != nil {
+		makePositive, makeNegative = cache.backoffs(key)
+	}
+	if makePositive == nil {
+		makePositive = cache.positive
+	}
+	if makeNegative == nil {
+		makeNegative = cache.negative
+	}
+	return makePositive(), makeNegative()
+}
+
+// Load a key's value, timing and tracing it.
+func (cache *cache) load(ctx context.Context, key Key, refresher Refresher) r {
+	began := cache.clock.Now()
+	ctx, traced := cache.trace(ctx, key)
+	result := cache.retrying(ctx, key, refresher)
+	cache.stats.took(cache.since(began))
+	if traced != nil {
+		traced(result.Value, result.Err)
+	}
+	return result
+}
+
+// Call the refresher, retrying it as configured should it fail.
+func (cache *cache) retrying(ctx context.Context, key Key, refresher Refresher) r {
+	result := cache.attempt(ctx, key, refresher)
+	if result.Err == nil || cache.retries == 0 {
+		return result
+	}
+	var backoff Backoff
+	if cache.retryBackoff != nil {
+		backoff = cache.retryBackoff()
+	}
+	for i := 0; i < cache.retries && result.Err != nil; i++ {
+		if _, ok := retryAfter(result.Err); ok {
+			// No sense in retrying before we've been told to
+			break
+		}
+		if backoff != nil {
+			wait := cache.delay(backoff)
+			if wait == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return result
+			case <-wait:
+			}
+		} else if ctx.Err() != nil {
+			return result
+		}
+		cache.debug("retrying refresh", "key", key, "error", result.Err)
+		result = cache.attempt(ctx, key, refresher)
+	}
+	return result
+}
+
+// Call the refresher once, within the refresh timeout if there is one.
+func (cache *cache) attempt(ctx context.Context, key Key, refresher Refresher) r {
+	if cache.refreshTimeout > 0 {
+		return cache.loadWithin(ctx, key, refresher, cache.refreshTimeout)
+	}
+	return cache.invoke(ctx, key, refresher)
+}
+
+// Call the refresher, hedging the call if so configured.
+func (cache *cache) invoke(ctx context.Context, key Key, refresher Refresher) r {
+	if cache.hedge > 0 {
+		return cache.hedged(ctx, key, refresher, cache.hedge)
+	}
+	return cache.call(ctx, key, refresher)
+}
+
+// Call the refresher, calling it a second time if the first call hasn't
+// returned after the given delay. Whichever returns first wins; the other
+// is cancelled.
+func (cache *cache) hedged(ctx context.Context, key Key, refresher Refresher, delay time.Duration) r {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	outcomes := make(chan r, 2)
+	call := func() {
+		outcomes <- cache.call(ctx, key, refresher)
+	}
+	go call()
+
+	hedge := cache.timer(delay)
+	defer cache.recycleTimer(hedge)
+	select {
+	case result := <-outcomes:
+		return result
+	case <-ctx.Done():
+		return r{Err: &RefreshError{Key: key, Err: ctx.Err()}}
+	case <-hedge.C():
+	}
+	cache.debug("hedging refresh", "key", key)
+	go call()
+	select {
+	case result := <-outcomes:
+		return result
+	case <-ctx.Done():
+		return r{Err: &RefreshError{Key: key, Err: ctx.Err()}}
+	}
+}
+
+// Call the refresher, packaging up its outcome.
+func (cache *cache) call(ctx context.Context, key Key, refresher Refresher) r {
+	value, err := refresher(ctx, key)
+	if err != nil {
+		err = &RefreshError{Key: key, Err: err}
+	}
+	return cache.result(value, err)
+}
+
+// Call the refresher, but give up on it if it's still going after the
+// timeout, leaving it to finish in the background.
+func (cache *cache) loadWithin(ctx context.Context, key Key, refresher Refresher, timeout time.Duration) r {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	loaded := make(chan r, 1)
+	go func() {
+		loaded <- cache.invoke(ctx, key, refresher)
+	}()
+
+	select {
+	case result := <-loaded:
+		// A refresher that gives up at the deadline has timed out too
+		if result.Err == nil || ctx.Err() != context.DeadlineExceeded {
+			return result
+		}
+	case <-ctx.Done():
+		if ctx.Err() != context.DeadlineExceeded {
+			return r{Err: &RefreshError{Key: key, Err: ctx.Err()}}
+		}
+	}
+	cache.warn("refresh timed out", "key", key)
+	cache.stats.timedOut()
+	cache.hooks.timedOut(key)
+	return r{Err: &RefreshError{Key: key, Err: ErrTimeout}}
 }
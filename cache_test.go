@@ -2,28 +2,30 @@ package cache
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
-	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
-
-	"github.com/jan-g/delay"
 )
 
-func init() {
-	logrus.SetLevel(logrus.DebugLevel)
-}
-
 const (
 	period = 200 * time.Millisecond
 )
 
 var (
-	positive = delay.New(2 * period)
-	negative = delay.New(period, delay.WithMultiplier(2), delay.WithMaximum(5*period))
+	positive = Every(2 * period)
+	negative = FromSchedule(func() Schedule { return &doubling{initial: period, next: period, max: 5 * period} })
 )
 
 type refresher struct {
@@ -31,6 +33,7 @@ type refresher struct {
 	errBefore int
 	err       error
 	period    time.Duration
+	clock     Clock // What each refresh takes its period on; the system clock, if nil
 }
 
 func (r *refresher) refresh(ctx context.Context, key Key) (Value, error) {
@@ -44,7 +47,7 @@ func (r *refresher) refresh(ctx context.Context, key Key) (Value, error) {
 		case <-ctx.Done():
 			fmt.Println("cancelled refresh of", key)
 			return nil, ctx.Err()
-		case <-time.After(r.period):
+		case <-r.after(r.period):
 		}
 	}
 	r.i++
@@ -52,6 +55,21 @@ func (r *refresher) refresh(ctx context.Context, key Key) (Value, error) {
 	return r.i, nil
 }
 
+func (r *refresher) after(d time.Duration) <-chan time.Time {
+	if r.clock != nil {
+		return r.clock.After(d)
+	}
+	return time.After(d)
+}
+
+// Get a key, moving the clock on for as long as its load takes.
+func getOn(clock *fakeClock, c Cache, key Key) (v Value, e error) {
+	clock.During(func() {
+		v, e = c.Get(context.Background(), key)
+	})
+	return v, e
+}
+
 func TestInitalLoad(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -66,18 +84,19 @@ func TestInitalLoad(t *testing.T) {
 
 func TestRefresh(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	c := New(ctx, (&refresher{period: period}).refresh, positive, negative)
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, clock: clock}).refresh, positive, negative, WithClock(clock))
 
-	v, e := c.Get(context.Background(), "foo")
+	v, e := getOn(clock, c, "foo")
 	assert.Nil(t, e)
 	assert.Equal(t, 1, v)
 
-	time.Sleep(period)
+	clock.Sleep(period)
 	v, e = c.Get(context.Background(), "foo")
 	assert.Nil(t, e)
 	assert.Equal(t, 1, v)
 
-	time.Sleep(3 * period)
+	clock.Sleep(3 * period)
 	v, e = c.Get(context.Background(), "foo")
 	assert.Nil(t, e)
 	assert.Equal(t, 2, v)
@@ -87,13 +106,14 @@ func TestRefresh(t *testing.T) {
 
 func TestCleanUnusedValues(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	c := New(ctx, (&refresher{period: period}).refresh, positive, negative).(*cache)
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, clock: clock}).refresh, positive, negative, WithClock(clock)).(*cache)
 
-	v, e := c.Get(context.Background(), "foo")
+	v, e := getOn(clock, c, "foo")
 	assert.Nil(t, e)
 	assert.Equal(t, 1, v)
 
-	time.Sleep(period / 2)
+	clock.Sleep(period / 2)
 
 	for i := 0; i < 7; i++ {
 		// 0.5: still cached
@@ -109,12 +129,12 @@ func TestCleanUnusedValues(t *testing.T) {
 		_, ok := c.kv.Load("foo")
 		fmt.Println("i=", i, "; key present?", ok)
 		assert.Equal(t, i < 5, ok)
-		time.Sleep(period)
+		clock.Sleep(period)
 	}
 
 	// The computation of the next value will be the third
 	// time we've called the refresh function
-	v, e = c.Get(context.Background(), "foo")
+	v, e = getOn(clock, c, "foo")
 	assert.Nil(t, e)
 	assert.Equal(t, 3, v)
 
@@ -123,13 +143,14 @@ func TestCleanUnusedValues(t *testing.T) {
 
 func TestHardDelay(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	c := New(ctx, (&refresher{period: 3 * period}).refresh, positive, negative).(*cache)
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: 3 * period, clock: clock}).refresh, positive, negative, WithClock(clock)).(*cache)
 
-	v, e := c.Get(context.Background(), "foo")
+	v, e := getOn(clock, c, "foo")
 	assert.Nil(t, e)
 	assert.Equal(t, 1, v)
 
-	time.Sleep(period / 2)
+	clock.Sleep(period / 2)
 
 	for i := 0; i < 6; i++ {
 		// 0.5: still cached
@@ -146,7 +167,7 @@ func TestHardDelay(t *testing.T) {
 		fmt.Println("i=", i, "; key present?", ok, "value=", v)
 		assert.Equal(t, 1+(i/5), v)
 		assert.Nil(t, e)
-		time.Sleep(period)
+		clock.Sleep(period)
 	}
 
 	// The computation of the next value will be the third
@@ -160,21 +181,2574 @@ func TestHardDelay(t *testing.T) {
 
 func TestErrorBackoff(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	c := New(ctx, (&refresher{period: period, errBefore: 2, err: errors.New("an error")}).refresh, positive, negative)
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, errBefore: 2, err: errors.New("an error"), clock: clock}).refresh, positive, negative, WithClock(clock))
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Equal(t, "an error", e.Error())
+	assert.Nil(t, v)
+
+	clock.Sleep(period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Equal(t, "an error", e.Error())
+	assert.Nil(t, v)
+
+	// Refreshes fail at 0 and 1, then succeed at 5, landing at 6
+	clock.Sleep(6 * period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 3, v)
+
+	cancel()
+}
+
+func TestTyped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &refresher{period: period}
+	c := NewTyped(ctx, func(ctx context.Context, key string) (int, error) {
+		v, err := r.refresh(ctx, key)
+		return value[int](v), err
+	}, positive, negative)
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	cancel()
+}
+
+func TestTypedError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &refresher{period: period, errBefore: 1, err: errors.New("an error")}
+	c := NewTyped(ctx, func(ctx context.Context, key string) (int, error) {
+		v, err := r.refresh(ctx, key)
+		return value[int](v), err
+	}, positive, negative)
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Equal(t, "an error", e.Error())
+	assert.Equal(t, 0, v)
+
+	cancel()
+}
+
+func TestSet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, clock: clock}).refresh, positive, negative, WithClock(clock))
 
+	// Seeding a key means the refresher isn't consulted
+	assert.Nil(t, c.Set(context.Background(), "foo", 42))
 	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 42, v)
+
+	// Overwriting a live key replaces its value
+	assert.Nil(t, c.SetWithError(context.Background(), "foo", nil, errors.New("an error")))
+	v, e = c.Get(context.Background(), "foo")
 	assert.Equal(t, "an error", e.Error())
 	assert.Nil(t, v)
 
-	time.Sleep(period)
+	assert.Nil(t, c.Set(context.Background(), "foo", 43))
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 43, v)
+
+	// The refresher takes over after a positive delay
+	clock.Sleep(4 * period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	cancel()
+}
+
+func TestSetOverridesRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: 3 * period, clock: clock}).refresh, positive, negative, WithClock(clock))
+
+	got := make(chan Value)
+	go func() {
+		v, e := c.Get(context.Background(), "foo")
+		assert.Nil(t, e)
+		got <- v
+	}()
+	clock.Sleep(period)
+	assert.Nil(t, c.Set(context.Background(), "foo", 42))
+
+	// The initial load is abandoned in favour of the value that was set
+	assert.Equal(t, 42, <-got)
+
+	cancel()
+}
+
+func TestInvalidate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, (&refresher{period: period}).refresh, positive, negative).(*cache)
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	assert.Nil(t, c.Invalidate(context.Background(), "foo"))
+	_, ok := c.kv.Load("foo")
+	assert.False(t, ok)
+
+	// The next Get reloads the value
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+
+	// Invalidating an absent key is harmless
+	assert.Nil(t, c.Invalidate(context.Background(), "bar"))
+
+	cancel()
+}
+
+func TestPurge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, (&refresher{period: period}).refresh, positive, negative).(*cache)
+
+	assert.Nil(t, c.Set(context.Background(), "foo", 42))
+	assert.Nil(t, c.Set(context.Background(), "bar", 43))
+
+	c.Purge()
+	_, ok := c.kv.Load("foo")
+	assert.False(t, ok)
+	_, ok = c.kv.Load("bar")
+	assert.False(t, ok)
+
+	// The cache is still usable
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	cancel()
+}
+
+func TestGetIfPresent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, clock: clock}).refresh, positive, negative, WithClock(clock)).(*cache)
+
+	// A miss doesn't start a load
+	_, ok := c.GetIfPresent("foo")
+	assert.False(t, ok)
+	_, ok = c.kv.Load("foo")
+	assert.False(t, ok)
+
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	v, ok = c.GetIfPresent("foo")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	// Reads through GetIfPresent keep the value live
+	for i := 0; i < 5; i++ {
+		clock.Sleep(period)
+		_, ok = c.GetIfPresent("foo")
+		assert.True(t, ok)
+	}
+
+	// Errors aren't reported as present
+	assert.Nil(t, c.SetWithError(context.Background(), "bar", nil, errors.New("an error")))
+	_, ok = c.GetIfPresent("bar")
+	assert.False(t, ok)
+
+	cancel()
+}
+
+func TestConcurrentReads(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, (&refresher{period: period / 10}).refresh, Every(period), Every(period))
+
+	_, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+
+	// Readers of a loaded value take it without waiting on one another, and
+	// their reads keep it in use across refreshes
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(10 * period)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c.Stats().Refreshes < 3 && time.Now().Before(deadline) {
+				_, e := c.Get(context.Background(), "foo")
+				assert.Nil(t, e)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, c.Len())
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.True(t, stats.Refreshes >= 3)
+
+	cancel()
+}
+
+func TestKeysAndLen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, (&refresher{period: period}).refresh, positive, negative)
+
+	assert.Equal(t, 0, c.Len())
+	assert.Empty(t, c.Keys())
+
+	assert.Nil(t, c.Set(context.Background(), "foo", 42))
+	assert.Nil(t, c.Set(context.Background(), "bar", 43))
+	assert.Equal(t, 2, c.Len())
+	assert.ElementsMatch(t, []Key{"foo", "bar"}, c.Keys())
+
+	assert.Nil(t, c.Invalidate(context.Background(), "foo"))
+	assert.Equal(t, 1, c.Len())
+	assert.Equal(t, []Key{"bar"}, c.Keys())
+
+	cancel()
+}
+
+func TestRange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, (&refresher{period: period}).refresh, positive, negative)
+
+	assert.Nil(t, c.Set(context.Background(), "foo", 42))
+	assert.Nil(t, c.SetWithError(context.Background(), "bar", nil, errors.New("an error")))
+
+	values := map[Key]Value{}
+	errs := map[Key]error{}
+	c.Range(func(key Key, value Value, err error) bool {
+		values[key] = value
+		errs[key] = err
+		return true
+	})
+	assert.Equal(t, map[Key]Value{"foo": 42, "bar": nil}, values)
+	assert.Nil(t, errs["foo"])
+	assert.Equal(t, "an error", errs["bar"].Error())
+
+	// Returning false stops the iteration
+	n := 0
+	c.Range(func(Key, Value, error) bool {
+		n++
+		return false
+	})
+	assert.Equal(t, 1, n)
+
+	cancel()
+}
+
+func TestClose(t *testing.T) {
+	clock := newFakeClock()
+	c := New(context.Background(), (&refresher{period: period, clock: clock}).refresh, positive, negative, WithClock(clock))
+
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Leave a load in flight
+	go c.Get(context.Background(), "bar")
+	clock.Sleep(period / 2)
+
+	assert.Nil(t, c.Close(context.Background()))
+	assert.Equal(t, 0, c.Len())
+
+	_, e = c.Get(context.Background(), "foo")
+	assert.Equal(t, ErrShutdown, e)
+	assert.Equal(t, ErrShutdown, c.Set(context.Background(), "foo", 42))
+}
+
+func TestCloseTimeout(t *testing.T) {
+	started := make(chan struct{})
+	stuck := make(chan struct{})
+	defer close(stuck)
+	c := New(context.Background(), func(ctx context.Context, key Key) (Value, error) {
+		// A refresher that ignores cancellation
+		close(started)
+		<-stuck
+		return nil, nil
+	}, positive, negative)
+
+	go c.Get(context.Background(), "foo")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), period/4)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, c.Close(ctx))
+}
+
+func TestForceRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, clock: clock}).refresh, positive, negative, WithClock(clock))
+
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// A refresh happens in the background; the old value is served meanwhile
+	assert.Nil(t, c.Refresh(context.Background(), "foo"))
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	clock.Sleep(3 * period / 2)
 	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+
+	// We can wait for the refreshed value instead
+	clock.During(func() {
+		v, e = c.RefreshAndGet(context.Background(), "foo")
+	})
+	assert.Nil(t, e)
+	assert.Equal(t, 3, v)
+
+	// Refreshing an absent key loads it
+	clock.During(func() {
+		v, e = c.RefreshAndGet(context.Background(), "bar")
+	})
+	assert.Nil(t, e)
+	assert.Equal(t, 4, v)
+
+	cancel()
+}
+
+func TestGetWithInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, errBefore: 1, err: errors.New("an error"), clock: clock}).refresh, positive, negative, WithClock(clock))
+
+	v, info, e := c.GetWithInfo(context.Background(), "foo")
 	assert.Equal(t, "an error", e.Error())
 	assert.Nil(t, v)
+	assert.True(t, info.Refreshed.IsZero())
+	assert.Equal(t, 1, info.Errors)
+	assert.False(t, info.Refreshing)
+
+	clock.Sleep(period / 4)
+	assert.Nil(t, c.Refresh(context.Background(), "foo"))
+	v, info, e = c.GetWithInfo(context.Background(), "foo")
+	assert.Equal(t, "an error", e.Error())
+	assert.True(t, info.Refreshing)
+
+	clock.Sleep(3 * period / 2)
+	v, info, e = c.GetWithInfo(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+	assert.Equal(t, 0, info.Errors)
+	assert.False(t, info.Refreshing)
+	assert.Equal(t, clock.Now().Add(-period/2), info.Refreshed)
+	assert.Equal(t, period/2, info.Age)
+
+	cancel()
+}
+
+func TestGetOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, clock: clock}).refresh, positive, negative, WithClock(clock))
+
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Young enough
+	v, e = c.Get(context.Background(), "foo", MaxAge(period))
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Too old: wait for a refresh
+	clock.Sleep(period / 2)
+	clock.During(func() {
+		v, e = c.Get(context.Background(), "foo", MaxAge(period/4))
+	})
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
 
-	time.Sleep(7 * period)
+	// Too old, but we'll take it while it refreshes
+	clock.Sleep(period / 2)
+	v, e = c.Get(context.Background(), "foo", MaxAge(period/4), AllowStale())
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+	clock.Sleep(3 * period / 2)
 	v, e = c.Get(context.Background(), "foo")
 	assert.Nil(t, e)
 	assert.Equal(t, 3, v)
 
+	clock.During(func() {
+		v, e = c.Get(context.Background(), "foo", ForceRefresh())
+	})
+	assert.Nil(t, e)
+	assert.Equal(t, 4, v)
+
+	v, e = c.Get(context.Background(), "foo", ForceRefresh(), AllowStale())
+	assert.Nil(t, e)
+	assert.Equal(t, 4, v)
+
+	cancel()
+}
+
+func TestGetOrLoad(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, clock: clock}).refresh, positive, negative, WithClock(clock))
+
+	loader := func(token string) Refresher {
+		return func(ctx context.Context, key Key) (Value, error) {
+			return fmt.Sprint(key, ":", token), nil
+		}
+	}
+
+	v, e := c.GetOrLoad(context.Background(), "foo", loader("a"))
+	assert.Nil(t, e)
+	assert.Equal(t, "foo:a", v)
+
+	// Resident values are shared, but the latest loader is used to refresh them
+	v, e = c.GetOrLoad(context.Background(), "foo", loader("b"))
+	assert.Nil(t, e)
+	assert.Equal(t, "foo:a", v)
+	clock.Sleep(3 * period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, "foo:b", v)
+
+	// Other keys are unaffected
+	v, e = getOn(clock, c, "bar")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	cancel()
+}
+
+func TestUpdate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, (&refresher{period: period}).refresh, positive, negative)
+
+	// Concurrent updates are serialized
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, e := c.Update(context.Background(), "foo", func(old Value) (Value, error) {
+				return old.(int) + 1, nil
+			})
+			assert.Nil(t, e)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 11, v)
+
+	// A failed update leaves the value alone
+	v, e = c.Update(context.Background(), "foo", func(old Value) (Value, error) {
+		return nil, errors.New("an error")
+	})
+	assert.Equal(t, "an error", e.Error())
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 11, v)
+
+	// As does updating an error
+	assert.Nil(t, c.SetWithError(context.Background(), "bar", nil, errors.New("another error")))
+	_, e = c.Update(context.Background(), "bar", func(old Value) (Value, error) {
+		t.Fatal("update of an error")
+		return nil, nil
+	})
+	assert.Equal(t, "another error", e.Error())
+
+	cancel()
+}
+
+func TestUpdateGivenUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		<-release
+		return 1, nil
+	}, positive, negative)
+
+	// An update waits for a value to update; one given up on meanwhile is
+	// never applied
+	updateCtx, giveUp := context.WithTimeout(context.Background(), period/10)
+	defer giveUp()
+	_, e := c.Update(updateCtx, "foo", func(old Value) (Value, error) {
+		t.Error("update applied after it was given up on")
+		return old, nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, e)
+	close(release)
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
 	cancel()
 }
+
+func TestEntrySize(t *testing.T) {
+	// Each key has one besides its maintainer, so they're kept small
+	assert.LessOrEqual(t, int(unsafe.Sizeof(entry{})), 88)
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, clock: clock}).refresh, positive, negative, WithClock(clock))
+
+	subCtx, unsubscribe := context.WithCancel(context.Background())
+	values, e := c.Subscribe(subCtx, "foo")
+	assert.Nil(t, e)
+
+	// The subscription alone keeps the key live and refreshing
+	for i := 1; i <= 3; i++ {
+		var v Value
+		clock.During(func() { v = <-values })
+		assert.Equal(t, i, v)
+	}
+
+	// Sets and updates are also reported
+	assert.Nil(t, c.Set(context.Background(), "foo", 42))
+	assert.Equal(t, 42, <-values)
+	_, e = c.Update(context.Background(), "foo", func(old Value) (Value, error) {
+		return old.(int) + 1, nil
+	})
+	assert.Nil(t, e)
+	assert.Equal(t, 43, <-values)
+
+	// A late subscriber sees the current value first
+	late, e := c.Subscribe(subCtx, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 43, <-late)
+
+	unsubscribe()
+	for range values {
+		// Drain anything that was already on its way
+	}
+
+	cancel()
+}
+
+func TestHooks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	events := make(chan string, 10)
+	c := New(ctx, (&refresher{period: period, errBefore: 1, err: errors.New("an error"), clock: clock}).refresh, positive, negative,
+		WithClock(clock),
+		WithHooks(Hooks{
+			OnRefresh: func(key Key, value Value) { events <- fmt.Sprint("refresh ", key, " ", value) },
+			OnError:   func(key Key, err error) { events <- fmt.Sprint("error ", key, " ", err) },
+			OnEvict:   func(key Key, value Value) { events <- fmt.Sprint("evict ", key, " ", value) },
+		}))
+
+	_, e := c.Get(context.Background(), "foo")
+	assert.Equal(t, "an error", e.Error())
+	assert.Equal(t, "error foo an error", <-events)
+
+	// The negative delay brings a refresh
+	var event string
+	clock.During(func() { event = <-events })
+	assert.Equal(t, "refresh foo 2", event)
+
+	// Which is no longer used
+	clock.During(func() { event = <-events })
+	assert.Equal(t, "evict foo 2", event)
+
+	cancel()
+}
+
+func TestRemovalReasons(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan string, 10)
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return fmt.Sprint(key, "!"), nil
+	}, positive, negative, WithMaxEntries(2), WithKeepUnused(), WithHooks(Hooks{
+		OnRemove: func(key Key, value Value, reason Reason) { events <- fmt.Sprint(reason, " ", key, " ", value) },
+	}))
+
+	for _, key := range []string{"foo", "bar", "baz"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+	assert.Equal(t, "capacity foo foo!", <-events)
+
+	assert.Nil(t, c.Invalidate(context.Background(), "bar"))
+	assert.Equal(t, "invalidated bar bar!", <-events)
+
+	assert.Nil(t, c.Close(context.Background()))
+	assert.Equal(t, "shutdown baz baz!", <-events)
+
+	cancel()
+}
+
+func TestRemoveBatch(t *testing.T) {
+	type ctxKey struct{}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan string, 10)
+	batches := make(chan []string, 10)
+	hooks := WithHooks(Hooks{
+		OnRemove: func(key Key, value Value, reason Reason) { events <- fmt.Sprint(reason, " ", key) },
+		OnRemoveBatch: func(ctx context.Context, removals []Removal) {
+			var batch []string
+			for _, r := range removals {
+				batch = append(batch, fmt.Sprint(r.Reason, " ", r.Key, " ", r.Value))
+			}
+			if ctx.Value(ctxKey{}) != nil {
+				batch = append(batch, "closing")
+			}
+			sort.Strings(batch)
+			batches <- batch
+		},
+	})
+	load := func(ctx context.Context, key Key) (Value, error) {
+		return fmt.Sprint(key, "!"), nil
+	}
+	get := func(c Cache, keys ...string) {
+		for _, key := range keys {
+			_, e := c.Get(context.Background(), key)
+			assert.Nil(t, e)
+		}
+	}
+	closing := context.WithValue(context.Background(), ctxKey{}, true)
+
+	for _, c := range []Cache{
+		New(ctx, load, positive, negative, WithMaxEntries(4), WithKeepUnused(), hooks),
+		NewOnDemand(ctx, load, time.Hour, time.Hour, WithMaxEntries(4), hooks),
+	} {
+		get(c, "a", "b", "c", "d")
+
+		// Those evicted by shrinking the cache are reported together
+		assert.Nil(t, c.SetMaxEntries(1))
+		assert.Equal(t, []string{"capacity a a!", "capacity b b!", "capacity c c!"}, <-batches)
+
+		// As are those purged
+		assert.Nil(t, c.SetMaxEntries(0))
+		get(c, "e", "f")
+		c.Purge()
+		assert.Equal(t, []string{"invalidated d d!", "invalidated e e!", "invalidated f f!"}, <-batches)
+
+		// Those removed alone are reported alone
+		get(c, "g", "h")
+		assert.Nil(t, c.Invalidate(context.Background(), "g"))
+		assert.Equal(t, "invalidated g", <-events)
+
+		// And those left at shutdown are reported with the context given to Close
+		assert.Nil(t, c.Close(closing))
+		assert.Equal(t, []string{"closing", "shutdown h h!"}, <-batches)
+		assert.Empty(t, events)
+		assert.Empty(t, batches)
+	}
+
+	cancel()
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, (&refresher{period: period}).refresh, positive, negative)
+
+	assert.Nil(t, c.Set(context.Background(), "foo", 42))
+	assert.Nil(t, c.SetWithError(context.Background(), "bar", nil, errors.New("an error")))
+	assert.Nil(t, c.Set(context.Background(), "baz", 43))
+
+	assert.Equal(t, map[Key]Value{"foo": 42, "baz": 43}, c.Snapshot())
+
+	cancel()
+}
+
+func TestWarm(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		<-clock.After(period)
+		if key == "bad" {
+			return nil, errors.New("an error")
+		}
+		return fmt.Sprint(key, "!"), nil
+	}, positive, negative, WithClock(clock))
+
+	start := clock.Now()
+	clock.During(func() {
+		assert.Nil(t, c.Warm(context.Background(), "foo", "bar", "baz"))
+	})
+	assert.Equal(t, period, clock.Now().Sub(start), "loads happen concurrently")
+	assert.Equal(t, map[Key]Value{"foo": "foo!", "bar": "bar!", "baz": "baz!"}, c.Snapshot())
+
+	clock.During(func() {
+		assert.Equal(t, "an error", c.Warm(context.Background(), "foo", "bad").Error())
+	})
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), period/2)
+	defer cancelTimeout()
+	assert.Equal(t, context.DeadlineExceeded, c.Warm(timeout, "qux"))
+
+	cancel()
+}
+
+func TestStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period / 4, errBefore: 1, err: errors.New("an error"), clock: clock}).refresh, Every(2*period), Every(period), WithClock(clock))
+
+	_, e := c.Get(context.Background(), "foo")
+	assert.NotNil(t, e)
+	_, e = c.Get(context.Background(), "foo")
+	assert.NotNil(t, e)
+	_, ok := c.GetIfPresent("bar")
+	assert.False(t, ok)
+
+	s := c.Stats()
+	s.RefreshTime = 0
+	assert.Equal(t, Stats{Hits: 1, Misses: 2, RefreshErrors: 1, Entries: 1, Maintainers: 1}, s)
+
+	// Wait for the error to be refreshed away, then go unused
+	clock.Sleep(6 * period)
+	s = c.Stats()
+	assert.Equal(t, period/4, s.RefreshTime, "the successful refresh took a while")
+	s.RefreshTime = 0
+	assert.Equal(t, Stats{Hits: 1, Misses: 2, Refreshes: 1, RefreshErrors: 1, Evictions: 1}, s)
+
+	cancel()
+}
+
+func TestStaleIfError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	failing := false
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		if failing {
+			return nil, errors.New("an error")
+		}
+		return 42, nil
+	}, Every(2*period), Every(period), WithStaleIfError(), WithClock(clock))
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 42, v)
+
+	failing = true
+	v, e = c.RefreshAndGet(context.Background(), "foo")
+	assert.Equal(t, "an error", e.Error())
+	assert.Nil(t, v)
+
+	// But readers continue to see the last good value
+	v, info, e := c.GetWithInfo(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 42, v)
+	assert.Equal(t, 1, info.Errors)
+	assert.Equal(t, "an error", info.LastError.Error())
+
+	// The failed refresh is retried
+	clock.Sleep(3 * period / 2)
+	_, info, _ = c.GetWithInfo(context.Background(), "foo")
+	assert.Equal(t, 2, info.Errors)
+
+	cancel()
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, clock: clock}).refresh, positive, negative, WithStaleWhileRevalidate(), WithClock(clock))
+
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Neither demand waits for the refresh it prompts
+	start := time.Now()
+	v, e = c.Get(context.Background(), "foo", ForceRefresh())
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+	for i := 0; i < 5; i++ {
+		v, e = c.Get(context.Background(), "foo", MaxAge(time.Nanosecond))
+		assert.Nil(t, e)
+		assert.Equal(t, 1, v)
+	}
+	assert.True(t, time.Since(start) < period/2)
+
+	// And the refresh in flight wasn't superseded
+	clock.Sleep(3 * period / 2)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+
+	cancel()
+}
+
+func TestHardTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: 2 * period, clock: clock}).refresh, Every(2*period), Every(period), WithHardTTL(3*period), WithClock(clock))
+
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Soft expiry at 2: the value is served while it refreshes
+	clock.Sleep(5 * period / 2)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Hard expiry at 3: readers wait for the refresh, which lands at 4
+	clock.Sleep(period)
+	_, ok := c.GetIfPresent("foo")
+	assert.False(t, ok)
+	start := clock.Now()
+	v, e = getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+	assert.Equal(t, period/2, clock.Now().Sub(start))
+
+	cancel()
+}
+
+func TestMaxErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{errBefore: 3, err: errors.New("an error")}).refresh, Every(2*period), Every(period), WithMaxErrors(2), WithClock(clock)).(*cache)
+
+	_, e := c.Get(context.Background(), "foo")
+	assert.Equal(t, "an error", e.Error())
+
+	// The refresh at 1 fails again; the error is served until 2, when we give up
+	clock.Sleep(3 * period / 2)
+	_, info, e := c.GetWithInfo(context.Background(), "foo")
+	assert.Equal(t, "an error", e.Error())
+	assert.Equal(t, 2, info.Errors)
+	clock.Sleep(period)
+	_, ok := c.kv.Load("foo")
+	assert.False(t, ok)
+
+	// A fresh start
+	_, info, e = c.GetWithInfo(context.Background(), "foo")
+	assert.Equal(t, "an error", e.Error())
+	assert.Equal(t, 1, info.Errors)
+	clock.Sleep(3 * period / 2)
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 4, v)
+
+	cancel()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period, clock: clock}).refresh, Every(period), Every(period), WithIdleTimeout(4*period), WithClock(clock)).(*cache)
+
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Refreshes continue while the entry is idle
+	clock.Sleep(5 * period / 2)
+	ent, ok := c.kv.Load("foo")
+	assert.True(t, ok)
+	result, _, _ := ent.(*entry).status()
+	assert.Greater(t, result.Value, 1)
+
+	// Until the timeout passes
+	clock.Sleep(period)
+	_, ok = c.kv.Load("foo")
+	assert.True(t, ok)
+	clock.Sleep(3 * period / 2)
+	_, ok = c.kv.Load("foo")
+	assert.False(t, ok)
+
+	cancel()
+}
+
+func TestKeepUnused(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{period: period / 4, clock: clock}).refresh, Every(period), Every(period), WithKeepUnused(), WithClock(clock))
+
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Several refresh periods pass without a read
+	clock.Sleep(4 * period)
+	assert.Equal(t, 1, c.Len())
+
+	// The value has kept being refreshed in the meantime
+	v, ok := c.GetIfPresent("foo")
+	assert.True(t, ok)
+	assert.Greater(t, v, 2)
+
+	cancel()
+}
+
+func TestExpireAfterAccess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{}).refresh, Every(period/2), Every(period/2), WithExpireAfterAccess(2*period), WithClock(clock))
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Each read extends the entry's life, and the value is never refreshed
+	for i := 0; i < 4; i++ {
+		clock.Sleep(period)
+		v, e = c.Get(context.Background(), "foo")
+		assert.Nil(t, e)
+		assert.Equal(t, 1, v)
+	}
+
+	// Once left alone, it expires
+	clock.Sleep(3 * period)
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, period, period/100)
+
+	cancel()
+}
+
+func TestExpireAfterWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	evicted := make(chan Key, 1)
+	c := New(ctx, (&refresher{}).refresh, Every(period/2), Every(period/2),
+		WithClock(clock),
+		WithExpireAfterWrite(2*period),
+		WithHooks(Hooks{OnEvict: func(key Key, _ Value) {
+			select {
+			case evicted <- key:
+			default:
+			}
+		}}))
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Constant use doesn't keep it alive
+	for i := 0; i < 4; i++ {
+		clock.Sleep(period / 4)
+		_, e = c.Get(context.Background(), "foo")
+		assert.Nil(t, e)
+	}
+	clock.Sleep(period)
+	select {
+	case key := <-evicted:
+		assert.Equal(t, "foo", key)
+	case <-time.After(period):
+		t.Error("entry outlived its lifetime")
+	}
+
+	// The next read loads afresh
+	assert.Equal(t, 0, c.Len())
+	v2, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Greater(t, v2, v)
+
+	cancel()
+}
+
+func TestOneShotTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithOneShotTimeout(period/2), WithClock(clock))
+
+	for _, key := range []string{"once", "twice", "twice"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+
+	// The key read just once goes well before the other
+	clock.Sleep(period)
+	assert.Eventually(t, func() bool { return c.Len() == 1 }, period, period/100)
+	assert.Equal(t, []Key{"twice"}, c.Keys())
+
+	cancel()
+}
+
+func TestJitter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	var refreshed []time.Time
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		refreshed = append(refreshed, clock.Now())
+		return key, nil
+	}, Every(period), Every(period), WithJitter(period/2), WithKeepUnused(), WithClock(clock))
+
+	for i := 0; i < 20; i++ {
+		_, e := c.Get(context.Background(), i)
+		assert.Nil(t, e)
+	}
+	start := clock.Now()
+
+	// The first refreshes are spread over the jitter window rather than all at once
+	clock.Sleep(7 * period / 4)
+	mu.Lock()
+	later := refreshed[20:]
+	assert.Equal(t, 20, len(later))
+	var first, last time.Duration = 2 * period, 0
+	for _, at := range later {
+		d := at.Sub(start)
+		if d < first {
+			first = d
+		}
+		if d > last {
+			last = d
+		}
+	}
+	mu.Unlock()
+	assert.True(t, first >= period)
+	assert.True(t, last-first > period/8)
+
+	cancel()
+}
+
+func TestEarlyRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	var began []time.Time
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		mu.Lock()
+		began = append(began, clock.Now())
+		n := len(began)
+		mu.Unlock()
+		<-clock.After(period / 2)
+		return ValueWithTTL(n, 2*period), nil
+	}, Every(period), Every(period), WithEarlyRefresh(2), WithClock(clock))
+
+	start := clock.Now()
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Steady reads set off the second refresh before the TTL runs out
+	for clock.Now().Sub(start) < 3*period {
+		_, e = c.Get(context.Background(), "foo")
+		assert.Nil(t, e)
+		clock.Sleep(period / 20)
+	}
+	mu.Lock()
+	assert.True(t, len(began) >= 2)
+	assert.True(t, began[1].Sub(start) < 9*period/4)
+	mu.Unlock()
+
+	cancel()
+}
+
+func TestRefreshAhead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, Every(period), Every(period), WithClock(clock),
+		WithRefreshAhead(2, func(key Key) bool { return key == "warm" }))
+
+	for _, key := range []string{"warm", "cold"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+
+	// The cold key goes at the first unused refresh; the warm one survives two
+	clock.Sleep(5 * period / 2)
+	assert.ElementsMatch(t, []Key{"warm"}, c.Keys())
+	clock.Sleep(period)
+	assert.ElementsMatch(t, []Key{"warm"}, c.Keys())
+
+	// But not a third
+	clock.Sleep(period)
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, period, period/100)
+
+	cancel()
+}
+
+func TestAdaptiveRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	refreshes := map[Key]int{}
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		refreshes[key]++
+		if key == "static" {
+			return 0, nil
+		}
+		return refreshes[key], nil
+	}, Every(period), Every(period), WithAdaptiveRefresh(func(old, new Value) bool {
+		return old == new
+	}, period/4, 2*period), WithKeepUnused(), WithClock(clock))
+
+	for _, key := range []string{"static", "volatile"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+
+	// The static key is refreshed after 1/4, 1/2 and 1 period; the volatile one every 1/4
+	clock.Sleep(3 * period)
+	mu.Lock()
+	assert.Equal(t, 4, refreshes["static"])
+	assert.Greater(t, refreshes["volatile"], 10)
+	mu.Unlock()
+
+	cancel()
+}
+
+func TestMaxAge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var failing int32
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, errors.New("an error")
+		}
+		return 42, nil
+	}, Every(period), Every(period/2), WithStaleIfError(), WithMaxAge(2*period), WithKeepUnused(), WithClock(clock))
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 42, v)
+
+	// The last good value is served for a while after refreshes start failing
+	atomic.StoreInt32(&failing, 1)
+	clock.Sleep(3 * period / 2)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 42, v)
+
+	// But not for ever
+	clock.Sleep(period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.ErrorIs(t, e, ErrStale)
+	assert.Nil(t, v)
+
+	// Until a refresh succeeds
+	atomic.StoreInt32(&failing, 0)
+	clock.Sleep(period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 42, v)
+
+	cancel()
+}
+
+func TestRefreshTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var hung int32 = 1
+	timeouts := make(chan Key, 10)
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		if atomic.LoadInt32(&hung) == 1 {
+			// Pay no attention to ctx
+			time.Sleep(10 * period)
+		}
+		return 42, nil
+	}, Every(period), Every(period), WithRefreshTimeout(period/2),
+		WithHooks(Hooks{OnTimeout: func(key Key) { timeouts <- key }}))
+
+	start := time.Now()
+	v, e := c.Get(context.Background(), "foo")
+	assert.ErrorIs(t, e, ErrTimeout)
+	assert.Nil(t, v)
+	assert.True(t, time.Since(start) < period)
+	assert.Equal(t, "foo", <-timeouts)
+	assert.Equal(t, uint64(1), c.Stats().Timeouts)
+
+	// The next refresh goes ahead regardless
+	atomic.StoreInt32(&hung, 0)
+	time.Sleep(3 * period / 2)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 42, v)
+
+	cancel()
+}
+
+func TestRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int32
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if key == "flaky" && n%3 != 0 {
+			return nil, errors.New("a blip")
+		}
+		if key == "broken" {
+			return nil, errors.New("an error")
+		}
+		return int(n), nil
+	}, positive, negative, WithRetries(2, Every(period/4)), WithClock(clock))
+
+	// Two blips are ridden out
+	start := clock.Now()
+	v, e := getOn(clock, c, "flaky")
+	assert.Nil(t, e)
+	assert.Equal(t, 3, v)
+	assert.Equal(t, period/2, clock.Now().Sub(start))
+
+	// But not three
+	atomic.StoreInt32(&calls, 0)
+	_, e = getOn(clock, c, "broken")
+	assert.Equal(t, "an error", e.Error())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	cancel()
+}
+
+func TestHedge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int32
+	cancelled := make(chan int32, 2)
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 {
+			// The first call is slow
+			select {
+			case <-ctx.Done():
+				cancelled <- n
+				return nil, ctx.Err()
+			case <-clock.After(5 * period):
+			}
+		}
+		return int(n), nil
+	}, positive, negative, WithHedge(period/2), WithClock(clock))
+
+	start := clock.Now()
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+	assert.Equal(t, period/2, clock.Now().Sub(start))
+	assert.Equal(t, int32(1), <-cancelled)
+
+	cancel()
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls, failing int32 = 0, 1
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, errors.New("an error")
+		}
+		return 42, nil
+	}, Every(period), Every(period/2), WithQuarantine(2, 0), WithClock(clock))
+
+	_, e := c.Get(context.Background(), "foo")
+	assert.Equal(t, "an error", e.Error())
+
+	// The second failure quarantines the key, which is left alone from then on
+	clock.Sleep(period)
+	_, info, e := c.GetWithInfo(context.Background(), "foo")
+	assert.ErrorIs(t, e, ErrQuarantined)
+	assert.Equal(t, "cache: quarantined: an error", e.Error())
+	assert.True(t, info.Quarantined)
+	clock.Sleep(2 * period)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, 1, c.Len())
+
+	// Until it's refreshed by hand
+	atomic.StoreInt32(&failing, 0)
+	v, e := c.RefreshAndGet(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 42, v)
+	_, info, _ = c.GetWithInfo(context.Background(), "foo")
+	assert.False(t, info.Quarantined)
+
+	cancel()
+}
+
+func TestPin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithMaxEntries(1), WithClock(clock))
+
+	assert.Nil(t, c.Pin(context.Background(), "foo"))
+	assert.Eventually(t, func() bool {
+		_, ok := c.GetIfPresent("foo")
+		return ok
+	}, period, period/10)
+
+	// A pinned key is neither evicted nor counted against the bound
+	for _, key := range []string{"bar", "baz"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+	assert.Eventually(t, func() bool { return c.Len() == 2 }, period, period/10)
+	assert.ElementsMatch(t, []Key{"foo", "baz"}, c.Keys())
+
+	// Nor is it dropped for want of use, and comes back if it's invalidated
+	clock.Sleep(5 * period)
+	assert.Equal(t, []Key{"foo"}, c.Keys())
+	assert.Nil(t, c.Invalidate(context.Background(), "foo"))
+	assert.Eventually(t, func() bool {
+		_, ok := c.GetIfPresent("foo")
+		return ok
+	}, period, period/10)
+
+	// Until it's unpinned
+	c.Unpin("foo")
+	clock.Sleep(5 * period)
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, period, period/100)
+
+	cancel()
+}
+
+func TestMaxEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	evicted := make(chan Key, 10)
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithMaxEntries(2), WithHooks(Hooks{
+		OnEvict: func(key Key, value Value) { evicted <- key },
+	}))
+
+	for _, key := range []string{"foo", "bar", "foo", "baz"} {
+		v, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+		assert.Equal(t, key, v)
+	}
+
+	// The least recently used key makes way
+	assert.Equal(t, "bar", <-evicted)
+	assert.Eventually(t, func() bool { return c.Len() == 2 }, period, period/10)
+	assert.ElementsMatch(t, []Key{"foo", "baz"}, c.Keys())
+	assert.Equal(t, uint64(1), c.Stats().Evictions)
+
+	cancel()
+}
+
+func TestMaxMaintainers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var loads int32
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		<-clock.After(period / 2)
+		atomic.AddInt32(&loads, 1)
+		return key, nil
+	}, positive, negative, WithMaxMaintainers(1), WithClock(clock))
+
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, "foo", v)
+
+	// Past the limit, keys are loaded for the readers at hand, who share the load
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, e := c.Get(context.Background(), "bar")
+			assert.Nil(t, e)
+			assert.Equal(t, "bar", v)
+		}()
+	}
+	clock.During(wg.Wait)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&loads))
+	assert.Equal(t, []Key{"foo"}, c.Keys())
+
+	cancel()
+}
+
+func TestUnkeptLoadOutlivesReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	release := make(chan struct{})
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		if key == "bar" {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+		}
+		return key, ctx.Err()
+	}, positive, negative, WithMaxMaintainers(1))
+	_, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+
+	// The reader that starts a load of a key that isn't kept gives up...
+	leader, stop := context.WithCancel(context.Background())
+	gaveUp := make(chan error)
+	go func() {
+		_, e := c.Get(leader, "bar")
+		gaveUp <- e
+	}()
+	assert.Eventually(t, func() bool {
+		s := &c.(*cache).flights[c.(*cache).kv.index("bar")]
+		s.Lock()
+		defer s.Unlock()
+		return s.flights["bar"] != nil
+	}, period, period/100)
+	followed := make(chan Value)
+	go func() {
+		v, e := c.Get(context.Background(), "bar")
+		assert.Nil(t, e)
+		followed <- v
+	}()
+	// Long enough for the follower to join the flight
+	time.Sleep(period / 10)
+	stop()
+	assert.ErrorIs(t, <-gaveUp, context.Canceled)
+
+	// ...but the load carries on for the others waiting on it
+	close(release)
+	assert.Equal(t, "bar", <-followed)
+}
+
+func TestMaxWaiters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		<-release
+		return key, nil
+	}, positive, negative, WithMaxWaiters(2))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, e := c.Get(context.Background(), "foo")
+			assert.Nil(t, e)
+			assert.Equal(t, "foo", v)
+		}()
+	}
+	time.Sleep(period / 2)
+
+	// A stuck load turns further readers away
+	_, e := c.Get(context.Background(), "foo")
+	assert.ErrorIs(t, e, ErrOverloaded)
+
+	close(release)
+	wg.Wait()
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, "foo", v)
+
+	cancel()
+}
+
+func TestKeyLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	alerts := make(chan Key, 10)
+	refresh := func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}
+	hooks := WithHooks(Hooks{
+		OnTooManyKeys: func(key Key, limit int) { alerts <- key },
+	})
+	clock := newFakeClock()
+	c := New(ctx, refresh, positive, negative, WithKeyLimit(2, period, true), hooks, WithClock(clock))
+
+	for _, key := range []string{"foo", "bar", "foo"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+	_, e := c.Get(context.Background(), "baz")
+	assert.ErrorIs(t, e, ErrTooManyKeys)
+	_, e = c.Get(context.Background(), "qux")
+	assert.ErrorIs(t, e, ErrTooManyKeys)
+	assert.Equal(t, "baz", <-alerts)
+	assert.Equal(t, uint64(2), c.Stats().Overflows)
+
+	// A new window lets more in
+	clock.Sleep(period)
+	v, e := c.Get(context.Background(), "baz")
+	assert.Nil(t, e)
+	assert.Equal(t, "baz", v)
+
+	// Otherwise, keys beyond the limit are loaded without being kept
+	c = New(ctx, refresh, positive, negative, WithKeyLimit(1, period, false), hooks)
+	for _, key := range []string{"foo", "bar"} {
+		v, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+		assert.Equal(t, key, v)
+	}
+	assert.Equal(t, "bar", <-alerts)
+	assert.Equal(t, []Key{"foo"}, c.Keys())
+	assert.Empty(t, alerts)
+
+	cancel()
+}
+
+func TestMaxWeight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	evicted := make(chan Key, 10)
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithMaxWeight(10, func(key Key, value Value) int64 {
+		return int64(len(value.(string)))
+	}), WithHooks(Hooks{
+		OnEvict: func(key Key, value Value) { evicted <- key },
+	}))
+
+	for _, key := range []string{"aaa", "bbbb", "cc"} {
+		v, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+		assert.Equal(t, key, v)
+	}
+	assert.Eventually(t, func() bool { return c.Stats().Weight == 9 }, period, period/10)
+
+	// A heavy value pushes out as many of the least recently used as it takes
+	v, e := c.Get(context.Background(), "dddddd")
+	assert.Nil(t, e)
+	assert.Equal(t, "dddddd", v)
+	assert.Equal(t, "aaa", <-evicted)
+	assert.Equal(t, "bbbb", <-evicted)
+	assert.Eventually(t, func() bool { return c.Len() == 2 }, period, period/10)
+	assert.ElementsMatch(t, []Key{"cc", "dddddd"}, c.Keys())
+	assert.Equal(t, int64(8), c.Stats().Weight)
+
+	cancel()
+}
+
+func TestResize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	evicted := make(chan Key, 10)
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithMaxEntries(4), WithMaxWeight(100, func(key Key, value Value) int64 {
+		return int64(len(value.(string)))
+	}), WithHooks(Hooks{
+		OnEvict: func(key Key, value Value) { evicted <- key },
+	}))
+
+	for _, key := range []string{"a", "bb", "ccc", "dddd"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+	assert.Eventually(t, func() bool { return c.Stats().Weight == 10 }, period, period/10)
+
+	// Shrinking evicts straight away, least recently used first
+	assert.Nil(t, c.SetMaxEntries(2))
+	assert.Equal(t, "a", <-evicted)
+	assert.Equal(t, "bb", <-evicted)
+	assert.Nil(t, c.SetMaxWeight(4))
+	assert.Equal(t, "ccc", <-evicted)
+	assert.Eventually(t, func() bool { return c.Len() == 1 }, period, period/10)
+	assert.Equal(t, []Key{"dddd"}, c.Keys())
+
+	// Growing makes room again
+	assert.Nil(t, c.SetMaxEntries(0))
+	assert.Nil(t, c.SetMaxWeight(0))
+	for _, key := range []string{"a", "bb", "ccc"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+	assert.Equal(t, 4, c.Len())
+	assert.Empty(t, evicted)
+
+	// There's nothing to change without a bound
+	unbounded := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithMaxEntries(1))
+	assert.Nil(t, unbounded.SetMaxEntries(2))
+	assert.ErrorIs(t, unbounded.SetMaxWeight(2), ErrUnbounded)
+	unbounded = New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative)
+	assert.ErrorIs(t, unbounded.SetMaxEntries(2), ErrUnbounded)
+
+	cancel()
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithMaxEntries(2), WithEvictionPolicy(LFU))
+
+	for _, key := range []string{"hot", "hot", "hot", "foo", "bar", "baz"} {
+		v, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+		assert.Equal(t, key, v)
+	}
+
+	// The hot key stays put as others come and go
+	assert.Eventually(t, func() bool { return c.Len() == 2 }, period, period/10)
+	assert.ElementsMatch(t, []Key{"hot", "baz"}, c.Keys())
+
+	cancel()
+}
+
+func TestPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	evicted := make(chan Key, 10)
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithMaxEntries(2), WithKeepUnused(), WithPriority(func(key Key, value Value) int {
+		if value == "vip" {
+			return 1
+		}
+		return 0
+	}), WithHooks(Hooks{
+		OnEvict: func(key Key, value Value) { evicted <- key },
+	}))
+
+	// The least recently used key is spared for its priority
+	for _, key := range []string{"vip", "foo", "bar", "baz"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+	assert.Equal(t, "foo", <-evicted)
+	assert.Equal(t, "bar", <-evicted)
+	assert.Eventually(t, func() bool { return c.Len() == 2 }, period, period/10)
+	assert.ElementsMatch(t, []Key{"vip", "baz"}, c.Keys())
+
+	cancel()
+}
+
+func TestSweeper(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var reaped int32
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		<-clock.After(period)
+		return key, nil
+	}, positive, negative, WithKeepUnused(), WithHardTTL(period/2), WithSweeper(period/4), WithClock(clock), WithHooks(Hooks{
+		OnSweep: func(n int) { atomic.AddInt32(&reaped, int32(n)) },
+	}))
+
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, "foo", v)
+
+	// Once its value expires, the entry is reaped without waiting to be read
+	clock.Sleep(period)
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, period, period/100)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reaped))
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Swept)
+	assert.True(t, stats.Sweeps > 1)
+
+	cancel()
+}
+
+func TestMemoryPressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var inUse uint64 = 50
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithKeepUnused(), WithMemoryPressure(0.9, period/4), WithClock(clock), func(c *cache) {
+		c.pressure.limit = func() int64 { return 100 }
+		c.pressure.inUse = func() uint64 { return atomic.LoadUint64(&inUse) }
+	})
+
+	for i := 0; i < 20; i++ {
+		_, e := c.Get(context.Background(), i)
+		assert.Nil(t, e)
+	}
+	clock.Sleep(period)
+	assert.Equal(t, 20, c.Len())
+
+	// Entries are shed, the least recently used first, until memory's no longer short
+	atomic.StoreUint64(&inUse, 95)
+	assert.Eventually(t, func() bool {
+		clock.Sleep(period / 4)
+		return c.Len() <= 16
+	}, 2*period, period/100)
+	atomic.StoreUint64(&inUse, 50)
+	n := c.Len()
+	clock.Sleep(period)
+	assert.Equal(t, n, c.Len())
+	assert.NotContains(t, c.Keys(), 0)
+	assert.Contains(t, c.Keys(), 19)
+
+	cancel()
+}
+
+func TestQuotas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	evicted := make(chan Key, 10)
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithKeepUnused(), WithQuotas(ByPrefix(":"), map[string]Quota{
+		"busy": {MaxEntries: 2},
+	}), WithHooks(Hooks{
+		OnEvict: func(key Key, value Value) { evicted <- key },
+	}))
+
+	for _, key := range []string{"quiet:1", "busy:1", "busy:2", "busy:3", "quiet:2"} {
+		v, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+		assert.Equal(t, key, v)
+	}
+
+	// The busy namespace makes room amongst its own keys
+	assert.Equal(t, "busy:1", <-evicted)
+	assert.Eventually(t, func() bool { return c.Len() == 4 }, period, period/10)
+	assert.ElementsMatch(t, []Key{"quiet:1", "quiet:2", "busy:2", "busy:3"}, c.Keys())
+
+	cancel()
+}
+
+func TestTinyLFU(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var loads int32
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		atomic.AddInt32(&loads, 1)
+		return key, nil
+	}, positive, negative, WithMaxEntries(2), WithTinyLFU())
+
+	for _, key := range []string{"foo", "bar", "foo", "bar", "foo", "bar"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+
+	// Keys that are read once are served, but not kept
+	for _, key := range []string{"a", "b", "c", "d"} {
+		v, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+		assert.Equal(t, key, v)
+	}
+	assert.ElementsMatch(t, []Key{"foo", "bar"}, c.Keys())
+	assert.Equal(t, int32(6), atomic.LoadInt32(&loads))
+
+	// One that's read often enough earns its place
+	for i := 0; i < 4; i++ {
+		_, e := c.Get(context.Background(), "baz")
+		assert.Nil(t, e)
+	}
+	assert.Contains(t, c.Keys(), "baz")
+
+	cancel()
+}
+
+func TestAdmission(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	candidates := make(chan Candidate, 10)
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithMaxEntries(2), WithAdmission(AdmissionFunc(func(c Candidate) bool {
+		candidates <- c
+		return !strings.HasPrefix(c.Key.(string), "tmp/")
+	})))
+
+	// Only those keys that the admission allows are kept
+	for _, key := range []string{"foo", "tmp/foo", "bar"} {
+		v, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+		assert.Equal(t, key, v)
+	}
+	assert.ElementsMatch(t, []Key{"foo", "bar"}, c.Keys())
+	// Frequencies are estimates, which may be overestimates
+	for _, key := range []string{"foo", "tmp/foo", "bar"} {
+		candidate := <-candidates
+		assert.Equal(t, key, candidate.Key)
+		assert.True(t, candidate.Frequency >= 1)
+		assert.False(t, candidate.Full)
+	}
+
+	// It's told what a newcomer would displace
+	_, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	_, e = c.Get(context.Background(), "baz")
+	assert.Nil(t, e)
+	candidate := <-candidates
+	assert.Equal(t, "baz", candidate.Key)
+	assert.True(t, candidate.Full)
+	assert.Equal(t, "bar", candidate.Victim)
+	assert.True(t, candidate.VictimFrequency >= 1)
+	assert.Eventually(t, func() bool { return c.Len() == 2 }, period, period/10)
+	assert.ElementsMatch(t, []Key{"foo", "baz"}, c.Keys())
+	assert.Empty(t, candidates)
+
+	// Without a bound, the admission is still consulted
+	c = New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithAdmission(AdmissionFunc(func(c Candidate) bool {
+		return c.Key != "tmp"
+	})))
+	for _, key := range []string{"foo", "tmp"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+	assert.Equal(t, []Key{"foo"}, c.Keys())
+
+	cancel()
+}
+
+func TestShards(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithShards(3), WithKeepUnused()).(*cache)
+	assert.Len(t, c.kv.shards, 4)
+
+	var keys []Key
+	for i := 0; i < 100; i++ {
+		keys = append(keys, i)
+		v, e := c.Get(context.Background(), i)
+		assert.Nil(t, e)
+		assert.Equal(t, i, v)
+	}
+	assert.Equal(t, 100, c.Len())
+	assert.ElementsMatch(t, keys, c.Keys())
+	// The keys are spread between the shards
+	for i := range c.kv.shards {
+		assert.True(t, atomic.LoadInt64(&c.kv.shards[i].n) > 0)
+	}
+
+	assert.Nil(t, c.Invalidate(context.Background(), 7))
+	assert.Eventually(t, func() bool { return c.Len() == 99 }, period, period/10)
+	c.Purge()
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, period, period/10)
+
+	cancel()
+}
+
+func TestShardKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var loads int32
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		atomic.AddInt32(&loads, 1)
+		return key, nil
+	}, positive, negative, WithShards(64), WithKeepUnused()).(*cache)
+	get := func(key Key) {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+
+	// A pointer is the one key, whatever it points to
+	p := &struct{ n int }{}
+	for i := 0; i < 20; i++ {
+		p.n = i
+		get(p)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+
+	// 0 and -0 are the same key, as are equal structs
+	get(0.0)
+	get(math.Copysign(0, -1))
+	type pair struct {
+		n int
+		s string
+	}
+	get(pair{1, "a"})
+	get(pair{1, "a"})
+	assert.Equal(t, int32(3), atomic.LoadInt32(&loads))
+	assert.Equal(t, 3, c.Len())
+
+	// Hashing a key takes no allocation
+	assert.Zero(t, testing.AllocsPerRun(100, func() { hashKey(c.kv.seed, 12345) }))
+}
+
+func TestSnapshotMap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithSnapshotMap(), WithShards(2), WithKeepUnused()).(*cache)
+
+	// Readers carry on as keys come and go
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := i*50 + j
+				v, e := c.Get(context.Background(), key)
+				assert.Nil(t, e)
+				assert.Equal(t, key, v)
+				c.GetIfPresent(key / 2)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 200, c.Len())
+	assert.Len(t, c.Keys(), 200)
+
+	// The copy a reader holds is left as it was
+	held := c.kv.shards[0].snap.Load()
+	n := len(*held)
+	c.Purge()
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, period, period/10)
+	assert.Len(t, *held, n)
+
+	cancel()
+}
+
+func TestCancelledReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var loads int32
+	refresher := func(ctx context.Context, key Key) (Value, error) {
+		atomic.AddInt32(&loads, 1)
+		return key, nil
+	}
+	dead, kill := context.WithCancel(context.Background())
+	kill()
+
+	for _, c := range []Cache{
+		New(ctx, refresher, positive, negative),
+		NewOnDemand(ctx, refresher, time.Minute, time.Minute),
+	} {
+		atomic.StoreInt32(&loads, 0)
+		// A reader that's given up makes no entry, and no load
+		_, e := c.Get(dead, "foo")
+		assert.ErrorIs(t, e, context.Canceled)
+		_, e = c.GetOrLoad(dead, "foo", refresher)
+		assert.ErrorIs(t, e, context.Canceled)
+		_, _, e = c.GetWithInfo(dead, "foo")
+		assert.ErrorIs(t, e, context.Canceled)
+		assert.Equal(t, 0, c.Len())
+		assert.Equal(t, int32(0), atomic.LoadInt32(&loads))
+
+		// But is still served a value that's there already
+		_, e = c.Get(context.Background(), "foo")
+		assert.Nil(t, e)
+		v, e := c.Get(dead, "foo")
+		assert.Nil(t, e)
+		assert.Equal(t, "foo", v)
+	}
+}
+
+func TestStripedLocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, WithShards(4), WithMaxEntries(10), WithKeepUnused()).(*cache)
+	assert.Len(t, c.capacity.reads, 4)
+
+	for i := 0; i < 10; i++ {
+		_, e := c.Get(context.Background(), i)
+		assert.Nil(t, e)
+	}
+	// Uses that are still waiting in their stripes are noted before a victim
+	// is chosen
+	for i := 1; i < 10; i++ {
+		c.GetIfPresent(i)
+	}
+	_, e := c.Get(context.Background(), 10)
+	assert.Nil(t, e)
+	assert.Eventually(t, func() bool {
+		_, ok := c.GetIfPresent(0)
+		return !ok && c.Len() == 10
+	}, period, period/10)
+
+	// Waiting for the lock on the policy is counted
+	c.capacity.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Get(context.Background(), 11)
+	}()
+	assert.Eventually(t, func() bool { return c.Stats().EvictionContention > 0 }, period, period/10)
+	c.capacity.mu.Unlock()
+	<-done
+
+	cancel()
+}
+
+func TestStandbyRefreshers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	before := runtime.NumGoroutine()
+	release := make(chan struct{})
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		<-release
+		return key, nil
+	}, positive, negative, WithStandbyRefreshers(4))
+	assert.True(t, runtime.NumGoroutine()-before >= 4)
+
+	// Loads beyond those standing by still run at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, e := c.Get(context.Background(), i)
+			assert.Nil(t, e)
+			assert.Equal(t, i, v)
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+
+	cancel()
+	assert.Nil(t, c.Close(context.Background()))
+}
+
+func TestRefreshWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var running, most int32
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		<-clock.After(period / 10)
+		return key, nil
+	}, positive, negative, WithRefreshWorkers(2), WithClock(clock))
+
+	// However many keys are read at once, only two are loaded at a time
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(key int) {
+			defer wg.Done()
+			v, e := c.Get(context.Background(), key)
+			assert.Nil(t, e)
+			assert.Equal(t, key, v)
+		}(i)
+	}
+	clock.During(wg.Wait)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&most))
+
+	cancel()
+	assert.Nil(t, c.Close(context.Background()))
+}
+
+// A Limiter that allows as many calls as it's been given tokens for
+type tokens int32
+
+func (t *tokens) Allow() bool {
+	for {
+		n := atomic.LoadInt32((*int32)(t))
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32((*int32)(t), n, n-1) {
+			return true
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var limit tokens
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{}).refresh, Every(period), Every(period),
+		WithRateLimit(&limit, period/10), WithKeepUnused(), WithClock(clock))
+
+	// The first load goes ahead regardless
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// But refreshes wait for the limit to allow them, and the value is
+	// served as it stands meanwhile
+	clock.Sleep(3 * period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+	assert.Greater(t, c.Stats().Throttled, uint64(0))
+
+	atomic.StoreInt32((*int32)(&limit), 1)
+	clock.Sleep(period / 10)
+	assert.Eventually(t, func() bool {
+		v, _ := c.GetIfPresent("foo")
+		return v == 2
+	}, period, period/100)
+	clock.Sleep(2 * period)
+	v, _ = c.GetIfPresent("foo")
+	assert.Equal(t, 2, v)
+
+	cancel()
+}
+
+func BenchmarkGet(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return 1, nil
+	}, Every(time.Hour), Every(time.Hour))
+	var key Key = "foo"
+	_, e := c.Get(ctx, key)
+	assert.Nil(b, e)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Get(ctx, key)
+		}
+	})
+}
+
+func BenchmarkTypedGet(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewTyped(ctx, func(ctx context.Context, key string) (int, error) {
+		return 1, nil
+	}, Every(time.Hour), Every(time.Hour))
+	key := strings.Repeat("foo", 1)
+	_, e := c.Get(ctx, key)
+	assert.Nil(b, e)
+
+	// The key is boxed as a Key for each call, which costs an allocation
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Get(ctx, key)
+		}
+	})
+}
+
+func BenchmarkRefreshAndGet(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return 1, nil
+	}, Every(time.Hour), Every(time.Hour))
+	var key Key = "foo"
+	_, e := c.Get(ctx, key)
+	assert.Nil(b, e)
+
+	// Each refresh's reply channels are reused
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.RefreshAndGet(ctx, key)
+	}
+}
+
+// A Scheduler whose refreshes fall due only when it's told
+type manualScheduler struct {
+	mu        sync.Mutex
+	scheduled map[Key]chan time.Time
+	cancelled []Key
+}
+
+func (s *manualScheduler) Schedule(key Key, at time.Time) <-chan time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := make(chan time.Time, 1)
+	s.scheduled[key] = c
+	return c
+}
+
+func (s *manualScheduler) Cancel(key Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.scheduled, key)
+	s.cancelled = append(s.cancelled, key)
+}
+
+// Make a key's refresh fall due, reporting whether one was scheduled.
+func (s *manualScheduler) fire(key Key) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.scheduled[key]
+	if ok {
+		delete(s.scheduled, key)
+		c <- time.Now()
+	}
+	return ok
+}
+
+func TestScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var loads int32
+	s := &manualScheduler{scheduled: map[Key]chan time.Time{}}
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return int(atomic.AddInt32(&loads, 1)), nil
+	}, Every(period), Every(period), WithScheduler(s), WithKeepUnused(), WithClock(clock))
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Refreshes wait on the scheduler, not the timers
+	clock.Sleep(2 * period)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+	assert.Eventually(t, func() bool { return s.fire("foo") }, period, period/10)
+	assert.Eventually(t, func() bool {
+		v, _ := c.GetIfPresent("foo")
+		return v == 2
+	}, period, period/10)
+
+	// A key that goes has its refresh cancelled
+	assert.Nil(t, c.Invalidate(context.Background(), "foo"))
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_, ok := s.scheduled["foo"]
+		return !ok && len(s.cancelled) > 0
+	}, period, period/10)
+
+	cancel()
+}
+
+func TestTimerResolution(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var loads int32
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		atomic.AddInt32(&loads, 1)
+		return key, nil
+	}, Every(period), Every(period), WithTimerResolution(period), WithKeepUnused(), WithClock(clock)).(*cache)
+
+	for i := 0; i < 100; i++ {
+		_, e := c.Get(context.Background(), i)
+		assert.Nil(t, e)
+	}
+	// The keys' refreshes share a timer or two
+	coarse := c.timers.(*coarseClock)
+	coarse.mu.Lock()
+	assert.LessOrEqual(t, len(coarse.buckets), 2)
+	coarse.mu.Unlock()
+
+	// And none is early
+	clock.Sleep(period / 2)
+	assert.Equal(t, int32(100), atomic.LoadInt32(&loads))
+	clock.Sleep(2 * period)
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&loads), int32(200))
+
+	cancel()
+}
+
+func TestParking(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var loads int32
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return int(atomic.AddInt32(&loads, 1)), nil
+	}, Every(period), Every(period), WithParking(), WithClock(clock))
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Once it goes unused, the entry stays but is no longer refreshed
+	clock.Sleep(4 * period)
+	assert.Equal(t, 1, c.Len())
+	_, ok := c.GetIfPresent("foo")
+	assert.False(t, ok)
+	parked := atomic.LoadInt32(&loads)
+	clock.Sleep(2 * period)
+	assert.Equal(t, parked, atomic.LoadInt32(&loads))
+
+	// Until it's read again
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, int(parked)+1, v)
+	v, ok = c.GetIfPresent("foo")
+	assert.True(t, ok)
+	assert.Equal(t, int(parked)+1, v)
+
+	// With stale values allowed, the old one is served while it's reloaded
+	c = New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return int(atomic.AddInt32(&loads, 1)), nil
+	}, Every(period), Every(period), WithParking(), WithStaleWhileRevalidate(), WithClock(clock))
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	clock.Sleep(4 * period)
+	stale, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Greater(t, stale, v)
+	assert.Eventually(t, func() bool {
+		fresh, _ := c.GetIfPresent("foo")
+		return fresh.(int) > stale.(int)
+	}, period, period/10)
+
+	cancel()
+}
+
+func TestRefreshOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	var order []Key
+	release := make(chan struct{})
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		mu.Lock()
+		order = append(order, key)
+		mu.Unlock()
+		if key == "block" {
+			<-release
+		}
+		return key, nil
+	}, Every(period), Every(period), WithRefreshWorkers(1), WithKeepUnused(), WithClock(clock))
+
+	for _, key := range []string{"cold", "hot"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+	for i := 0; i < 10; i++ {
+		_, e := c.Get(context.Background(), "hot")
+		assert.Nil(t, e)
+	}
+
+	// While the worker's busy, both keys' refreshes fall due; the one read
+	// more often goes first
+	go c.Get(context.Background(), "block")
+	clock.Sleep(3 * period / 2)
+	close(release)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(order) >= 5
+	}, period, period/10)
+	mu.Lock()
+	assert.Equal(t, []Key{"cold", "hot", "block", "hot", "cold"}, order[:5])
+	mu.Unlock()
+
+	cancel()
+}
+
+func TestAdaptiveRefreshWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var failing int32 = 1
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, errors.New("struggling")
+		}
+		return key, nil
+	}, Every(time.Hour), Every(time.Hour), WithAdaptiveRefreshWorkers(8, 0)).(*cache)
+	limit := func() int {
+		c.workers.mu.Lock()
+		defer c.workers.mu.Unlock()
+		return c.workers.limit
+	}
+	assert.Equal(t, 8, limit())
+
+	// Failures back off the concurrency, down to a single load at a time
+	for i := 0; i < 10; i++ {
+		_, e := c.Get(context.Background(), i)
+		assert.NotNil(t, e)
+	}
+	assert.Eventually(t, func() bool { return limit() == 1 }, period, period/10)
+
+	// Successes bring it back
+	atomic.StoreInt32(&failing, 0)
+	for i := 10; i < 50; i++ {
+		_, e := c.Get(context.Background(), i)
+		assert.Nil(t, e)
+	}
+	assert.Eventually(t, func() bool { return limit() == 8 }, period, period/10)
+
+	cancel()
+}
+
+// How many readers are waiting at the gate of a key's entry.
+func waiting(c *cache, key Key) int {
+	v, ok := c.kv.Load(key)
+	if !ok {
+		return 0
+	}
+	e := v.(*entry)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.gate == nil {
+		return 0
+	}
+	return e.gate.waiting
+}
+
+func TestWaiters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		<-release
+		return key, nil
+	}, positive, negative).(*cache)
+
+	// Readers waiting on a load all get its value
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, e := c.Get(context.Background(), "foo")
+			assert.Nil(t, e)
+			assert.Equal(t, "foo", v)
+		}()
+	}
+	assert.Eventually(t, func() bool { return waiting(c, "foo") == 10 }, period, time.Millisecond)
+	// Including those that come after one's given up
+	gone, giveUp := context.WithCancel(context.Background())
+	go c.Get(gone, "foo")
+	assert.Eventually(t, func() bool { return waiting(c, "foo") == 11 }, period, time.Millisecond)
+	giveUp()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v, e := c.Get(context.Background(), "foo")
+		assert.Nil(t, e)
+		assert.Equal(t, "foo", v)
+	}()
+	assert.Eventually(t, func() bool { return waiting(c, "foo") == 12 }, period, time.Millisecond)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 0, waiting(c, "foo"))
+
+	cancel()
+}
+
+// How long the readers waiting on a load take to get its value, at the
+// 99th percentile, as there are more of them.
+func BenchmarkWaiters(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			var latencies []time.Duration
+			for i := 0; i < b.N; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				release := make(chan struct{})
+				var landed int64
+				c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+					<-release
+					atomic.StoreInt64(&landed, time.Now().UnixNano())
+					return key, nil
+				}, positive, negative).(*cache)
+				got := make([]int64, n)
+				var wg sync.WaitGroup
+				for j := 0; j < n; j++ {
+					wg.Add(1)
+					go func(j int) {
+						defer wg.Done()
+						c.Get(context.Background(), "foo")
+						got[j] = time.Now().UnixNano()
+					}(j)
+				}
+				for waiting(c, "foo") < n {
+					runtime.Gosched()
+				}
+				close(release)
+				wg.Wait()
+				for _, at := range got {
+					latencies = append(latencies, time.Duration(at-atomic.LoadInt64(&landed)))
+				}
+				cancel()
+			}
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)*99/100]), "p99-ns")
+		})
+	}
+}
+
+func TestLazyMaintainers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var loads int32
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return int(atomic.AddInt32(&loads, 1)), nil
+	}, positive, negative, WithLazyMaintainers(period), WithClock(clock))
+
+	// A key read once isn't kept
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+	assert.Equal(t, 0, c.Len())
+
+	// One read again soon after is
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+	assert.Equal(t, 1, c.Len())
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+
+	// But not one read again after a while
+	_, e = c.Get(context.Background(), "bar")
+	assert.Nil(t, e)
+	clock.Sleep(2 * period)
+	_, e = c.Get(context.Background(), "bar")
+	assert.Nil(t, e)
+	_, ok := c.GetIfPresent("bar")
+	assert.False(t, ok)
+
+	cancel()
+}
+
+func TestCanonicalKey(t *testing.T) {
+	for name, construct := range map[string]func(context.Context, Refresher, ...Option) Cache{
+		"New": func(ctx context.Context, refresher Refresher, opts ...Option) Cache {
+			return New(ctx, refresher, positive, negative, opts...)
+		},
+		"NewOnDemand": func(ctx context.Context, refresher Refresher, opts ...Option) Cache {
+			return NewOnDemand(ctx, refresher, time.Hour, time.Hour, opts...)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var loads int32
+			c := construct(ctx, func(ctx context.Context, key Key) (Value, error) {
+				atomic.AddInt32(&loads, 1)
+				return "loaded " + key.(string), nil
+			}, WithCanonicalKey(func(key Key) Key {
+				return strings.ToLower(key.(string))
+			}))
+
+			// Aliases share the one entry, loaded once for the canonical key
+			v, e := c.Get(context.Background(), "USER:42")
+			assert.Nil(t, e)
+			assert.Equal(t, "loaded user:42", v)
+			v, e = c.Get(context.Background(), "user:42")
+			assert.Nil(t, e)
+			assert.Equal(t, "loaded user:42", v)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+			assert.Equal(t, []Key{"user:42"}, c.Keys())
+
+			assert.Nil(t, c.Set(context.Background(), "User:42", "set"))
+			v, ok := c.GetIfPresent("user:42")
+			assert.True(t, ok)
+			assert.Equal(t, "set", v)
+
+			assert.Nil(t, c.Invalidate(context.Background(), "USER:42"))
+			assert.Eventually(t, func() bool {
+				_, ok := c.GetIfPresent("user:42")
+				return !ok
+			}, time.Second, period/10)
+		})
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	c := New(context.Background(), func(ctx context.Context, key Key) (Value, error) {
+		if strings.HasSuffix(key.(string), "bad") {
+			return nil, fmt.Errorf("no %v", key)
+		}
+		return key, nil
+	}, positive, negative, WithExpvar("test", func(key Key) string {
+		return strings.SplitN(key.(string), ":", 2)[0]
+	}))
+	_, _ = c.Get(context.Background(), "user:1")
+	_, _ = c.Get(context.Background(), "user:1")
+	_, _ = c.Get(context.Background(), "user:bad")
+	_, _ = c.Get(context.Background(), "order:bad")
+
+	var published struct {
+		Hits, Misses, Refreshes uint64
+		Entries                 int
+		LastErrors              map[string]string
+	}
+	exported := expvar.Get("cache").(*expvar.Map)
+	assert.Nil(t, json.Unmarshal([]byte(exported.Get("test").String()), &published))
+	assert.Equal(t, uint64(1), published.Hits)
+	assert.Equal(t, uint64(3), published.Misses)
+	assert.Equal(t, uint64(1), published.Refreshes)
+	assert.Equal(t, 3, published.Entries)
+	assert.Equal(t, map[string]string{"user": "no user:bad", "order": "no order:bad"}, published.LastErrors)
+
+	// Another cache can't take its name
+	assert.Panics(t, func() {
+		New(context.Background(), func(ctx context.Context, key Key) (Value, error) {
+			return key, nil
+		}, positive, negative, WithExpvar("test", nil))
+	})
+	assert.NotNil(t, exported.Get("test"))
+
+	// Until it's closed
+	assert.Nil(t, c.Close(context.Background()))
+	assert.Nil(t, exported.Get("test"))
+}
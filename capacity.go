@@ -0,0 +1,557 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A Weigher reports how much an entry counts towards a cache's budget, as
+// set by WithMaxWeight. Its units are up to it: bytes, perhaps.
+type Weigher func(key Key, value Value) int64
+
+// Values that implement Prioritized rank themselves for eviction, as
+// PriorityOf reports.
+type Prioritized interface {
+	Priority() int
+}
+
+// PriorityOf is a priority function for WithPriority that asks values that
+// implement Prioritized for their priority, giving others zero.
+func PriorityOf(key Key, value Value) int {
+	if p, ok := value.(Prioritized); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
+// A Quota bounds the entries of one namespace of a cache, as given by
+// WithQuotas. A zero field sets no bound.
+type Quota struct {
+	MaxEntries int
+	MaxWeight  int64 // As reckoned by the cache's Weigher
+}
+
+// ByPrefix divides string keys into namespaces by the part of them before
+// the first sep. Other keys, and those without a sep, are in the namespace "".
+func ByPrefix(sep string) func(key Key) string {
+	return func(key Key) string {
+		s, ok := key.(string)
+		if !ok {
+			return ""
+		}
+		if i := strings.Index(s, sep); i >= 0 {
+			return s[:i]
+		}
+		return ""
+	}
+}
+
+// A set of keys bounded in number and weight, with the policy that chooses
+// which of them to evict
+type pool struct {
+	max    int   // How many keys may be resident; zero for any number
+	budget int64 // Their total weight; zero for any
+	total  int64
+	policy Policy
+}
+
+// Whether there's room for another key.
+func (p *pool) room() bool {
+	return (p.max <= 0 || p.policy.Len() < p.max) && (p.budget <= 0 || p.total < p.budget)
+}
+
+// Whether there are more keys than there may be, or they weigh more than
+// they may.
+func (p *pool) excess() bool {
+	return (p.max > 0 && p.policy.Len() > p.max) || p.over()
+}
+
+// Whether the keys weigh more than they may.
+func (p *pool) over() bool {
+	return p.budget > 0 && p.total > p.budget
+}
+
+// Bounds the number and weight of resident keys, evicting those the policy
+// chooses; and likewise those of each namespace that has a quota.
+type capacity struct {
+	mu meteredMutex
+	pool
+	reads     []readStripe      // Uses of keys not yet noted by the policies
+	index     func(key Key) int // The stripe of a key's uses
+	weigher   Weigher
+	priority  func(key Key, value Value) int
+	namespace func(key Key) string
+	quotas    map[string]*pool
+	residents map[Key]*resident
+	filter    *tinyLFU  // Estimates how often keys are read, for the admission, if there is one
+	admission Admission // Decides whether newcomers are kept
+}
+
+type resident struct {
+	weight   int64
+	priority int
+	quota    *pool // Nil unless its namespace has one
+}
+
+// The size assumed for sketches and the like when the number of keys isn't bounded
+const nominalEntries = 1000
+
+func (cache *cache) bound() {
+	if cache.maxEntries <= 0 && cache.maxWeight <= 0 && len(cache.quotas) == 0 && cache.pressure == nil && cache.admission == nil {
+		return
+	}
+	policy := cache.policy
+	if policy == nil {
+		policy = LRU
+	}
+	newPool := func(max int, budget int64) *pool {
+		p := &pool{max: max, budget: budget, policy: policy()}
+		if cache.priority != nil {
+			p.policy = &prioritized{policy: policy, ranks: map[Key]*level{}}
+		}
+		if b, ok := p.policy.(bounded); ok {
+			if max <= 0 {
+				max = nominalEntries
+			}
+			b.bound(max)
+		}
+		return p
+	}
+	c := &capacity{
+		pool:      *newPool(cache.maxEntries, cache.maxWeight),
+		weigher:   cache.weigher,
+		priority:  cache.priority,
+		namespace: cache.namespace,
+		quotas:    map[string]*pool{},
+		residents: map[Key]*resident{},
+		reads:     make([]readStripe, len(cache.kv.shards)),
+		index:     cache.kv.index,
+	}
+	for ns, quota := range cache.quotas {
+		c.quotas[ns] = newPool(quota.MaxEntries, quota.MaxWeight)
+	}
+	if cache.admission != nil {
+		size := cache.maxEntries
+		if size <= 0 {
+			size = nominalEntries
+		}
+		c.filter = newTinyLFU(size)
+		c.admission = cache.admission
+	}
+	cache.capacity = c
+}
+
+// The quota that applies to a key, if there is one.
+func (c *capacity) quota(key Key) *pool {
+	if c.namespace == nil {
+		return nil
+	}
+	return c.quotas[c.namespace(key)]
+}
+
+// Take a key out of consideration.
+func (c *capacity) drop(key Key) {
+	r, ok := c.residents[key]
+	if !ok {
+		return
+	}
+	c.policy.Remove(key)
+	c.total -= r.weight
+	if r.quota != nil {
+		r.quota.policy.Remove(key)
+		r.quota.total -= r.weight
+	}
+	delete(c.residents, key)
+}
+
+// Evict keys of a pool, as its policy chooses, for as long as full says it
+// needs it. The spared key is passed over, and keeps its place.
+func (c *capacity) evictFrom(p *pool, full func() bool, spare Key) []Key {
+	var skip func(Key) bool
+	if spare != nil {
+		skip = func(key Key) bool { return key == spare }
+	}
+	var victims []Key
+	for full() {
+		victim, ok := p.policy.Victim(skip)
+		if !ok {
+			break
+		}
+		c.drop(victim)
+		victims = append(victims, victim)
+	}
+	return victims
+}
+
+// Move a key to the given priority in a pool, if its policy heeds them.
+func (c *capacity) rank(p *pool, key Key, priority int) {
+	if pr, ok := p.policy.(*prioritized); ok {
+		pr.rank(key, priority)
+	}
+}
+
+// Note a use of a key, draining the uses of its stripe once there are
+// enough of them.
+func (c *capacity) touch(key Key) {
+	s := &c.reads[c.index(key)]
+	s.Lock()
+	s.keys = append(s.keys, key)
+	full := len(s.keys) >= readBatch
+	s.Unlock()
+	if full {
+		c.mu.Lock()
+		c.drain()
+		c.mu.Unlock()
+	}
+}
+
+// Note the uses of keys waiting in the stripes, a stripe at a time, so
+// that the policies are up to date. The caller holds c.mu.
+func (c *capacity) drain() {
+	for i := range c.reads {
+		s := &c.reads[i]
+		s.Lock()
+		for _, key := range s.keys {
+			if r, ok := c.residents[key]; ok {
+				c.policy.Touch(key)
+				if r.quota != nil {
+					r.quota.policy.Touch(key)
+				}
+			}
+			if c.filter != nil {
+				c.filter.record(key)
+			}
+		}
+		s.keys = s.keys[:0]
+		s.Unlock()
+	}
+}
+
+// The contention for the locks on the policies and on the stripes of uses.
+func (c *capacity) contention() (policies, reads uint64) {
+	for i := range c.reads {
+		reads += c.reads[i].contention()
+	}
+	return c.mu.contention(), reads
+}
+
+// Note a read of a key that isn't resident, reporting whether the admission
+// would have it kept.
+func (c *capacity) admits(key Key) bool {
+	if c.admission == nil {
+		return true
+	}
+	c.mu.Lock()
+	c.drain()
+	c.filter.record(key)
+	candidate := Candidate{Key: key, Frequency: c.filter.estimate(key)}
+	// The newcomer would displace one of its own namespace, if that's full
+	p := &c.pool
+	if q := c.quota(key); q != nil && !q.room() {
+		p = q
+	}
+	if !p.room() {
+		if victim, ok := p.policy.Victim(nil); ok {
+			candidate.Full, candidate.Victim, candidate.VictimFrequency = true, victim, c.filter.estimate(victim)
+		}
+	}
+	c.mu.Unlock()
+	return c.admission.Admit(candidate)
+}
+
+// Note a new key, returning those that should be evicted to make room.
+func (c *capacity) add(key Key) []Key {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drain()
+	// Make room first, so that the newcomer isn't the one chosen
+	quota := c.quota(key)
+	var victims []Key
+	if quota != nil {
+		victims = c.evictFrom(quota, func() bool { return !quota.room() }, key)
+		quota.policy.Add(key)
+	}
+	victims = append(victims, c.evictFrom(&c.pool, func() bool { return !c.room() }, key)...)
+	c.policy.Add(key)
+	c.residents[key] = &resident{quota: quota}
+	return victims
+}
+
+// Note the weight and priority of a key's new value, returning the keys
+// that should be evicted to keep within budget. The key itself is spared.
+func (c *capacity) weigh(key Key, weight int64, priority int) []Key {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.residents[key]
+	if !ok {
+		// It's already been evicted
+		return nil
+	}
+	c.drain()
+	if priority != r.priority {
+		r.priority = priority
+		c.rank(&c.pool, key, priority)
+		if r.quota != nil {
+			c.rank(r.quota, key, priority)
+		}
+	}
+	delta := weight - r.weight
+	r.weight = weight
+	c.total += delta
+	var victims []Key
+	if q := r.quota; q != nil {
+		q.total += delta
+		victims = c.evictFrom(q, q.over, key)
+	}
+	return append(victims, c.evictFrom(&c.pool, c.over, key)...)
+}
+
+// Choose up to n keys to evict, as the policy sees fit.
+func (c *capacity) shed(n int) []Key {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drain()
+	var victims []Key
+	for len(victims) < n {
+		victim, ok := c.policy.Victim(nil)
+		if !ok {
+			break
+		}
+		c.drop(victim)
+		victims = append(victims, victim)
+	}
+	return victims
+}
+
+// Change the bounds of the cache as a whole, returning the keys that should
+// be evicted to keep within them.
+func (c *capacity) resize(set func(p *pool)) []Key {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drain()
+	set(&c.pool)
+	if b, ok := c.policy.(bounded); ok {
+		max := c.max
+		if max <= 0 {
+			max = nominalEntries
+		}
+		b.bound(max)
+	}
+	return c.evictFrom(&c.pool, c.excess, nil)
+}
+
+// Forget a key that's gone.
+func (c *capacity) remove(key Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drop(key)
+}
+
+// The total weight of the resident keys.
+func (c *capacity) weight() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
+
+// Note a use of a key, if the cache is bounded.
+func (cache *cache) use(key Key) {
+	if cache.capacity != nil {
+		cache.capacity.touch(key)
+	}
+}
+
+// Note a use of a key that's been found resident, unless it's that of the
+// read that admitted it, which was counted as it was.
+func (cache *cache) found(key Key, e *entry) {
+	if atomic.LoadUint32(&e.flags)&admittedFlag != 0 && e.clear(admittedFlag)&admittedFlag != 0 {
+		return
+	}
+	cache.use(key)
+}
+
+// Whether a read of a key that isn't resident should load it without
+// keeping it, for want of room or of maintainers, because there have been
+// too many keys of late, or because it's the first read of the key and
+// maintainers are started lazily; or an error if it's to be refused
+// altogether.
+func (cache *cache) refuse(key Key) (bool, error) {
+	if cache.capacity == nil && cache.maxMaintainers <= 0 && cache.cardinality == nil && cache.lazy == nil {
+		return false, nil
+	}
+	if _, ok := cache.kv.Load(key); ok {
+		return false, nil
+	}
+	if refuse, err := cache.guard(key); refuse || err != nil {
+		return refuse, err
+	}
+	if cache.once(key) {
+		return true, nil
+	}
+	if cache.maxMaintainers > 0 && atomic.LoadInt32(&cache.maintainers) >= cache.maxMaintainers {
+		return true, nil
+	}
+	return cache.capacity != nil && !cache.capacity.admits(key), nil
+}
+
+// A load on behalf of readers of a key that isn't kept
+type flight struct {
+	done   chan struct{} // Closed once result is in
+	result r
+}
+
+// Load a key for readers without keeping it. Those that read it at the same
+// time share a load.
+func (cache *cache) loadOnce(ctx context.Context, key Key, refresher Refresher) (Value, error) {
+	if err := ctx.Err(); err != nil {
+		// Nobody's waiting for it
+		return nil, err
+	}
+	cache.stats.read(false)
+	s := &cache.flights[cache.kv.index(key)]
+	s.Lock()
+	f, ok := s.flights[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		if s.flights == nil {
+			s.flights = map[Key]*flight{}
+		}
+		s.flights[key] = f
+	}
+	s.Unlock()
+	if !ok {
+		cache.fly(ctx, key, f, refresher)
+	}
+
+	// Each reader gives up on its own account
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-f.done:
+		return f.result.Value, f.result.Err
+	}
+}
+
+// Start the load of a flight, for the reader at hand and any that join it.
+// It's made on a context of the cache's own, as an on-demand entry's is, so
+// that the reader giving up doesn't cut it short for the others.
+func (cache *cache) fly(reader context.Context, key Key, f *flight, refresher Refresher) {
+	finish := func(result r) {
+		s := &cache.flights[cache.kv.index(key)]
+		s.Lock()
+		delete(s.flights, key)
+		s.Unlock()
+		f.result = result
+		close(f.done)
+	}
+	cache.closing.RLock()
+	defer cache.closing.RUnlock()
+	ctx, cancel := context.WithCancel(cache.ctx)
+	if ctx.Err() != nil {
+		cancel()
+		finish(r{Err: ErrShutdown})
+		return
+	}
+	ctx = cache.traceFor(ctx, reader, time.Time{})
+	cache.spawn(ctx, 0, func() r {
+		return cache.load(ctx, key, refresher)
+	}, func(result r) {
+		cancel()
+		finish(result)
+		cache.landed(key, result)
+	})
+}
+
+// Make room for a new key, if the cache is bounded and the key isn't pinned.
+func (cache *cache) admit(key Key) {
+	if cache.capacity == nil || cache.isPinned(key) {
+		return
+	}
+	for _, victim := range cache.capacity.add(key) {
+		cache.evict(victim, nil)
+	}
+}
+
+// Weigh and rank a key's new result, if the cache is bounded by weight or
+// heeds priorities, and evict others as needed to keep within budget.
+// Errors weigh nothing, and have no priority.
+func (cache *cache) weigh(key Key, result r) {
+	c := cache.capacity
+	if c == nil || (c.weigher == nil && c.priority == nil) {
+		return
+	}
+	var weight int64
+	var priority int
+	if result.Err == nil {
+		if c.weigher != nil {
+			weight = c.weigher(key, result.Value)
+		}
+		if c.priority != nil {
+			priority = c.priority(key, result.Value)
+		}
+	}
+	for _, victim := range c.weigh(key, weight, priority) {
+		cache.evict(victim, nil)
+	}
+}
+
+// Forget a key that's been dropped, if the cache is bounded.
+func (cache *cache) forget(key Key) {
+	if cache.capacity != nil {
+		cache.capacity.remove(key)
+	}
+}
+
+// Stop the maintainer of a key to make room for others, reporting its
+// removal in the batch given, if any.
+func (cache *cache) evictEntry(key Key, b *batch) {
+	c, ok := cache.kv.Load(key)
+	if !ok {
+		return
+	}
+	e := c.(*entry)
+	result, ok := e.result()
+	if ok {
+		// Before it goes, lest it's read again in the meantime
+		cache.demote(key, result)
+	}
+	e.join(b)
+	e.stopFor(ReasonCapacity)
+	cache.stats.evicted()
+	cache.hooks.evicted(key, result.Value)
+}
+
+func (cache *cache) SetMaxEntries(n int) error {
+	if cache.capacity == nil {
+		return ErrUnbounded
+	}
+	cache.evictAll(cache.capacity.resize(func(p *pool) { p.max = n }))
+	return nil
+}
+
+func (cache *cache) SetMaxWeight(budget int64) error {
+	if cache.capacity == nil || cache.capacity.weigher == nil {
+		return ErrUnbounded
+	}
+	cache.evictAll(cache.capacity.resize(func(p *pool) { p.budget = budget }))
+	return nil
+}
+
+// Evict keys together, reporting their removals in one batch.
+func (cache *cache) evictAll(victims []Key) {
+	b := cache.newBatch()
+	for _, victim := range victims {
+		cache.evict(victim, b)
+	}
+	cache.deliver(cache.ctx, b)
+}
+
+// The total weight of the resident entries, if they're weighed.
+func (cache *cache) weight() int64 {
+	if cache.capacity == nil || cache.capacity.weigher == nil {
+		return 0
+	}
+	return cache.capacity.weight()
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Tracks the distinct keys read in each window, turning away those beyond
+// the limit
+type cardinality struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	reject  bool // Whether keys beyond the limit are refused outright, rather than loaded without being kept
+	start   time.Time
+	seen    map[Key]struct{}
+	alerted bool // Whether the hook has been told of this window's overflow
+}
+
+// Note a read of a key that isn't resident, reporting whether it's one too
+// many, and whether it's the first such in its window.
+func (c *cardinality) over(key Key, now time.Time) (over, first bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.start) >= c.window {
+		c.start, c.seen, c.alerted = now, map[Key]struct{}{}, false
+	}
+	if _, ok := c.seen[key]; ok {
+		return false, false
+	}
+	if len(c.seen) < c.limit {
+		c.seen[key] = struct{}{}
+		return false, false
+	}
+	first = !c.alerted
+	c.alerted = true
+	return true, first
+}
+
+// Check a read of a key that isn't resident against the cardinality limit,
+// if there is one. It reports whether the key should be loaded without
+// being kept; or an error if it's to be refused.
+func (cache *cache) guard(key Key) (bool, error) {
+	if cache.cardinality == nil {
+		return false, nil
+	}
+	over, first := cache.cardinality.over(key, cache.clock.Now())
+	if !over {
+		return false, nil
+	}
+	cache.stats.overflowed()
+	if first {
+		cache.hooks.tooManyKeys(key, cache.cardinality.limit)
+	}
+	if cache.cardinality.reject {
+		return false, &KeyLimitError{Key: key, Limit: cache.cardinality.limit}
+	}
+	return true, nil
+}
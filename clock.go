@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"time"
+)
+
+// A Clock tells the time and waits for it to pass. A cache uses the system
+// clock unless WithClock gives it another, such as a fake one that a test
+// advances as it sees fit.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// A Timer is a time.Timer, as made by a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{t: time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+func (t systemTimer) Reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
+
+// The Backoffs made here, and so by the delay package, can wait on the
+// cache's clock. Others, such as a Delay of github.com/jan-g/delay used as
+// it stands, follow the system clock regardless.
+type clocked interface {
+	delayOn(clock Clock) <-chan time.Time
+}
+
+// Wait out the next delay of a Backoff, on the cache's clock if it can.
+func (cache *cache) delay(b Backoff) <-chan time.Time {
+	return delayOn(cache.clock, b)
+}
+
+func delayOn(clock Clock, b Backoff) <-chan time.Time {
+	if c, ok := b.(clocked); ok {
+		return c.delayOn(clock)
+	}
+	return b.Delay()
+}
+
+// A Scheduler decides when each key of a cache made by New is refreshed,
+// in place of the timer that each key's maintainer keeps, as WithScheduler
+// arranges. It's told when a key's next refresh is due, and tells the
+// maintainer when to make it, by sending on the channel it returns; it may
+// do so late, or early, or not at all, as it sees fit. Each key has one
+// refresh scheduled at a time, which replaces any before it.
+type Scheduler interface {
+	// Schedule arranges a key's next refresh for the given time.
+	Schedule(key Key, at time.Time) <-chan time.Time
+	// Cancel forgets a key's refresh, as when it's gone or is no longer
+	// refreshed.
+	Cancel(key Key)
+}
+
+// The default Scheduler, under which each maintainer times its own
+// refreshes, on the given clock.
+type timerScheduler struct {
+	clock Clock
+}
+
+func (s timerScheduler) Schedule(key Key, at time.Time) <-chan time.Time {
+	return s.clock.After(at.Sub(s.clock.Now()))
+}
+
+func (s timerScheduler) Cancel(key Key) {}
+
+// The clock that a key's refreshes are timed on, whose timers are those
+// of the cache's Scheduler.
+type refreshClock struct {
+	Clock
+	scheduler Scheduler
+	key       Key
+}
+
+func (cache *cache) refreshClock(key Key) refreshClock {
+	return refreshClock{Clock: cache.timers, scheduler: cache.scheduler, key: key}
+}
+
+func (c refreshClock) After(d time.Duration) <-chan time.Time {
+	return c.scheduler.Schedule(c.key, c.Now().Add(d))
+}
+
+func (cache *cache) since(t time.Time) time.Duration {
+	return cache.clock.Now().Sub(t)
+}
@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A clock that moves only when it's told to
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	calls  int // Counts those made of it, so that Sleep can tell when they've died down
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Move the clock on, firing the timers that fall due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// Move the clock on by d as a sleep would see it pass: a timer at a time,
+// letting those each wakes settle, and set timers of their own, before
+// moving on to the next.
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.run(c.Now().Add(d), nil)
+}
+
+// Make a call that waits on the clock, moving the clock on a timer at a
+// time, as Sleep does, until it returns.
+func (c *fakeClock) During(f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	c.run(time.Time{}, done)
+}
+
+// Move the clock on until the given time, or until done is closed.
+func (c *fakeClock) run(until time.Time, done chan struct{}) {
+	for {
+		c.settle()
+		select {
+		case <-done:
+			return
+		default:
+		}
+		c.mu.Lock()
+		next := until
+		for _, t := range c.timers {
+			if next.IsZero() || t.at.Before(next) {
+				next = t.at
+			}
+		}
+		c.mu.Unlock()
+		if next.IsZero() {
+			// It waits on something other than the clock
+			<-done
+			return
+		}
+		c.Advance(next.Sub(c.Now()))
+		if next.Equal(until) {
+			c.settle()
+			return
+		}
+	}
+}
+
+// Wait until nothing's made use of the clock for a few milliseconds, as
+// when those it's woken have done what they were woken for.
+func (c *fakeClock) settle() {
+	c.mu.Lock()
+	calls := c.calls
+	c.mu.Unlock()
+	for quiet := 0; quiet < 5; {
+		time.Sleep(time.Millisecond)
+		c.mu.Lock()
+		if c.calls == calls {
+			quiet++
+		} else {
+			calls, quiet = c.calls, 0
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.clock.calls++
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	active := t.Stop()
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.clock.calls++
+	t.at = t.clock.now.Add(d)
+	t.clock.timers = append(t.clock.timers, t)
+	return active
+}
+
+func TestWithClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	var loads int32
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return int(atomic.AddInt32(&loads, 1)), nil
+	}, Every(time.Hour), Every(time.Minute), WithClock(clock))
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	// Nothing happens until the clock says so
+	time.Sleep(period)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+	clock.Advance(time.Hour)
+	assert.Eventually(t, func() bool {
+		v, _ := c.GetIfPresent("foo")
+		return v == 2
+	}, time.Second, period/10)
+
+	// Left unused, the entry goes
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Hour)
+		return c.Len() == 0
+	}, time.Second, period/10)
+
+	cancel()
+}
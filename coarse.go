@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// A Clock whose After rounds deadlines up to a multiple of its resolution,
+// so that those falling in the same interval share a single timer, as
+// WithTimerResolution arranges. It runs that timer once it's started.
+type coarseClock struct {
+	Clock
+	resolution int64 // In nanoseconds
+
+	mu      sync.Mutex
+	buckets map[int64][]chan time.Time // The channels awaiting each deadline, in units of the resolution
+	due     slots                      // Those deadlines
+	wake    chan struct{}              // Nudged when one's sooner than before
+}
+
+func newCoarseClock(clock Clock, resolution time.Duration) *coarseClock {
+	return &coarseClock{
+		Clock:      clock,
+		resolution: int64(resolution),
+		buckets:    map[int64][]chan time.Time{},
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// A heap of deadlines, the soonest first
+type slots []int64
+
+func (s slots) Len() int            { return len(s) }
+func (s slots) Less(i, j int) bool  { return s[i] < s[j] }
+func (s slots) Swap(i, j int)       { s[i], s[j] = s[j], s[i] }
+func (s *slots) Push(x interface{}) { *s = append(*s, x.(int64)) }
+func (s *slots) Pop() interface{} {
+	old := *s
+	x := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return x
+}
+
+func (c *coarseClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	at := c.Now().Add(d).UnixNano()
+	slot := (at + c.resolution - 1) / c.resolution
+	c.mu.Lock()
+	waiting, ok := c.buckets[slot]
+	c.buckets[slot] = append(waiting, ch)
+	soonest := false
+	if !ok {
+		heap.Push(&c.due, slot)
+		soonest = c.due[0] == slot
+	}
+	c.mu.Unlock()
+	if soonest {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+	return ch
+}
+
+// Fire the deadlines that have passed, and say how long until the next;
+// or, if there's none, less than zero.
+func (c *coarseClock) fire() time.Duration {
+	now := c.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.due) > 0 && c.due[0]*c.resolution <= now.UnixNano() {
+		slot := heap.Pop(&c.due).(int64)
+		for _, ch := range c.buckets[slot] {
+			ch <- now
+		}
+		delete(c.buckets, slot)
+	}
+	if len(c.due) == 0 {
+		return -1
+	}
+	return time.Duration(c.due[0]*c.resolution - now.UnixNano())
+}
+
+// Run the shared timer until the context is done.
+func (c *coarseClock) run(ctx context.Context) {
+	var timer Timer
+	for {
+		var wait <-chan time.Time
+		if next := c.fire(); next >= 0 {
+			timer = rearm(c.Clock, timer, next)
+			wait = timer.C()
+		}
+		select {
+		case <-ctx.Done():
+		case <-c.wake:
+		case <-wait:
+		}
+		if wait != nil {
+			stopTimer(timer)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cron schedule, as the sets of minutes, hours, days of the month, months
+// and weekdays at which refreshes fall due
+type cron struct {
+	minute, hour, dom, month, dow uint64 // Bitsets
+	anyDom, anyDow                bool   // Whether those fields were left as *
+}
+
+// The fields of a cron expression, in order, with their bounds
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of the month", 1, 31},
+	{"month", 1, 12},
+	{"day of the week", 0, 6},
+}
+
+// Cron makes Backoffs that schedule each refresh for the next time matching
+// a cron expression, such as "0,30 * * * *" for on the hour and half-hour.
+// Unlike a relative delay, this doesn't drift against a source that's
+// updated at fixed times of day.
+//
+// The expression has the usual five fields: minute, hour, day of the month,
+// month and day of the week (0 being Sunday). Each is a *, a number or a
+// range such as 1-5, any of which may be followed by a step such as */15; or
+// a comma-separated list of those. As with cron, if both the day of the month
+// and the day of the week are restricted, a day matching either will do.
+// Times are in the local time zone.
+func Cron(spec string) (func() Backoff, error) {
+	c, err := parseCron(spec)
+	if err != nil {
+		return nil, err
+	}
+	return func() Backoff {
+		return c
+	}, nil
+}
+
+func parseCron(spec string) (*cron, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cache: cron expression %q: want %d fields, got %d", spec, len(cronFields), len(fields))
+	}
+	var sets [5]uint64
+	for i, field := range fields {
+		f := cronFields[i]
+		set, err := parseCronField(field, f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("cache: cron expression %q: %s: %w", spec, f.name, err)
+		}
+		sets[i] = set
+	}
+	return &cron{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		anyDom: fields[2] == "*",
+		anyDow: fields[4] == "*",
+	}, nil
+}
+
+// Parse a comma-separated list of ranges into a bitset.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		span, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			span = part[:i]
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if span != "*" {
+			bounds := strings.SplitN(span, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value in %q", part)
+				}
+			} else if step > 1 {
+				// As with cron, 5/15 means 5-max/15
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (c *cron) Delay() <-chan time.Time {
+	return c.delayOn(systemClock{})
+}
+
+func (c *cron) delayOn(clock Clock) <-chan time.Time {
+	now := clock.Now()
+	next := c.next(now)
+	if next.IsZero() {
+		return nil
+	}
+	return clock.After(next.Sub(now))
+}
+
+func (c *cron) Reset() {}
+
+// The first time after t that the schedule matches; zero if there's none.
+func (c *cron) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// An expression that can match at all does so within a few years (29th Feb on a Monday, say)
+	limit := t.AddDate(8, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cron) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCron(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	for _, tc := range []struct {
+		spec, from, next string
+	}{
+		{"0,30 * * * *", "2024-03-01 10:05", "2024-03-01 10:30"},
+		{"0,30 * * * *", "2024-03-01 10:30", "2024-03-01 11:00"},
+		{"*/15 9-17 * * *", "2024-03-01 17:50", "2024-03-02 09:00"},
+		{"0 0 * * 1-5", "2024-03-01 12:00", "2024-03-04 00:00"}, // Friday to Monday
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 1 * 0", "2024-03-01 12:00", "2024-03-03 00:00"}, // The 1st or a Sunday
+		{"0 0 30 2 *", "2024-03-01 00:00", ""},
+	} {
+		c, err := parseCron(tc.spec)
+		if !assert.Nil(t, err, tc.spec) {
+			continue
+		}
+		next := c.next(at(tc.from))
+		if tc.next == "" {
+			assert.True(t, next.IsZero(), tc.spec)
+		} else {
+			assert.Equal(t, at(tc.next), next, tc.spec)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := Cron(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
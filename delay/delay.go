@@ -0,0 +1,71 @@
+// Package delay adapts github.com/jan-g/delay to the cache's Backoff.
+//
+// The cache itself doesn't import jan-g/delay, so that caches that don't use
+// it needn't depend on it.
+package delay
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/jan-g/cache"
+	"github.com/jan-g/delay"
+)
+
+// Settings are the parameters of a Delay, as the options to delay.New set
+// them.
+type Settings struct {
+	Base       time.Duration // The first wait, and the one after a Reset
+	Multiplier float64       // What each wait is multiplied by for the next; 1 if zero
+	Maximum    time.Duration // The longest wait; Base if zero
+	Jitter     float64       // The fraction of a wait that may be added at random
+}
+
+// Fill in the defaults that delay.New would.
+func (s Settings) defaults() Settings {
+	if s.Multiplier == 0 {
+		s.Multiplier = 1
+	}
+	if s.Maximum == 0 {
+		s.Maximum = s.Base
+	}
+	return s
+}
+
+// Delay makes a Delay with the settings.
+func (s Settings) Delay() delay.Delay {
+	s = s.defaults()
+	return delay.New(s.Base, delay.WithMultiplier(s.Multiplier), delay.WithMaximum(s.Maximum), delay.WithJitter(s.Jitter))
+}
+
+// New makes Backoffs that wait as a Delay with the given settings does, a
+// fresh one for each key, for New and the options that take backoffs.
+// Unlike a Delay, they wait on the cache's clock, so WithClock and
+// WithScheduler govern them, and WithExpiryHeap can tell in advance when
+// they'll be done.
+//
+// A Delay's options are opaque once made, so the settings are given here
+// rather than read back from one.
+func New(s Settings) func() cache.Backoff {
+	s = s.defaults()
+	return cache.FromSchedule(func() cache.Schedule {
+		return &schedule{Settings: s, curr: s.Base}
+	})
+}
+
+// The intervals a Delay waits, worked out as it would
+type schedule struct {
+	Settings
+	curr time.Duration
+}
+
+func (s *schedule) NextBackOff() time.Duration {
+	wait := time.Duration(float64(s.curr) * (1 + rand.Float64()*s.Jitter))
+	s.curr = time.Duration(math.Min(float64(s.curr)*s.Multiplier, float64(s.Maximum)))
+	return wait
+}
+
+func (s *schedule) Reset() {
+	s.curr = s.Base
+}
@@ -0,0 +1,114 @@
+package delay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jan-g/cache"
+	"github.com/jan-g/delay"
+	"github.com/stretchr/testify/assert"
+)
+
+const period = 100 * time.Millisecond
+
+func TestNew(t *testing.T) {
+	backoff := New(Settings{Base: period, Multiplier: 2, Maximum: 4 * period})
+
+	// Each Backoff made keeps its own state
+	a, b := backoff(), backoff()
+	start := time.Now()
+	<-a.Delay()
+	<-a.Delay()
+	assert.WithinDuration(t, start.Add(3*period), time.Now(), period/2)
+	start = time.Now()
+	<-b.Delay()
+	assert.WithinDuration(t, start.Add(period), time.Now(), period/2)
+
+	a.Reset()
+	start = time.Now()
+	<-a.Delay()
+	assert.WithinDuration(t, start.Add(period), time.Now(), period/2)
+}
+
+func TestSettings(t *testing.T) {
+	// A Delay made with the settings waits as the Backoffs do
+	var d delay.Delay = Settings{Base: period / 2, Multiplier: 2, Maximum: period}.Delay()
+	start := time.Now()
+	<-d.Delay()
+	<-d.Delay()
+	<-d.Delay()
+	assert.WithinDuration(t, start.Add(5*period/2), time.Now(), period/2)
+}
+
+func TestCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loads := make(chan cache.Key, 10)
+	c := cache.New(ctx, func(ctx context.Context, key cache.Key) (cache.Value, error) {
+		loads <- key
+		return key, nil
+	}, New(Settings{Base: period}), New(Settings{Base: period}))
+
+	for _, key := range []string{"a", "b"} {
+		v, err := c.Get(ctx, key)
+		assert.Nil(t, err)
+		assert.Equal(t, key, v)
+	}
+	for i := 0; i < 2; i++ {
+		<-loads
+	}
+
+	// Both keys are refreshed on schedule
+	refreshed := map[cache.Key]bool{}
+	timeout := time.After(3 * period)
+	for len(refreshed) < 2 {
+		select {
+		case key := <-loads:
+			refreshed[key] = true
+		case <-timeout:
+			t.Fatal("keys weren't refreshed")
+		}
+	}
+}
+
+// A Scheduler that notes how far ahead each refresh is scheduled, and
+// makes it at once
+type eagerScheduler struct {
+	mu        sync.Mutex
+	intervals []time.Duration
+}
+
+func (s *eagerScheduler) Schedule(key cache.Key, at time.Time) <-chan time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.intervals = append(s.intervals, time.Until(at).Round(period/10))
+	c := make(chan time.Time, 1)
+	c <- at
+	return c
+}
+
+func (s *eagerScheduler) Cancel(key cache.Key) {}
+
+func TestScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &eagerScheduler{}
+	c := cache.New(ctx, func(ctx context.Context, key cache.Key) (cache.Value, error) {
+		return nil, errors.New("boom")
+	}, New(Settings{Base: period}), New(Settings{Base: period, Multiplier: 2, Maximum: 4 * period}), cache.WithScheduler(s), cache.WithKeepUnused())
+	_, err := c.Get(ctx, "foo")
+	assert.NotNil(t, err)
+
+	// The Scheduler is told of each refresh the Backoffs ask for
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.intervals) >= 4
+	}, period, period/100)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, []time.Duration{period, 2 * period, 4 * period, 4 * period}, s.intervals[:4])
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrShutdown is returned by a cache that has been closed, or whose
+	// context is done.
+	ErrShutdown = errors.New("cache: shut down")
+	// ErrNotFound may be returned (or wrapped) by a refresher to signal that
+	// a key doesn't exist upstream.
+	ErrNotFound = errors.New("cache: not found")
+	// ErrStale is returned in place of a value that's too old to be served.
+	ErrStale = errors.New("cache: stale")
+	// ErrTimeout is the failure recorded for a refresh that's abandoned for
+	// taking too long.
+	ErrTimeout = errors.New("cache: refresh timed out")
+	// ErrQuarantined is matched by the QuarantineError returned for a key
+	// that's in quarantine.
+	ErrQuarantined = errors.New("cache: quarantined")
+	// ErrTooManyKeys is matched by the KeyLimitError returned for a key
+	// beyond the limit set by WithKeyLimit.
+	ErrTooManyKeys = errors.New("cache: too many keys")
+	// ErrOverloaded is matched by the OverloadedError returned to a reader
+	// turned away for want of room to wait, as WithMaxWaiters arranges.
+	ErrOverloaded = errors.New("cache: overloaded")
+	// ErrUnbounded is returned for an attempt to change a bound that a cache
+	// wasn't made with, such as by SetMaxWeight for one that doesn't weigh
+	// its entries.
+	ErrUnbounded = errors.New("cache: unbounded")
+)
+
+// A QuarantineError is returned in place of a value whose key is in
+// quarantine. It wraps the failure that put it there, and matches
+// ErrQuarantined.
+type QuarantineError struct {
+	Key Key
+	Err error
+}
+
+func (e *QuarantineError) Error() string {
+	return ErrQuarantined.Error() + ": " + e.Err.Error()
+}
+
+func (e *QuarantineError) Is(target error) bool {
+	return target == ErrQuarantined
+}
+
+func (e *QuarantineError) Unwrap() error {
+	return e.Err
+}
+
+// A KeyLimitError is returned for a key that's refused for being one too
+// many, as WithKeyLimit arranges. It matches ErrTooManyKeys.
+type KeyLimitError struct {
+	Key   Key
+	Limit int // How many distinct keys may be read in each window
+}
+
+func (e *KeyLimitError) Error() string {
+	return fmt.Sprintf("%s: more than %d", ErrTooManyKeys.Error(), e.Limit)
+}
+
+func (e *KeyLimitError) Is(target error) bool {
+	return target == ErrTooManyKeys
+}
+
+// An OverloadedError is returned to a reader that would have waited on a
+// key's load, had there not been as many waiting as WithMaxWaiters allows.
+// It matches ErrOverloaded.
+type OverloadedError struct {
+	Key     Key
+	Waiters int // How many may wait
+}
+
+func (e *OverloadedError) Error() string {
+	return fmt.Sprintf("%s: %d readers already waiting", ErrOverloaded.Error(), e.Waiters)
+}
+
+func (e *OverloadedError) Is(target error) bool {
+	return target == ErrOverloaded
+}
+
+// A RetryAfterError is an error that says when to try again, as a rate
+// limiter might. When a refresher fails with one (or one that wraps one), the
+// next refresh is scheduled for then, rather than by the negative backoff.
+type RetryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// How long an error says to wait before trying again, if it says.
+func retryAfter(err error) (time.Duration, bool) {
+	var ra RetryAfterError
+	if errors.As(err, &ra) {
+		return ra.RetryAfter(), true
+	}
+	return 0, false
+}
+
+// A RefreshError wraps the error from a failed refresh, so that it can be
+// told apart from errors originating in the cache itself.
+type RefreshError struct {
+	Key Key
+	Err error
+}
+
+// Error returns the refresher's message unchanged.
+func (e *RefreshError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RefreshError) Unwrap() error {
+	return e.Err
+}
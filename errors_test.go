@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return nil, fmt.Errorf("looking up %v: %w", key, ErrNotFound)
+	}, positive, negative)
+
+	_, e := c.Get(context.Background(), "foo")
+	assert.ErrorIs(t, e, ErrNotFound)
+	var re *RefreshError
+	assert.ErrorAs(t, e, &re)
+	assert.Equal(t, "foo", re.Key)
+	assert.Equal(t, "looking up foo: cache: not found", e.Error())
+
+	cancel()
+	_, e = c.Get(context.Background(), "foo")
+	assert.ErrorIs(t, e, ErrShutdown)
+}
+
+type rateLimited time.Duration
+
+func (e rateLimited) Error() string {
+	return "rate limited"
+}
+
+func (e rateLimited) RetryAfter() time.Duration {
+	return time.Duration(e)
+}
+
+func TestRetryAfter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int32
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return nil, fmt.Errorf("upstream: %w", rateLimited(3*period))
+		}
+		return 42, nil
+	}, Every(period), Every(period), WithRetries(3, nil), WithClock(clock))
+
+	_, e := c.Get(context.Background(), "foo")
+	var ra RetryAfterError
+	assert.ErrorAs(t, e, &ra)
+
+	// Neither the retries nor the negative backoff come back before we're told to
+	clock.Sleep(5 * period / 2)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	_, e = c.Get(context.Background(), "foo")
+	assert.NotNil(t, e)
+
+	clock.Sleep(period)
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 42, v)
+
+	cancel()
+}
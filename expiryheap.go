@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"math"
+	"time"
+)
+
+// The backoffs that pace the refreshes of a key of New's, when they're kept
+// in an expiry heap rather than timed by a maintainer
+type pacing struct {
+	positive, negative Backoff
+	// The backoff for the last error, which may be one of WithErrorBackoffs'
+	failing Backoff
+	// The delay being waited out, if it's one that couldn't be told in
+	// advance, and when it was asked for
+	wait  <-chan time.Time
+	asked time.Time
+	// How long the last such delay turned out to be, as a guess at the next
+	took time.Duration
+}
+
+// The soonest an entry waiting out a delay that couldn't be told in advance
+// is looked at again to see whether it's over
+const minCheck = time.Millisecond
+
+// A clock that, rather than timing the delay that a Backoff asks of it,
+// notes it down, so that the heap can be told when a refresh falls due
+type measure struct {
+	Clock
+	d     time.Duration
+	asked bool
+}
+
+func (m *measure) After(d time.Duration) <-chan time.Time {
+	m.d, m.asked = d, true
+	return nil
+}
+
+// When a refresh paced by b falls due, if it's to be made at all. The
+// Backoffs made here, and by the delay package, say beforehand how long
+// they'd wait. Others don't, so the entry is taken to stay fresh until
+// their delay is over, which the heap looks to see, first when the last
+// such delay would have been over. The caller holds d.mu.
+func (c *onDemand) measure(d *demand, b Backoff, now time.Time) time.Time {
+	p := &d.extras.paced
+	p.wait = nil
+	if _, ok := b.(clocked); ok {
+		m := &measure{Clock: c.cache.clock}
+		delayOn(m, b)
+		if m.asked {
+			return now.Add(m.d)
+		}
+	} else {
+		p.wait, p.asked = b.Delay(), now
+	}
+	return now.Add(math.MaxInt64)
+}
+
+// When an entry should next be looked at by the heap: when its value goes
+// stale, or when the delay it's waiting out is likely to be over. The caller
+// holds d.mu.
+func (c *onDemand) due(d *demand) int64 {
+	if d.extras == nil || d.extras.paced.wait == nil {
+		return d.expires
+	}
+	p := &d.extras.paced
+	if p.took < minCheck {
+		return nanos(p.asked.Add(minCheck))
+	}
+	return nanos(p.asked.Add(p.took))
+}
+
+// Whether an entry that's fallen due is still waiting out a delay that
+// couldn't be told in advance, in which case it's put back in the queue to
+// look again after a quarter as long again as it's waited so far. Once the
+// delay is over, the entry's value is stale. The caller holds d.mu.
+func (c *onDemand) waiting(key Key, d *demand, now time.Time) bool {
+	if d.extras == nil || d.extras.paced.wait == nil {
+		return false
+	}
+	p := &d.extras.paced
+	select {
+	case <-p.wait:
+		p.wait, p.took = nil, now.Sub(p.asked)
+		d.expires = now.UnixNano()
+		return false
+	default:
+	}
+	again := now.Sub(p.asked) / 4
+	if again < minCheck {
+		again = minCheck
+	}
+	c.queue(key, d, nanos(now.Add(again)))
+	return true
+}
+
+// The pacing of a key's refreshes, if the cache has any, made the first
+// time it's needed. The caller holds d.mu.
+func (c *onDemand) pacing(key Key, d *demand) *pacing {
+	if c.cache.positive == nil {
+		return nil
+	}
+	p := &d.extra().paced
+	if p.positive == nil {
+		p.positive, p.negative = c.cache.backoffsFor(key)
+		p.failing = p.negative
+	}
+	return p
+}
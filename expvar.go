@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// The caches published with expvar, by name, under the map made or found
+// the first time one is
+var (
+	exportsMu sync.Mutex
+	exports   *expvar.Map
+)
+
+// How a cache is published with expvar, as WithExpvar arranges
+type exported struct {
+	name    string
+	pattern func(Key) string
+
+	mu         sync.Mutex
+	stats      func() Stats      // Set as it's published
+	lastErrors map[string]string // The last error loading a key of each pattern
+}
+
+// What's published of a cache
+type exportedStats struct {
+	Stats
+	LastErrors map[string]string
+}
+
+// Note how a load turned out, if it failed.
+func (e *exported) loaded(key Key, result r) {
+	if result.Err == nil {
+		return
+	}
+	var pattern string
+	if e.pattern != nil {
+		pattern = e.pattern(key)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lastErrors == nil {
+		e.lastErrors = map[string]string{}
+	}
+	e.lastErrors[pattern] = result.Err.Error()
+}
+
+func (e *exported) errors() map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	errors := make(map[string]string, len(e.lastErrors))
+	for pattern, err := range e.lastErrors {
+		errors[pattern] = err
+	}
+	return errors
+}
+
+// What's published of the cache, as JSON.
+func (e *exported) String() string {
+	e.mu.Lock()
+	stats := e.stats
+	e.mu.Unlock()
+	b, _ := json.Marshal(exportedStats{Stats: stats(), LastErrors: e.errors()})
+	return string(b)
+}
+
+// Publish the stats of c, of which cache is part, if it should be, in
+// place of any it published before. Like expvar.Publish, it panics if the
+// name is taken, by another cache or by anything else.
+func (cache *cache) publish(c Cache) {
+	e := cache.export
+	if e == nil {
+		return
+	}
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	if exports == nil {
+		switch v := expvar.Get("cache").(type) {
+		case nil:
+			exports = expvar.NewMap("cache")
+		case *expvar.Map:
+			exports = v
+		default:
+			panic(fmt.Sprintf("cache: expvar %q is already published, and isn't a map", "cache"))
+		}
+	}
+	if v := exports.Get(e.name); v != nil && v != expvar.Var(e) {
+		panic(fmt.Sprintf("cache: expvar name %q is already published", e.name))
+	}
+	e.mu.Lock()
+	e.stats = c.Stats
+	e.mu.Unlock()
+	exports.Set(e.name, e)
+}
+
+// Stop publishing the cache's stats, as it closes, unless what's published
+// under its name isn't its own.
+func (cache *cache) unpublish() {
+	e := cache.export
+	if e == nil {
+		return
+	}
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	if exports != nil && exports.Get(e.name) == expvar.Var(e) {
+		exports.Delete(e.name)
+	}
+}
+
+// Count a load that's landed, note it for expvar, and tell the hooks.
+func (cache *cache) landed(key Key, result r) {
+	cache.stats.loaded(result)
+	if cache.export != nil {
+		cache.export.loaded(key, result)
+	}
+	cache.hooks.loaded(key, result)
+}
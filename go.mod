@@ -1,9 +1,18 @@
 module github.com/jan-g/cache
 
-go 1.12
+go 1.19
 
 require (
 	github.com/jan-g/delay v0.0.0-20190312093912-b308d2b11009
 	github.com/sirupsen/logrus v1.3.0
-	github.com/stretchr/testify v1.3.0
+	github.com/stretchr/testify v1.8.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/crypto v0.0.0-20180904163835-0709b304e793 // indirect
+	golang.org/x/sys v0.0.0-20180905080454-ebe1bf3edb33 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
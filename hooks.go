@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+)
+
+// Hooks are called as entries are loaded and removed. They run on the
+// maintainer of the key concerned, so should return promptly. Any may be nil.
+type Hooks struct {
+	// OnRefresh is called when the refresher successfully loads a value.
+	OnRefresh func(key Key, value Value)
+	// OnError is called when the refresher fails.
+	OnError func(key Key, err error)
+	// OnEvict is called when the cache drops an entry of its own accord: for
+	// want of use, after too many failures, or to make room for others.
+	OnEvict func(key Key, value Value)
+	// OnTimeout is called when a refresh is abandoned for taking too long.
+	// OnError follows, with ErrTimeout.
+	OnTimeout func(key Key)
+	// OnTooManyKeys is called when a read of a key is the first in its window
+	// to go beyond the limit set by WithKeyLimit.
+	OnTooManyKeys func(key Key, limit int)
+	// OnSweep is called after each pass of the sweeper set up by
+	// WithSweeper, with how many entries it reaped.
+	OnSweep func(reaped int)
+	// OnRemove is called whenever an entry leaves the cache, for whatever
+	// reason, with the last value it held.
+	OnRemove func(key Key, value Value, reason Reason)
+	// OnRemoveBatch, if set, is called in place of OnRemove with the entries
+	// removed together in one pass over the cache: by SetMaxEntries or
+	// SetMaxWeight, Purge, Close, a sweep, or shedding under memory
+	// pressure. They can then be archived in one go, say, rather than one
+	// at a time. The context is that given to Close for the entries removed
+	// by it, and the cache's own otherwise. Entries removed alone are still
+	// reported to OnRemove.
+	OnRemoveBatch func(ctx context.Context, removals []Removal)
+}
+
+// A Reason says why an entry left the cache.
+type Reason int
+
+const (
+	ReasonUnused      Reason = iota // It went unread for too long
+	ReasonExpired                   // It reached the end of its lifetime (see WithExpireAfterWrite)
+	ReasonCapacity                  // It was evicted to make room for others
+	ReasonInvalidated               // It was invalidated or purged
+	ReasonFailure                   // Its refreshes failed too many times
+	ReasonShutdown                  // The cache was closed
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonUnused:
+		return "unused"
+	case ReasonExpired:
+		return "expired"
+	case ReasonCapacity:
+		return "capacity"
+	case ReasonInvalidated:
+		return "invalidated"
+	case ReasonFailure:
+		return "failure"
+	case ReasonShutdown:
+		return "shutdown"
+	}
+	return fmt.Sprintf("Reason(%d)", int(r))
+}
+
+func (h *Hooks) loaded(key Key, result r) {
+	if result.Err == nil {
+		if h.OnRefresh != nil {
+			h.OnRefresh(key, result.Value)
+		}
+	} else if h.OnError != nil {
+		h.OnError(key, result.Err)
+	}
+}
+
+func (h *Hooks) timedOut(key Key) {
+	if h.OnTimeout != nil {
+		h.OnTimeout(key)
+	}
+}
+
+func (h *Hooks) evicted(key Key, value Value) {
+	if h.OnEvict != nil {
+		h.OnEvict(key, value)
+	}
+}
+
+func (h *Hooks) removed(key Key, value Value, reason Reason) {
+	if h.OnRemove != nil {
+		h.OnRemove(key, value, reason)
+	}
+}
+
+func (h *Hooks) removedBatch(ctx context.Context, removals []Removal) {
+	if h.OnRemoveBatch != nil {
+		h.OnRemoveBatch(ctx, removals)
+	}
+}
+
+func (h *Hooks) tooManyKeys(key Key, limit int) {
+	if h.OnTooManyKeys != nil {
+		h.OnTooManyKeys(key, limit)
+	}
+}
+
+func (h *Hooks) swept(reaped int) {
+	if h.OnSweep != nil {
+		h.OnSweep(reaped)
+	}
+}
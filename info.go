@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Info describes the state of a cache entry.
+type Info struct {
+	Refreshed   time.Time     // When a value was last successfully loaded; zero if never
+	Age         time.Duration // How long ago that was
+	Errors      int           // How many loads have failed since
+	LastError   error         // The latest of those failures
+	Refreshing  bool          // Whether a refresh is in flight
+	Quarantined bool          // Whether failures have put the entry in quarantine
+}
+
+// Update the info with the outcome of a load.
+func (info *Info) record(result r, at time.Time) {
+	if result.Err == nil {
+		info.Refreshed = at
+		info.Errors = 0
+		info.LastError = nil
+	} else {
+		info.Errors++
+		info.LastError = result.Err
+	}
+}
+
+func (cache *cache) GetWithInfo(ctx context.Context, key Key) (Value, Info, error) {
+	key = cache.canonical(key)
+	for {
+		e, started, err := cache.entryFor(ctx, key, cache.refresher)
+		if err != nil {
+			return nil, Info{}, err
+		}
+		if !started {
+			if p, ok := cache.hit(e); ok {
+				return p.result.Value, cache.aged(p.info), p.result.Err
+			}
+		}
+		_, ok, err := cache.receive(ctx, key, e, started)
+		if err != nil {
+			return nil, Info{}, err
+		}
+		if !ok {
+			continue
+		}
+		// This counts as a use, and guarantees a value has been published.
+		// Report what's published, so that the value and its info match up.
+		result, info, _ := e.status()
+		return result.Value, cache.aged(info), result.Err
+	}
+}
+
+// Fill in the age of the value the info describes.
+func (cache *cache) aged(info Info) Info {
+	if !info.Refreshed.IsZero() {
+		info.Age = cache.since(info.Refreshed)
+	}
+	return info
+}
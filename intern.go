@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+)
+
+// An Interner keeps a single copy of each string key in use, as WithInterner
+// arranges. Caches that share one share their copies too.
+type Interner struct {
+	mu      sync.Mutex
+	strings map[string]*interned
+}
+
+type interned struct {
+	s    string
+	refs int
+}
+
+// NewInterner makes an Interner, for one cache or several.
+func NewInterner() *Interner {
+	return &Interner{strings: map[string]*interned{}}
+}
+
+// The single copy of a string, made if need be; each call must be matched
+// by a call to release.
+func (in *Interner) acquire(s string) string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	i, ok := in.strings[s]
+	if !ok {
+		// A copy of its own, so as not to hold on to whatever the caller's is part of
+		i = &interned{s: strings.Clone(s)}
+		in.strings[i.s] = i
+	}
+	i.refs++
+	return i.s
+}
+
+func (in *Interner) release(s string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if i, ok := in.strings[s]; ok {
+		i.refs--
+		if i.refs == 0 {
+			delete(in.strings, s)
+		}
+	}
+}
+
+// Len counts the strings interned.
+func (in *Interner) Len() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return len(in.strings)
+}
+
+// The key that a key's entry is kept under, as WithCanonicalKey has it.
+func (cache *cache) canonical(key Key) Key {
+	if cache.canon == nil {
+		return key
+	}
+	return cache.canon(key)
+}
+
+// The key to keep for a new entry: the interned copy of a string key, if
+// the cache interns them.
+func (cache *cache) intern(key Key) Key {
+	if s, ok := key.(string); ok && cache.interner != nil {
+		return cache.interner.acquire(s)
+	}
+	return key
+}
+
+// Let go of the key of an entry that's gone.
+func (cache *cache) unintern(key Key) {
+	if s, ok := key.(string); ok && cache.interner != nil {
+		cache.interner.release(s)
+	}
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := NewInterner()
+	load := func(ctx context.Context, key Key) (Value, error) {
+		return len(key.(string)), nil
+	}
+	c1 := New(ctx, load, Every(period), Every(period), WithInterner(in))
+	c2 := NewOnDemand(ctx, load, period, period, WithInterner(in))
+
+	// The same key, built afresh each time, is held once between the caches
+	long := strings.Repeat("x", 1000)
+	for _, c := range []Cache{c1, c2, c1, c2} {
+		v, e := c.Get(context.Background(), long[:500]+long[500:])
+		assert.Nil(t, e)
+		assert.Equal(t, 1000, v)
+	}
+	v, e := c1.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 3, v)
+	assert.Equal(t, 2, in.Len())
+
+	// Only once the last entry for a key goes is it let go
+	c2.Invalidate(context.Background(), long)
+	assert.Equal(t, 2, in.Len())
+	cancel()
+	assert.Eventually(t, func() bool { return in.Len() == 0 }, time.Second, period/10)
+}
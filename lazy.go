@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// The keys read once of late, so that only those read again are given a
+// maintainer, as WithLazyMaintainers arranges. Keys are remembered by
+// window, the current one and the one before, so each is remembered for
+// between one and two windows.
+type lazy struct {
+	mu       sync.Mutex
+	window   time.Duration
+	start    time.Time
+	current  map[Key]struct{}
+	previous map[Key]struct{}
+}
+
+// Note a read of a key that isn't resident, reporting whether it's the
+// first of late.
+func (l *lazy) first(key Key, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elapsed := now.Sub(l.start); elapsed >= l.window {
+		l.previous = l.current
+		if elapsed >= 2*l.window {
+			l.previous = nil
+		}
+		l.start, l.current = now, map[Key]struct{}{}
+	}
+	_, current := l.current[key]
+	_, previous := l.previous[key]
+	if current || previous {
+		// It's to be resident from here on
+		delete(l.current, key)
+		delete(l.previous, key)
+		return false
+	}
+	l.current[key] = struct{}{}
+	return true
+}
+
+// Whether a read of a key that isn't resident is the first of late, and
+// so should load it without keeping it, if maintainers are started lazily.
+func (cache *cache) once(key Key) bool {
+	return cache.lazy != nil && cache.lazy.first(key, cache.clock.Now())
+}
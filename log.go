@@ -0,0 +1,44 @@
+package cache
+
+// A Logger receives what the cache has to say of its workings, as
+// WithLogger arranges: mostly at the debug level, as maintainers come and
+// go and values are refreshed, with warnings of refreshes that time out and
+// stores that fail. The fields alternate between names and values, as
+// "key", key, "error", err. The logrus and slog packages adapt the loggers
+// of those names.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+}
+
+// Log a debug message, if there's a Logger.
+func (cache *cache) debug(msg string, fields ...interface{}) {
+	if cache.logger != nil {
+		cache.logger.Debug(msg, fields...)
+	}
+}
+
+// Log a warning, if there's a Logger.
+func (cache *cache) warn(msg string, fields ...interface{}) {
+	if cache.logger != nil {
+		cache.logger.Warn(msg, fields...)
+	}
+}
+
+// Logs, if there's a Logger, for a maintainer, with its key
+type keyLogger struct {
+	logger Logger
+	key    Key
+}
+
+func (l keyLogger) Debug(msg string, fields ...interface{}) {
+	if l.logger != nil {
+		l.logger.Debug(msg, append([]interface{}{"key", l.key}, fields...)...)
+	}
+}
+
+func (l keyLogger) Warn(msg string, fields ...interface{}) {
+	if l.logger != nil {
+		l.logger.Warn(msg, append([]interface{}{"key", l.key}, fields...)...)
+	}
+}
@@ -0,0 +1,40 @@
+// Package logrus adapts a github.com/sirupsen/logrus logger to the cache's
+// Logger, for cache.WithLogger.
+//
+// The cache itself doesn't import logrus, so that caches that don't log
+// with it needn't depend on it.
+package logrus
+
+import (
+	"fmt"
+
+	"github.com/jan-g/cache"
+	"github.com/sirupsen/logrus"
+)
+
+// New makes a Logger that logs to logger, with the cache's fields as its
+// own. The standard logger, logrus.StandardLogger(), will do.
+func New(logger logrus.FieldLogger) cache.Logger {
+	return fieldLogger{logger}
+}
+
+type fieldLogger struct {
+	logger logrus.FieldLogger
+}
+
+func (l fieldLogger) Debug(msg string, fields ...interface{}) {
+	l.logger.WithFields(asFields(fields)).Debug(msg)
+}
+
+func (l fieldLogger) Warn(msg string, fields ...interface{}) {
+	l.logger.WithFields(asFields(fields)).Warn(msg)
+}
+
+// Pair up the names and values of fields.
+func asFields(fields []interface{}) logrus.Fields {
+	f := make(logrus.Fields, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		f[fmt.Sprint(fields[i])] = fields[i+1]
+	}
+	return f
+}
@@ -0,0 +1,38 @@
+package logrus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jan-g/cache"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := cache.New(ctx, func(ctx context.Context, key cache.Key) (cache.Value, error) {
+		return nil, errors.New("boom")
+	}, cache.Every(time.Hour), cache.Every(time.Hour), cache.WithLogger(New(logger)))
+	_, e := c.Get(context.Background(), "foo")
+	assert.NotNil(t, e)
+
+	// The maintainer logs the refresh, with the key and error as fields
+	var refreshed *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "refreshed value" {
+			refreshed = entry
+		}
+	}
+	if assert.NotNil(t, refreshed) {
+		assert.Equal(t, logrus.DebugLevel, refreshed.Level)
+		assert.Equal(t, "foo", refreshed.Data["key"])
+		assert.Equal(t, "boom", refreshed.Data["error"].(error).Error())
+	}
+}
@@ -0,0 +1,65 @@
+// Package prometheus exports a cache's Stats as Prometheus metrics.
+//
+// It's a module of its own, github.com/jan-g/cache/metrics/prometheus, so
+// that caches that aren't monitored with it needn't depend on the Prometheus
+// client.
+package prometheus
+
+import (
+	"github.com/jan-g/cache"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// A Collector is a prometheus.Collector that reports the Stats of a Cache
+// each time it's scraped: hits and misses, refreshes and how long they took,
+// refresh errors, evictions, and how many entries and maintainers it has.
+type Collector struct {
+	c cache.Cache
+
+	hits, misses, refreshes, errors, evictions *prom.Desc
+	refreshTime, entries, maintainers          *prom.Desc
+}
+
+// NewCollector makes a Collector for c, whose metrics are labelled with
+// cache="name", so that those of several caches can be told apart.
+func NewCollector(c cache.Cache, name string) *Collector {
+	desc := func(metric, help string) *prom.Desc {
+		return prom.NewDesc("cache_"+metric, help, nil, prom.Labels{"cache": name})
+	}
+	return &Collector{
+		c:           c,
+		hits:        desc("hits_total", "Reads served from a loaded entry."),
+		misses:      desc("misses_total", "Reads that waited for a load."),
+		refreshes:   desc("refreshes_total", "Successful loads, initial or otherwise."),
+		errors:      desc("refresh_errors_total", "Failed loads."),
+		evictions:   desc("evictions_total", "Entries dropped for want of use, after too many failures, or for room."),
+		refreshTime: desc("refresh_duration_seconds", "How long loads took, successful or not."),
+		entries:     desc("entries", "Entries currently resident."),
+		maintainers: desc("maintainers", "Goroutines maintaining keys."),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	for _, d := range []*prom.Desc{c.hits, c.misses, c.refreshes, c.errors, c.evictions, c.refreshTime, c.entries, c.maintainers} {
+		ch <- d
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	s := c.c.Stats()
+	counter := func(d *prom.Desc, n uint64) {
+		ch <- prom.MustNewConstMetric(d, prom.CounterValue, float64(n))
+	}
+	gauge := func(d *prom.Desc, n int) {
+		ch <- prom.MustNewConstMetric(d, prom.GaugeValue, float64(n))
+	}
+	counter(c.hits, s.Hits)
+	counter(c.misses, s.Misses)
+	counter(c.refreshes, s.Refreshes)
+	counter(c.errors, s.RefreshErrors)
+	counter(c.evictions, s.Evictions)
+	// The cache keeps no more than the total time, so there are no quantiles
+	ch <- prom.MustNewConstSummary(c.refreshTime, s.Refreshes+s.RefreshErrors, s.RefreshTime.Seconds(), nil)
+	gauge(c.entries, s.Entries)
+	gauge(c.maintainers, s.Maintainers)
+}
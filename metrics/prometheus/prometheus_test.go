@@ -0,0 +1,57 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jan-g/cache"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := cache.New(ctx, func(ctx context.Context, key cache.Key) (cache.Value, error) {
+		if key == "bad" {
+			return nil, errors.New("boom")
+		}
+		time.Sleep(10 * time.Millisecond)
+		return key, nil
+	}, cache.Every(time.Hour), cache.Every(time.Hour))
+	_, _ = c.Get(context.Background(), "a")
+	_, _ = c.Get(context.Background(), "a")
+	_, _ = c.Get(context.Background(), "bad")
+
+	registry := prom.NewPedanticRegistry()
+	registry.MustRegister(NewCollector(c, "test"))
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	values := map[string]float64{}
+	for _, f := range families {
+		m := f.GetMetric()[0]
+		assert.Equal(t, "test", m.GetLabel()[0].GetValue())
+		switch {
+		case m.Counter != nil:
+			values[f.GetName()] = m.GetCounter().GetValue()
+		case m.Gauge != nil:
+			values[f.GetName()] = m.GetGauge().GetValue()
+		case m.Summary != nil:
+			values[f.GetName()] = float64(m.GetSummary().GetSampleCount())
+			assert.True(t, m.GetSummary().GetSampleSum() >= 0.01)
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"cache_hits_total":               1,
+		"cache_misses_total":             2,
+		"cache_refreshes_total":          1,
+		"cache_refresh_errors_total":     1,
+		"cache_evictions_total":          0,
+		"cache_refresh_duration_seconds": 2,
+		"cache_entries":                  2,
+		"cache_maintainers":              2,
+	}, values)
+}
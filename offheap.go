@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"runtime"
+)
+
+// A Codec turns values into bytes and back, for WithOffHeap.
+type Codec interface {
+	Encode(value Value) ([]byte, error)
+	Decode(data []byte) (Value, error)
+}
+
+type gobCodec struct{}
+
+// GobCodec makes a Codec that uses encoding/gob. The concrete types of the
+// values, if they're not built in, must be registered with gob.Register.
+func GobCodec() Codec {
+	return gobCodec{}
+}
+
+func (gobCodec) Encode(value Value) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte) (Value, error) {
+	var value Value
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+// A Blob is a value kept off the heap, as WithOffHeap arranges: its encoded
+// bytes are held in memory the garbage collector neither manages nor scans,
+// which is released once the Blob itself is unreachable.
+type Blob struct {
+	data  []byte // Off the heap, where the platform allows
+	codec Codec
+}
+
+// Keep the bytes of a value off the heap.
+func newBlob(data []byte, codec Codec) *Blob {
+	b := &Blob{data: allocOffHeap(len(data)), codec: codec}
+	copy(b.data, data)
+	if len(b.data) > 0 {
+		runtime.SetFinalizer(b, (*Blob).free)
+	}
+	return b
+}
+
+func (b *Blob) free() {
+	freeOffHeap(b.data)
+	b.data = nil
+}
+
+// Decode makes a copy of the value, on the heap.
+func (b *Blob) Decode() (Value, error) {
+	defer runtime.KeepAlive(b)
+	return b.codec.Decode(b.data)
+}
+
+// View calls f with the value's encoded bytes, without copying them. They
+// mustn't be kept, or changed, once f returns.
+func (b *Blob) View(f func(data []byte) error) error {
+	defer runtime.KeepAlive(b)
+	return f(b.data)
+}
+
+// Size reports how many bytes the value takes up, encoded, so that
+// EstimateSize weighs it by them.
+func (b *Blob) Size() int64 {
+	return int64(len(b.data))
+}
+
+// Move a result's value off the heap, if the cache keeps them there.
+func (cache *cache) stow(result r) r {
+	if cache.codec == nil || result.Err != nil {
+		return result
+	}
+	if _, ok := result.Value.(*Blob); ok {
+		// Brought back from the cold store, say
+		return result
+	}
+	data, err := cache.codec.Encode(result.Value)
+	if err != nil {
+		return r{Err: err}
+	}
+	result.Value = newBlob(data, cache.codec)
+	return result
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package cache
+
+// Without mmap, values are kept on the heap after all.
+func allocOffHeap(n int) []byte {
+	return make([]byte, n)
+}
+
+func freeOffHeap(data []byte) {}
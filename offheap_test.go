@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffHeap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	big := bytes.Repeat([]byte("blob"), 1<<14)
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return big, nil
+	}, Every(time.Hour), Every(time.Hour), WithOffHeap(GobCodec()))
+
+	// Readers are handed the value encoded, and decode it as they need it
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	b, ok := v.(*Blob)
+	assert.True(t, ok)
+	decoded, e := b.Decode()
+	assert.Nil(t, e)
+	assert.Equal(t, big, decoded)
+	assert.Nil(t, b.View(func(data []byte) error {
+		assert.True(t, len(data) >= len(big))
+		return nil
+	}))
+	assert.True(t, EstimateSize("foo", b) >= int64(len(big)))
+
+	// Updates are encoded in turn
+	v, e = c.Update(context.Background(), "foo", func(old Value) (Value, error) {
+		value, err := old.(*Blob).Decode()
+		return append(value.([]byte), '!'), err
+	})
+	assert.Nil(t, e)
+	decoded, _ = v.(*Blob).Decode()
+	assert.Len(t, decoded, len(big)+1)
+
+	// Values that can't be encoded fail
+	assert.Nil(t, c.Set(context.Background(), "bar", func() {}))
+	_, e = c.Get(context.Background(), "bar")
+	assert.NotNil(t, e)
+
+	// Blobs that are replaced are freed in time
+	for i := 0; i < 10; i++ {
+		c.Set(context.Background(), "foo", big)
+		runtime.GC()
+	}
+	v, _ = c.Get(context.Background(), "foo")
+	decoded, _ = v.(*Blob).Decode()
+	assert.Equal(t, big, decoded)
+}
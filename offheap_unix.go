@@ -0,0 +1,24 @@
+//go:build unix
+
+package cache
+
+import (
+	"syscall"
+)
+
+// Map anonymous memory for n bytes, or fall back to the heap if that fails.
+func allocOffHeap(n int) []byte {
+	if n == 0 {
+		return nil
+	}
+	data, err := syscall.Mmap(-1, 0, n, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return make([]byte, n)
+	}
+	return data
+}
+
+func freeOffHeap(data []byte) {
+	// Memory that came from the heap isn't mapped, and is left to the collector
+	_ = syscall.Munmap(data)
+}
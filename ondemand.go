@@ -0,0 +1,856 @@
+package cache
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// An onDemand cache runs no goroutine per key. Its entries are plain data,
+// checked for freshness as they're read: the first reader to find one stale
+// reloads it, and any others wait for that same load.
+type onDemand struct {
+	cache       *cache        // Options and stats, and the store of entries
+	ttl         time.Duration // How long a value stays fresh
+	negativeTTL time.Duration // Likewise an error
+	sched       *scheduler    // Refreshes entries as they fall due, for NewScheduled; nil for none
+}
+
+// A load in flight; its outcome is filled in before done is closed.
+type load struct {
+	done    chan struct{}
+	result  r
+	info    Info
+	dropped bool // The entry went away first; its successor should be tried instead
+	cancel  context.CancelFunc
+	waiters int32 // Readers waiting on it, counted if they're limited
+}
+
+// An on-demand entry, guarded by mu. There may be millions of them, so
+// they're packed into a hundred bytes or so: times are kept in Unix
+// nanoseconds, the Info is pieced together from its fields as it's asked
+// for, and what few entries need is kept apart, in extras.
+type demand struct {
+	mu        sync.Mutex
+	result    r
+	expires   int64   // When result goes stale, in Unix nanoseconds
+	used      int64   // When the entry was last read, likewise
+	refreshed int64   // When a value was last loaded, likewise; zero if never
+	load      *load   // The load in flight, if any
+	extras    *extras // Made the first time it's needed
+	gen       uint32  // Counts loads started, so that superseded ones are ignored as they land
+	turn      uint32  // Counts the times it's been scheduled, so that the places it's left in the queue are ignored
+	errors    uint16  // How many loads have failed since the last good one, up to as many as fit
+	heat      uint16  // Reads of late, halved as each load begins, for the order of queued loads; likewise
+	reads     uint8   // How many times it's been read, counted up to two
+	loaded    bool    // Whether result holds anything yet
+	touched   bool    // Whether it's been read since it last fell due, if it's scheduled
+	dropped   bool    // Removed from the cache
+}
+
+// The parts of an on-demand entry that few need
+type extras struct {
+	refresher   Refresher // In place of the cache's, once a reader has given a loader
+	subscribers []subscriber
+	lastError   error  // The latest failure, if the last good value was kept in spite of it
+	paced       pacing // What paces its refreshes, if it's one of New's kept in an expiry heap
+}
+
+// The entry's extras, made if need be. The caller holds d.mu.
+func (d *demand) extra() *extras {
+	if d.extras == nil {
+		d.extras = &extras{}
+	}
+	return d.extras
+}
+
+// The refresher to load the entry with. The caller holds d.mu.
+func (d *demand) refresher(fallback Refresher) Refresher {
+	if d.extras != nil && d.extras.refresher != nil {
+		return d.extras.refresher
+	}
+	return fallback
+}
+
+// Whether anyone's subscribed to the entry. The caller holds d.mu.
+func (d *demand) subscribed() bool {
+	return d.extras != nil && len(d.extras.subscribers) > 0
+}
+
+// Note the outcome of a load, or a result that's been set, as Info.record
+// does. The caller holds d.mu.
+func (d *demand) record(result r, at time.Time) {
+	if result.Err == nil {
+		d.refreshed, d.errors = at.UnixNano(), 0
+	} else if d.errors < math.MaxUint16 {
+		d.errors++
+	}
+	if d.extras != nil {
+		d.extras.lastError = nil
+	}
+}
+
+// The entry's Info. The caller holds d.mu.
+func (d *demand) info() Info {
+	info := Info{Errors: int(d.errors), Refreshing: d.load != nil}
+	if d.refreshed != 0 {
+		info.Refreshed = time.Unix(0, d.refreshed)
+	}
+	if d.errors > 0 {
+		info.LastError = d.result.Err
+		if d.extras != nil && d.extras.lastError != nil {
+			info.LastError = d.extras.lastError
+		}
+	}
+	return info
+}
+
+// A time in Unix nanoseconds, those too far off to tell that way taken as
+// the furthest that can be.
+func nanos(t time.Time) int64 {
+	if t.After(latest) {
+		return math.MaxInt64
+	}
+	return t.UnixNano()
+}
+
+var latest = time.Unix(0, math.MaxInt64)
+
+// NewOnDemand constructs a cache that runs no goroutine per key, for when
+// there are too many keys for that to be affordable. Values aren't refreshed
+// in the background; instead, a read of one that was loaded longer than ttl
+// ago (or negativeTTL, for an error) reloads it, with concurrent readers
+// sharing the one load. A value's own TTL, from ValueWithTTL or an Expirer,
+// takes the place of ttl. Subscribers see values as reads load them.
+//
+// A single sweeper drops entries that have gone unread for ttl, or for the
+// timeout given by WithIdleTimeout (or WithOneShotTimeout, for those read
+// just once), bar those that are pinned;
+// WithKeepUnused stops it. Pinning a key loads it, but it's reloaded, like
+// any other, only as it's read. During a
+// blackout, stale values are served rather than reloaded. Of the other
+// options, those that govern how the refresher is called (WithRefreshTimeout,
+// WithRetries, WithHedge) take effect, as do WithHooks, WithClock,
+// WithStaleIfError and WithStaleWhileRevalidate, and those that bound what's
+// kept (WithMaxEntries, WithKeyLimit and the like); those that govern
+// background refreshes do not.
+func NewOnDemand(ctx context.Context, refresher Refresher, ttl, negativeTTL time.Duration, opts ...Option) Cache {
+	c := &onDemand{
+		cache:       newCache(ctx, refresher, nil, nil, opts...),
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}
+	c.cache.evict = c.evict
+	c.cache.reap = c.reap
+	c.cache.publish(c)
+	c.cache.background()
+	if idle := c.idle(); idle > 0 && !c.cache.keepUnused {
+		c.cache.running.Add(1)
+		go c.sweep(idle)
+	}
+	return c
+}
+
+// NewMemo constructs a cache that memoizes compute: the first read of a key
+// calls it, with concurrent readers sharing the call, and later reads are
+// served what it returned for as long as the key is resident. Errors aren't
+// kept; the next read tries again. It's a cache made by NewOnDemand whose
+// values never go stale and whose entries are never dropped for want of use,
+// so that, running no goroutines of its own, it's bounded only by the likes
+// of WithMaxEntries. A value's own TTL, from ValueWithTTL or an Expirer, is
+// heeded still.
+func NewMemo(ctx context.Context, compute Refresher, opts ...Option) Cache {
+	return NewOnDemand(ctx, compute, math.MaxInt64, 0, append(opts[:len(opts):len(opts)], WithKeepUnused())...)
+}
+
+// How long an entry may go unread.
+func (c *onDemand) idle() time.Duration {
+	if c.cache.idleTimeout > 0 {
+		return c.cache.idleTimeout
+	}
+	return c.ttl
+}
+
+// When a result goes stale.
+func (c *onDemand) expiry(key Key, d *demand, result r, now time.Time) time.Time {
+	if wait, ok := retryAfter(result.Err); ok {
+		return now.Add(wait)
+	}
+	if result.Err != nil {
+		return c.retry(key, d, result.Err, now)
+	}
+	p := c.pacing(key, d)
+	if p != nil {
+		p.positive.Reset()
+		p.negative.Reset()
+		p.failing.Reset()
+	}
+	switch {
+	case result.ttl > 0:
+		return now.Add(result.ttl)
+	case p != nil && c.cache.noRefresh:
+		return now.Add(math.MaxInt64)
+	case p != nil:
+		return c.measure(d, p.positive, now)
+	}
+	return now.Add(c.ttl)
+}
+
+// When an error goes stale, to be tried again. The caller holds d.mu.
+func (c *onDemand) retry(key Key, d *demand, err error, now time.Time) time.Time {
+	p := c.pacing(key, d)
+	if p == nil {
+		return now.Add(c.negativeTTL)
+	}
+	p.failing = c.cache.negativeFor(err, p.negative)
+	return c.measure(d, p.failing, now)
+}
+
+// Locate the entry for a key on behalf of a reader, as entry does; but a
+// reader that's given up already doesn't make one for nobody.
+func (c *onDemand) entryFor(ctx context.Context, key Key) (*demand, error) {
+	if d, ok := c.cache.kv.Load(key); ok {
+		c.cache.use(key)
+		return d.(*demand), nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.entry(key)
+}
+
+// Locate the entry for a key, creating an empty one if there isn't one.
+func (c *onDemand) entry(key Key) (*demand, error) {
+	if d, ok := c.cache.kv.Load(key); ok {
+		c.cache.use(key)
+		return d.(*demand), nil
+	}
+
+	c.cache.closing.RLock()
+	defer c.cache.closing.RUnlock()
+	if c.cache.ctx.Err() != nil {
+		return nil, ErrShutdown
+	}
+	key = c.cache.intern(key)
+	d, loaded := c.cache.kv.LoadOrStore(key, &demand{used: c.cache.clock.Now().UnixNano()})
+	if loaded {
+		c.cache.unintern(key)
+		c.cache.use(key)
+	} else {
+		c.cache.admit(key)
+	}
+	return d.(*demand), nil
+}
+
+// Read the entry for a key, loading it if it's missing or stale, or if
+// that's forced. A loader, if given, replaces the entry's refresher.
+func (c *onDemand) read(ctx context.Context, key Key, loader Refresher, o getOptions) (*demand, r, Info, error) {
+	for {
+		d, err := c.entryFor(ctx, key)
+		if err != nil {
+			return nil, r{}, Info{}, err
+		}
+		now := c.cache.clock.Now()
+		d.mu.Lock()
+		if d.dropped {
+			d.mu.Unlock()
+			continue
+		}
+		if loader != nil {
+			d.extra().refresher = loader
+		}
+		d.used, d.touched = now.UnixNano(), true
+		if d.reads < 2 {
+			d.reads++
+		}
+		if d.heat < math.MaxUint16 {
+			d.heat++
+		}
+		stale := !d.loaded || o.forceRefresh || now.UnixNano() >= d.expires ||
+			(o.maxAge > 0 && d.refreshed != 0 && time.Duration(now.UnixNano()-d.refreshed) > o.maxAge)
+		// During a blackout, stale values are served rather than reloaded; so
+		// are those whose reload the rate limit refuses
+		allowStale := o.allowStale || (!o.forceRefresh && c.cache.blackedOut())
+		throttled := stale && d.loaded && d.load == nil && !o.forceRefresh && !c.cache.blackedOut() && !c.cache.allowed()
+		if !stale || (d.loaded && (allowStale || throttled)) {
+			if o.forceRefresh || (stale && d.load == nil && !c.cache.blackedOut() && !throttled) {
+				c.start(ctx, key, d)
+			}
+			result, info := d.result, d.info()
+			d.mu.Unlock()
+			c.cache.stats.read(true)
+			return d, result, info, nil
+		}
+		l := d.load
+		if l == nil || o.forceRefresh {
+			l = c.start(ctx, key, d)
+		}
+		if max := c.cache.maxWaiters; max > 0 {
+			if l.waiters >= max {
+				d.mu.Unlock()
+				return nil, r{}, Info{}, &OverloadedError{Key: key, Waiters: int(max)}
+			}
+			l.waiters++
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			if c.cache.maxWaiters > 0 {
+				d.mu.Lock()
+				l.waiters--
+				d.mu.Unlock()
+			}
+			return nil, r{}, Info{}, ctx.Err()
+		case <-l.done:
+		}
+		if l.dropped {
+			continue
+		}
+		c.cache.stats.read(false)
+		return d, l.result, l.info, nil
+	}
+}
+
+// Start loading a key for a reader, or for nobody in particular if that's
+// nil, superseding any load already in flight, whose waiters receive the
+// outcome of this one instead. The caller holds d.mu.
+func (c *onDemand) start(reader context.Context, key Key, d *demand) *load {
+	c.cache.closing.RLock()
+	defer c.cache.closing.RUnlock()
+	l, ctx, gen := c.begin(d)
+	if ctx == nil {
+		return l
+	}
+	var refreshed time.Time
+	if d.loaded && d.result.Err == nil {
+		refreshed = time.Unix(0, d.refreshed)
+	}
+	ctx = c.cache.traceFor(ctx, reader, refreshed)
+	refresher, first := d.refresher(c.cache.refresher), !d.loaded
+	heat := d.heat
+	d.heat -= heat / 2
+	c.cache.spawn(ctx, int(heat), func() r {
+		// An entry's first load may find it demoted
+		if first {
+			if promoted, ok := c.cache.promote(key); ok {
+				return promoted
+			}
+		}
+		return c.cache.load(ctx, key, refresher)
+	}, func(outcome r) {
+		c.land(key, d, gen, outcome)
+	})
+	return l
+}
+
+// Begin a load, superseding any that's in flight, and return it with the
+// context and generation to make it in; or, if the cache has shut down,
+// return it failed, with no context. The caller holds d.mu and a read lock
+// on c.cache.closing.
+func (c *onDemand) begin(d *demand) (*load, context.Context, uint32) {
+	l := d.load
+	if l == nil {
+		l = &load{done: make(chan struct{})}
+		d.load = l
+	} else {
+		l.cancel()
+	}
+	d.gen++
+
+	ctx, cancel := context.WithCancel(c.cache.ctx)
+	l.cancel = cancel
+	if ctx.Err() != nil {
+		cancel()
+		d.load = nil
+		l.result, l.info = r{Err: ErrShutdown}, d.info()
+		close(l.done)
+		return l, nil, 0
+	}
+	return l, ctx, d.gen
+}
+
+// Record the outcome of a load, unless it has been superseded.
+func (c *onDemand) land(key Key, d *demand, gen uint32, outcome r) {
+	d.mu.Lock()
+	l := d.load
+	if l == nil || d.gen != gen {
+		d.mu.Unlock()
+		return
+	}
+	now := c.cache.clock.Now()
+	c.cache.debug("loaded value", "key", key, "value", outcome.Value, "error", outcome.Err)
+	l.cancel()
+	d.load = nil
+	d.record(outcome, now)
+	if outcome.Err != nil && c.cache.staleIfError && d.loaded && d.result.Err == nil {
+		// Hang on to the last good value, and try again after the negative TTL
+		d.extra().lastError = outcome.Err
+		d.expires = nanos(c.retry(key, d, outcome.Err, now))
+	} else {
+		d.result, d.loaded, d.expires = outcome, true, nanos(c.expiry(key, d, outcome, now))
+	}
+	c.reschedule(key, d)
+	l.result, l.info = d.result, d.info()
+	close(l.done)
+	d.notify()
+	result := d.result
+	d.mu.Unlock()
+
+	c.cache.weigh(key, result)
+	c.cache.landed(key, outcome)
+}
+
+// Deliver the current value to subscribers. The caller holds d.mu.
+func (d *demand) notify() {
+	if d.extras == nil {
+		return
+	}
+	if d.result.Err == nil {
+		for _, sub := range d.extras.subscribers {
+			select {
+			case sub.in <- d.result.Value:
+			case <-sub.ctx.Done():
+			}
+		}
+	}
+	d.prune()
+}
+
+// Forget subscribers who've gone away. The caller holds d.mu.
+func (d *demand) prune() {
+	if d.extras == nil {
+		return
+	}
+	live := d.extras.subscribers[:0]
+	for _, sub := range d.extras.subscribers {
+		if sub.ctx.Err() == nil {
+			live = append(live, sub)
+		} else {
+			close(sub.in)
+		}
+	}
+	d.extras.subscribers = live
+}
+
+// Remove an entry from the cache, reporting whether it was there to remove.
+// Anyone awaiting its load tries again with its successor. The caller holds
+// d.mu.
+func (c *onDemand) drop(key Key, d *demand) bool {
+	if d.dropped {
+		return false
+	}
+	d.dropped = true
+	// Nothing else replaces an entry, so the key still refers to this one
+	c.cache.forget(key)
+	c.cache.kv.Delete(key)
+	c.cache.unintern(key)
+	if l := d.load; l != nil {
+		l.cancel()
+		l.dropped = true
+		close(l.done)
+		d.load = nil
+	}
+	if d.extras != nil {
+		for _, sub := range d.extras.subscribers {
+			close(sub.in)
+		}
+		d.extras.subscribers = nil
+	}
+	return true
+}
+
+// Drop an entry to make room for others.
+func (c *onDemand) evict(key Key, b *batch) {
+	v, ok := c.cache.kv.Load(key)
+	if !ok {
+		return
+	}
+	d := v.(*demand)
+	d.mu.Lock()
+	result, loaded := d.result, d.loaded
+	value := result.Value
+	dropped := c.drop(key, d)
+	d.mu.Unlock()
+	if dropped {
+		if loaded {
+			c.cache.demote(key, result)
+		}
+		c.cache.stats.evicted()
+		c.cache.hooks.evicted(key, value)
+		c.cache.removed(key, value, ReasonCapacity, b)
+	}
+}
+
+// Periodically drop the entries that have gone unread for the given time.
+func (c *onDemand) sweep(idle time.Duration) {
+	defer c.cache.running.Done()
+	oneShot := c.cache.oneShotTimeout
+	every := idle
+	if oneShot > 0 && oneShot < every {
+		every = oneShot
+	}
+	timer := c.cache.clock.NewTimer(every)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.cache.ctx.Done():
+			return
+		case now := <-timer.C():
+			timer.Reset(every)
+			c.cache.kv.Range(func(k, v interface{}) bool {
+				d := v.(*demand)
+				d.mu.Lock()
+				d.prune()
+				quiet := time.Duration(now.UnixNano() - d.used)
+				unused := (quiet >= idle || (oneShot > 0 && d.reads <= 1 && quiet >= oneShot)) &&
+					!d.subscribed() && d.load == nil && !d.dropped && !c.cache.isPinned(k)
+				value := d.result.Value
+				if unused {
+					c.cache.debug("unused value, dropping", "key", k)
+					c.drop(k, d)
+				}
+				d.mu.Unlock()
+				if unused {
+					c.cache.stats.evicted()
+					c.cache.hooks.evicted(k, value)
+					c.cache.hooks.removed(k, value, ReasonUnused)
+				}
+				return true
+			})
+		}
+	}
+}
+
+func (c *onDemand) Get(ctx context.Context, key Key, opts ...GetOption) (Value, error) {
+	key = c.cache.canonical(key)
+	o := getOptions{allowStale: c.cache.staleWhileRevalidate}
+	if len(opts) > 0 {
+		o = o.with(opts)
+	}
+	if refuse, err := c.cache.refuse(key); err != nil {
+		return nil, err
+	} else if refuse {
+		return c.cache.loadOnce(ctx, key, c.cache.refresher)
+	}
+	_, result, _, err := c.read(ctx, key, nil, o)
+	if err != nil {
+		return nil, err
+	}
+	return result.Value, result.Err
+}
+
+func (c *onDemand) GetIfPresent(key Key) (Value, bool) {
+	key = c.cache.canonical(key)
+	v, ok := c.cache.kv.Load(key)
+	if !ok {
+		c.cache.stats.read(false)
+		return nil, false
+	}
+	d := v.(*demand)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.loaded || d.result.Err != nil {
+		c.cache.stats.read(false)
+		return nil, false
+	}
+	d.used, d.touched = c.cache.clock.Now().UnixNano(), true
+	c.cache.stats.read(true)
+	return d.result.Value, true
+}
+
+func (c *onDemand) GetOrLoad(ctx context.Context, key Key, loader Refresher) (Value, error) {
+	key = c.cache.canonical(key)
+	if refuse, err := c.cache.refuse(key); err != nil {
+		return nil, err
+	} else if refuse {
+		return c.cache.loadOnce(ctx, key, loader)
+	}
+	_, result, _, err := c.read(ctx, key, loader, getOptions{allowStale: c.cache.staleWhileRevalidate})
+	if err != nil {
+		return nil, err
+	}
+	return result.Value, result.Err
+}
+
+func (c *onDemand) GetWithInfo(ctx context.Context, key Key) (Value, Info, error) {
+	key = c.cache.canonical(key)
+	_, result, info, err := c.read(ctx, key, nil, getOptions{allowStale: c.cache.staleWhileRevalidate})
+	if err != nil {
+		return nil, Info{}, err
+	}
+	if !info.Refreshed.IsZero() {
+		info.Age = c.cache.since(info.Refreshed)
+	}
+	return result.Value, info, result.Err
+}
+
+func (c *onDemand) Set(ctx context.Context, key Key, value Value) error {
+	return c.SetWithError(ctx, key, value, nil)
+}
+
+func (c *onDemand) SetWithError(ctx context.Context, key Key, value Value, err error) error {
+	key = c.cache.canonical(key)
+	set := c.cache.result(value, err)
+	for {
+		d, err := c.entry(key)
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		if d.dropped {
+			d.mu.Unlock()
+			continue
+		}
+		now := c.cache.clock.Now()
+		d.record(set, now)
+		d.result, d.loaded, d.expires = set, true, nanos(c.expiry(key, d, set, now))
+		c.reschedule(key, d)
+		if l := d.load; l != nil {
+			// An externally-supplied value supersedes any load in flight
+			l.cancel()
+			d.load = nil
+			l.result, l.info = d.result, d.info()
+			close(l.done)
+		}
+		d.notify()
+		d.mu.Unlock()
+		c.cache.weigh(key, set)
+		return nil
+	}
+}
+
+func (c *onDemand) Update(ctx context.Context, key Key, fn func(old Value) (Value, error)) (Value, error) {
+	key = c.cache.canonical(key)
+	for {
+		d, _, _, err := c.read(ctx, key, nil, getOptions{allowStale: true})
+		if err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		if d.dropped {
+			d.mu.Unlock()
+			continue
+		}
+		if d.result.Err != nil {
+			result := d.result
+			d.mu.Unlock()
+			return result.Value, result.Err
+		}
+		value, err := fn(d.result.Value)
+		if err != nil {
+			d.mu.Unlock()
+			return nil, err
+		}
+		stowed := c.cache.stow(r{Value: value, ttl: d.result.ttl})
+		if stowed.Err != nil {
+			d.mu.Unlock()
+			return nil, stowed.Err
+		}
+		d.result = stowed
+		d.notify()
+		d.mu.Unlock()
+		c.cache.weigh(key, stowed)
+		return stowed.Value, nil
+	}
+}
+
+func (c *onDemand) Subscribe(ctx context.Context, key Key) (<-chan Value, error) {
+	key = c.cache.canonical(key)
+	sub := subscriber{ctx: ctx, in: make(chan Value)}
+	out := make(chan Value)
+	go relay(ctx, sub.in, out)
+	for {
+		d, err := c.entry(key)
+		if err != nil {
+			close(sub.in)
+			return nil, err
+		}
+		d.mu.Lock()
+		if d.dropped {
+			d.mu.Unlock()
+			continue
+		}
+		d.extra().subscribers = append(d.extra().subscribers, sub)
+		if d.loaded && d.result.Err == nil {
+			select {
+			case sub.in <- d.result.Value:
+			case <-ctx.Done():
+			}
+		} else if d.load == nil {
+			c.start(ctx, key, d)
+		}
+		d.mu.Unlock()
+		return out, nil
+	}
+}
+
+func (c *onDemand) Warm(ctx context.Context, keys ...Key) error {
+	return warm(ctx, c, keys)
+}
+
+func (c *onDemand) Invalidate(ctx context.Context, key Key) error {
+	key = c.cache.canonical(key)
+	c.cache.discard(key)
+	if v, ok := c.cache.kv.Load(key); ok {
+		d := v.(*demand)
+		d.mu.Lock()
+		value := d.result.Value
+		dropped := c.drop(key, d)
+		d.mu.Unlock()
+		if dropped {
+			c.cache.hooks.removed(key, value, ReasonInvalidated)
+		}
+	}
+	return nil
+}
+
+func (c *onDemand) Pin(ctx context.Context, key Key) error {
+	key = c.cache.canonical(key)
+	c.cache.pinned.Store(key, struct{}{})
+	for {
+		d, err := c.entry(key)
+		if err != nil {
+			c.cache.pinned.Delete(key)
+			return err
+		}
+		d.mu.Lock()
+		if !d.dropped && !d.loaded && d.load == nil {
+			c.start(ctx, key, d)
+		}
+		dropped := d.dropped
+		d.mu.Unlock()
+		if !dropped {
+			// It no longer counts towards the cache's bounds
+			c.cache.forget(key)
+			return nil
+		}
+	}
+}
+
+func (c *onDemand) Unpin(key Key) {
+	c.cache.Unpin(key)
+}
+
+func (c *onDemand) Refresh(ctx context.Context, key Key) error {
+	key = c.cache.canonical(key)
+	for {
+		d, err := c.entry(key)
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		if !d.dropped {
+			c.start(ctx, key, d)
+		}
+		dropped := d.dropped
+		d.mu.Unlock()
+		if !dropped {
+			return nil
+		}
+	}
+}
+
+func (c *onDemand) RefreshAndGet(ctx context.Context, key Key) (Value, error) {
+	return c.Get(ctx, key, ForceRefresh())
+}
+
+func (c *onDemand) Purge() {
+	c.purge(c.cache.ctx)
+}
+
+// Drop every key, reporting their removals in a batch with the context given.
+func (c *onDemand) purge(ctx context.Context) {
+	reason := ReasonInvalidated
+	if c.cache.ctx.Err() != nil {
+		reason = ReasonShutdown
+	}
+	b := c.cache.newBatch()
+	c.cache.kv.Range(func(k, v interface{}) bool {
+		d := v.(*demand)
+		d.mu.Lock()
+		value := d.result.Value
+		dropped := c.drop(k, d)
+		d.mu.Unlock()
+		if dropped {
+			c.cache.removed(k, value, reason, b)
+		}
+		return true
+	})
+	c.cache.deliver(ctx, b)
+}
+
+func (c *onDemand) Keys() []Key {
+	return c.cache.Keys()
+}
+
+func (c *onDemand) Len() int {
+	return c.cache.Len()
+}
+
+func (c *onDemand) Range(f func(key Key, value Value, err error) bool) {
+	type kr struct {
+		key Key
+		r
+	}
+	var entries []kr
+	c.cache.kv.Range(func(k, v interface{}) bool {
+		d := v.(*demand)
+		d.mu.Lock()
+		if d.loaded {
+			entries = append(entries, kr{key: k, r: d.result})
+		}
+		d.mu.Unlock()
+		return true
+	})
+	for _, e := range entries {
+		if !f(e.key, e.Value, e.Err) {
+			return
+		}
+	}
+}
+
+func (c *onDemand) Snapshot() map[Key]Value {
+	return snapshot(c)
+}
+
+func (c *onDemand) SetMaxEntries(n int) error {
+	return c.cache.SetMaxEntries(n)
+}
+
+func (c *onDemand) SetMaxWeight(budget int64) error {
+	return c.cache.SetMaxWeight(budget)
+}
+
+func (c *onDemand) SizeOf(key Key) (int64, bool) {
+	key = c.cache.canonical(key)
+	v, ok := c.cache.kv.Load(key)
+	if !ok {
+		return 0, false
+	}
+	d := v.(*demand)
+	d.mu.Lock()
+	loaded, result := d.loaded, d.result
+	d.mu.Unlock()
+	if !loaded || result.Err != nil {
+		return 0, false
+	}
+	return c.cache.size(key, result.Value), true
+}
+
+func (c *onDemand) Sizes() (map[Key]int64, int64) {
+	return sizes(c, c.cache.size)
+}
+
+func (c *onDemand) Stats() Stats {
+	return c.cache.Stats()
+}
+
+func (c *onDemand) Close(ctx context.Context) error {
+	// Closing the underlying cache stops the sweeper and cancels loads; the
+	// entries themselves are left to clear away
+	err := c.cache.Close(ctx)
+	c.purge(ctx)
+	return err
+}
@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnDemand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var loads int32
+	clock := newFakeClock()
+	c := NewOnDemand(ctx, func(ctx context.Context, key Key) (Value, error) {
+		<-clock.After(period / 2)
+		return int(atomic.AddInt32(&loads, 1)), nil
+	}, period, period, WithIdleTimeout(5*period/2), WithClock(clock))
+
+	// Concurrent readers share a load
+	clock.During(func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v, e := c.Get(context.Background(), "foo")
+				assert.Nil(t, e)
+				assert.Equal(t, 1, v)
+			}()
+		}
+		wg.Wait()
+	})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+
+	// Nothing happens in the background
+	clock.Sleep(3 * period / 2)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+
+	// A stale value is reloaded as it's read
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+
+	// Unless the reader will put up with it
+	clock.Sleep(3 * period / 2)
+	v, e = c.Get(context.Background(), "foo", AllowStale())
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+	clock.Sleep(period)
+	v, _ = getOn(clock, c, "foo")
+	assert.Equal(t, 3, v)
+
+	// Unused entries are swept away
+	clock.Sleep(11 * period / 2)
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, period, period/100)
+
+	assert.Nil(t, c.Close(context.Background()))
+	_, e = c.Get(context.Background(), "foo")
+	assert.ErrorIs(t, e, ErrShutdown)
+	cancel()
+}
+
+func TestOnDemandSetAndErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var failing int32
+	clock := newFakeClock()
+	c := NewOnDemand(ctx, func(ctx context.Context, key Key) (Value, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, errors.New("an error")
+		}
+		return "loaded", nil
+	}, period, period, WithStaleIfError(), WithKeepUnused(), WithClock(clock))
+
+	assert.Nil(t, c.Set(context.Background(), "foo", "set"))
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, "set", v)
+
+	// The last good value outlives a failed reload
+	atomic.StoreInt32(&failing, 1)
+	v, info, e := c.GetWithInfo(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, "set", v)
+	assert.Equal(t, 0, info.Errors)
+	clock.Sleep(3 * period / 2)
+	v, info, e = c.GetWithInfo(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, "set", v)
+	assert.Equal(t, 1, info.Errors)
+	assert.EqualError(t, info.LastError, "an error")
+
+	// A key without one reports the failure
+	_, e = c.Get(context.Background(), "bar")
+	assert.Equal(t, "an error", e.Error())
+
+	atomic.StoreInt32(&failing, 0)
+	v, e = c.RefreshAndGet(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, "loaded", v)
+
+	cancel()
+}
+
+func TestDemandSize(t *testing.T) {
+	// There may be millions of entries, so they're kept small
+	assert.LessOrEqual(t, int(unsafe.Sizeof(demand{})), 104)
+}
+
+func TestMemo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var computes int32
+	clock := newFakeClock()
+	c := NewMemo(ctx, func(ctx context.Context, key Key) (Value, error) {
+		atomic.AddInt32(&computes, 1)
+		if key == "bad" {
+			return nil, errors.New("an error")
+		}
+		return key, nil
+	}, WithMaxEntries(2), WithClock(clock))
+
+	// Values are computed once, and kept however long they go unread
+	for i := 0; i < 3; i++ {
+		v, e := c.Get(context.Background(), "foo")
+		assert.Nil(t, e)
+		assert.Equal(t, "foo", v)
+		clock.Sleep(period)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&computes))
+
+	// Errors aren't
+	for i := 0; i < 2; i++ {
+		_, e := c.Get(context.Background(), "bad")
+		assert.NotNil(t, e)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&computes))
+
+	// Only room has to be made
+	for _, key := range []string{"bar", "baz", "foo"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+	}
+	assert.Equal(t, int32(6), atomic.LoadInt32(&computes))
+	assert.Equal(t, 2, c.Len())
+
+	cancel()
+}
+
+func BenchmarkOnDemandGet(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewOnDemand(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return 1, nil
+	}, time.Hour, time.Hour)
+	var key Key = "foo"
+	_, e := c.Get(ctx, key)
+	assert.Nil(b, e)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Get(ctx, key)
+		}
+	})
+}
+
+// A Tracer that notes the loads it's told of, and their outcomes
+type recordingTracer struct {
+	mu       sync.Mutex
+	loads    []Load
+	outcomes []error
+}
+
+type readerKey struct{}
+
+func (t *recordingTracer) StartLoad(ctx context.Context, load Load) (context.Context, func(Value, error)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.loads = append(t.loads, load)
+	return ctx, func(_ Value, err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.outcomes = append(t.outcomes, err)
+	}
+}
+
+func TestOnDemandTracer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := newFakeClock()
+	tracer, another := &recordingTracer{}, &recordingTracer{}
+	c := NewOnDemand(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, time.Minute, time.Minute, WithClock(clock), WithTracer(tracer), WithTracer(another))
+
+	// Each load is traced for the reader it's made for
+	reader := context.WithValue(context.Background(), readerKey{}, "me")
+	_, e := c.Get(reader, "foo")
+	assert.Nil(t, e)
+	clock.Advance(2 * time.Minute)
+	_, e = c.Get(reader, "foo")
+	assert.Nil(t, e)
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	assert.Len(t, tracer.loads, 2)
+	assert.Equal(t, "me", tracer.loads[0].Reader.Value(readerKey{}))
+	assert.Equal(t, Key("foo"), tracer.loads[0].Key)
+	assert.False(t, tracer.loads[0].Stale)
+	assert.True(t, tracer.loads[1].Stale)
+	assert.Equal(t, 2*time.Minute, tracer.loads[1].Age)
+	assert.Equal(t, []error{nil, nil}, tracer.outcomes)
+
+	// Tracers given together each follow every load
+	another.mu.Lock()
+	defer another.mu.Unlock()
+	assert.Equal(t, tracer.loads, another.loads)
+	assert.Equal(t, tracer.outcomes, another.outcomes)
+}
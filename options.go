@@ -0,0 +1,689 @@
+package cache
+
+import (
+	"time"
+)
+
+// An Option configures a cache at construction.
+type Option func(*cache)
+
+// WithHooks registers callbacks for events in the lives of entries.
+func WithHooks(hooks Hooks) Option {
+	return func(c *cache) {
+		c.hooks = hooks
+	}
+}
+
+// WithLogger has the cache log to logger. By default, it logs nothing.
+func WithLogger(logger Logger) Option {
+	return func(c *cache) {
+		c.logger = logger
+	}
+}
+
+// WithClock has the cache tell the time by the given clock, rather than the
+// system's. The backoffs made by Every, FromSchedule and Cron follow it too;
+// other Backoffs keep to their own timing.
+func WithClock(clock Clock) Option {
+	return func(c *cache) {
+		c.clock = clock
+	}
+}
+
+// WithBackoffs chooses the backoffs for each key as its maintainer starts,
+// in place of those the cache was constructed with. Either may be returned
+// as nil, to use the cache's own.
+func WithBackoffs(backoffs func(key Key) (positive, negative func() Backoff)) Option {
+	return func(c *cache) {
+		c.backoffs = backoffs
+	}
+}
+
+// WithErrorBackoffs chooses the negative backoff to follow a failed load by
+// the error it failed with, so that (say) a missing key can be retried less
+// often than one that timed out. The error is a *RefreshError, so it should
+// be examined with errors.Is or errors.As. Returning nil uses the key's usual
+// negative backoff.
+func WithErrorBackoffs(backoffs func(err error) func() Backoff) Option {
+	return func(c *cache) {
+		c.errorBackoffs = backoffs
+	}
+}
+
+// WithRefreshTimeout bounds how long each call to the refresher may take.
+// Its context is given the timeout as a deadline; if it hasn't returned by
+// then, it's left to finish in the background, and the load fails with
+// ErrTimeout.
+func WithRefreshTimeout(timeout time.Duration) Option {
+	return func(c *cache) {
+		c.refreshTimeout = timeout
+	}
+}
+
+// WithHedge has each refresh call the refresher a second time if the first
+// call hasn't returned after the given delay. Whichever call returns first
+// provides the outcome, and the other is cancelled. This trims the tail of
+// refresh latency when a few slow calls are to blame for it, at the cost of
+// some extra calls.
+func WithHedge(delay time.Duration) Option {
+	return func(c *cache) {
+		c.hedge = delay
+	}
+}
+
+// WithRetries has each refresh retry a failing refresher up to the given
+// number of times, waiting between attempts as the backoff says, before the
+// failure is published and the negative backoff takes over. A nil backoff
+// retries straight away. With WithRefreshTimeout, each attempt is timed
+// separately. A RetryAfterError isn't retried.
+func WithRetries(retries int, backoff func() Backoff) Option {
+	return func(c *cache) {
+		c.retries = retries
+		c.retryBackoff = backoff
+	}
+}
+
+// WithStaleIfError has the cache continue to serve the last successfully
+// loaded value for a key when a refresh fails, rather than the error. The
+// failure is reported by GetWithInfo, and retried after the negative backoff.
+func WithStaleIfError() Option {
+	return func(c *cache) {
+		c.staleIfError = true
+	}
+}
+
+// WithStaleWhileRevalidate has every Get behave as if AllowStale were
+// given, so that only a cold load ever waits for the refresher. (Reads of a
+// loaded value never wait for a scheduled refresh in any case.)
+func WithStaleWhileRevalidate() Option {
+	return func(c *cache) {
+		c.staleWhileRevalidate = true
+	}
+}
+
+// WithHardTTL sets how long a value may be served for without being
+// refreshed. The positive backoff acts as a soft TTL: beyond it, the value is
+// served while it's refreshed. Beyond the hard TTL, the value is withdrawn;
+// readers wait for the outcome of a refresh instead.
+func WithHardTTL(ttl time.Duration) Option {
+	return func(c *cache) {
+		c.hardTTL = ttl
+	}
+}
+
+// WithMaxAge puts a hard limit on the age of the values the cache serves.
+// Once a value has gone unrefreshed for the given duration (typically because
+// refreshes keep failing, while WithStaleIfError is in effect), reads of its
+// key fail with ErrStale until a refresh succeeds. Unlike WithHardTTL, readers
+// are not kept waiting for that refresh.
+func WithMaxAge(age time.Duration) Option {
+	return func(c *cache) {
+		c.maxAge = age
+	}
+}
+
+// WithExpireAfterWrite limits how long any entry lives. Once the given
+// duration has passed since the entry was created, it's removed, however
+// often it's been used and whether or not its refreshes have succeeded;
+// the next Get loads the key afresh.
+func WithExpireAfterWrite(lifetime time.Duration) Option {
+	return func(c *cache) {
+		c.expireAfterWrite = lifetime
+	}
+}
+
+// WithIdleTimeout has the cache drop an entry once it has gone unused for
+// the given duration. Until then, it's refreshed whether or not it has been
+// used in the meantime. Without an idle timeout, an entry is dropped if it
+// goes unused between two scheduled refreshes.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(c *cache) {
+		c.idleTimeout = timeout
+	}
+}
+
+// WithMaxWaiters limits how many readers may wait on a key's load at once.
+// Those beyond the limit are turned away straight away with an
+// OverloadedError, rather than piling up behind a refresher that's stuck.
+// Readers served a value already loaded don't count.
+func WithMaxWaiters(n int) Option {
+	return func(c *cache) {
+		c.maxWaiters = int32(n)
+	}
+}
+
+// WithOneShotTimeout drops entries that have been read no more than once
+// after they've gone unused for the given duration, which is presumably
+// shorter than would otherwise apply. This suits caches where many keys are
+// read just the once: they make way promptly, while those read repeatedly
+// are kept as usual.
+func WithOneShotTimeout(timeout time.Duration) Option {
+	return func(c *cache) {
+		c.oneShotTimeout = timeout
+	}
+}
+
+// WithJitter spreads out refreshes by delaying each one that's scheduled by
+// the positive backoff by a further random amount, up to the given maximum.
+// This stops entries that were loaded together from refreshing in lockstep.
+// Refreshes scheduled by a value's own TTL are not delayed.
+func WithJitter(max time.Duration) Option {
+	return func(c *cache) {
+		c.jitter = max
+	}
+}
+
+// WithEarlyRefresh lets reads of an entry trigger its refresh a little
+// before it's due, using the "XFetch" algorithm for probabilistic early
+// expiration. The likelihood of an early refresh grows as the due time
+// approaches, and in proportion to how long the previous refresh took; beta
+// scales this, with 1 being the usual choice. Hot keys thus refresh ahead of
+// time, rather than in a burst when their timers fire.
+//
+// A refresh is due when the value's TTL runs out or, failing that, after the
+// interval last observed from the positive backoff.
+func WithEarlyRefresh(beta float64) Option {
+	return func(c *cache) {
+		c.earlyRefresh = beta
+	}
+}
+
+// WithExpireAfterAccess switches the cache to sliding expiration: a value,
+// once loaded, is never refreshed, and the entry is dropped when it has gone
+// unaccessed for the given duration. Each read extends its lifetime. Failed
+// loads are still retried according to the negative backoff.
+func WithExpireAfterAccess(timeout time.Duration) Option {
+	return func(c *cache) {
+		c.idleTimeout = timeout
+		c.noRefresh = true
+	}
+}
+
+// WithRefreshAhead keeps designated entries warm across quiet periods: they
+// carry on being refreshed for up to the given number of refresh cycles in
+// which they're not used, rather than being dropped after the first. Keys are
+// designated by the given predicate; if that's nil, this applies to all keys.
+func WithRefreshAhead(cycles int, keys func(key Key) bool) Option {
+	return func(c *cache) {
+		c.refreshAhead = cycles
+		c.refreshAheadKeys = keys
+	}
+}
+
+// WithAdaptiveRefresh has each entry's refresh interval follow how often its
+// value changes, in place of the positive backoff. Each time a refresh gives
+// back a value that equal reports is unchanged, the interval doubles; each
+// time the value has changed, it halves. It starts at min and is kept
+// between min and max.
+func WithAdaptiveRefresh(equal func(old, new Value) bool, min, max time.Duration) Option {
+	return func(c *cache) {
+		c.unchanged = equal
+		c.adaptiveMin, c.adaptiveMax = min, max
+	}
+}
+
+// WithKeepUnused keeps entries resident, and refreshing, even when they go
+// unused. They're only removed by Invalidate, Purge, WithMaxErrors or
+// WithIdleTimeout. This suits keys that are read rarely but are expensive to
+// load from cold.
+func WithKeepUnused() Option {
+	return func(c *cache) {
+		c.keepUnused = true
+	}
+}
+
+// WithParking has the maintainer of an entry that goes unused park, rather
+// than go on refreshing it (as WithKeepUnused would have it) or drop it.
+// A parked entry stays resident, but its value is withdrawn and its timers
+// released; the next read, or Update or Subscribe, has it loaded afresh,
+// waiting for that unless stale values are allowed, as WithStaleWhileRevalidate
+// allows them. This saves the work of refreshing keys nobody reads, while
+// keeping their entries to hand. WithIdleTimeout, WithExpireAfterWrite and
+// eviction for room still drop them.
+func WithParking() Option {
+	return func(c *cache) {
+		c.parking = true
+	}
+}
+
+// WithMaxErrors has the cache give up on a key after the given number of
+// consecutive failed loads. The failure is served until the next refresh
+// would be due; then the key is dropped, and a subsequent Get loads it afresh.
+func WithMaxErrors(n int) Option {
+	return func(c *cache) {
+		c.maxErrors = n
+	}
+}
+
+// WithMaxEntries bounds the number of entries the cache holds. When a new key
+// would take it over the limit, the least recently used entry (or whichever
+// the policy given by WithEvictionPolicy chooses) is dropped, and counted as
+// an eviction, to make room. SetMaxEntries changes the bound later.
+func WithMaxEntries(n int) Option {
+	return func(c *cache) {
+		c.maxEntries = n
+	}
+}
+
+// WithMaxWeight bounds the total weight of the entries the cache holds, as
+// the weigher reckons it, so that large values count for more than small
+// ones. Each value is weighed as it's loaded, set or updated; when that
+// takes the total over budget, other entries are evicted, as chosen by the
+// eviction policy, until it's back within it. This may be combined with
+// WithMaxEntries. SetMaxWeight changes the budget later.
+func WithMaxWeight(budget int64, weigher Weigher) Option {
+	return func(c *cache) {
+		c.maxWeight = budget
+		c.weigher = weigher
+	}
+}
+
+// WithMaxMemory bounds the memory taken up by the cache's entries to about
+// the given number of bytes, as reckoned by EstimateSize. Values that know
+// their own size better can say so by implementing Sizer.
+func WithMaxMemory(bytes int64) Option {
+	return WithMaxWeight(bytes, EstimateSize)
+}
+
+// WithEvictionPolicy chooses how a cache bounded by WithMaxEntries,
+// WithMaxWeight or WithMaxMemory decides which entries to evict. The cache
+// makes itself a Policy with the given function, such as LFU, ARC or S3FIFO.
+func WithEvictionPolicy(policy func() Policy) Option {
+	return func(c *cache) {
+		c.policy = policy
+	}
+}
+
+// WithMaxMaintainers limits how many keys may have a maintainer at once.
+// Beyond that, reads of keys that have none load them on the spot, without
+// keeping them; concurrent reads of one such key share a load. This stops a
+// burst of reads across many distinct keys from starting a goroutine for
+// each. The limit is approximate: maintainers started at the same moment
+// may overshoot it, as may those started by Set and the like.
+func WithMaxMaintainers(n int) Option {
+	return func(c *cache) {
+		c.maxMaintainers = int32(n)
+	}
+}
+
+// WithRefreshWorkers runs loads and refreshes on a pool of n workers,
+// rather than each in a goroutine of its own, so that no more than n calls
+// to the refresher are made at once. When many entries fall due together,
+// the rest wait their turn, as do the readers waiting on them; those of the
+// keys read most often of late go first, so popular keys are the least
+// likely to go stale. A load that's abandoned while it waits, because the
+// cache is closed or the key invalidated, is never made.
+func WithRefreshWorkers(n int) Option {
+	return func(c *cache) {
+		c.refreshWorkers = n
+	}
+}
+
+// WithAdaptiveRefreshWorkers runs loads and refreshes on a pool of up to
+// max workers, as WithRefreshWorkers does, but adapts how many of them may
+// run at once to how the refresher fares, as TCP does its congestion
+// window. The limit starts at max. A load that fails, or that takes longer
+// than latency (unless that's zero), halves it, backing off an upstream
+// that's struggling; once as many loads as it allows have succeeded in
+// time, it's raised by one, back towards max.
+func WithAdaptiveRefreshWorkers(max int, latency time.Duration) Option {
+	return func(c *cache) {
+		c.refreshWorkers = max
+		c.adaptiveWorkers = true
+		c.workerLatency = latency
+	}
+}
+
+// WithBulkRefresher has a cache made by NewScheduled refresh the entries
+// that fall due together with one call to bulk, rather than a call to the
+// refresher for each, turning many round trips upstream into one. Each call
+// is given up to max keys (or any number, if that's zero), and each worker
+// makes one call at a time. Loads on demand still go through the
+// refresher, as do Refresh and the like. Retries and hedging don't apply to
+// bulk calls, though a refresh timeout is given them as a deadline. Other
+// caches ignore it.
+func WithBulkRefresher(bulk BulkRefresher, max int) Option {
+	return func(c *cache) {
+		c.bulk = bulk
+		c.bulkMax = max
+	}
+}
+
+// WithStandbyRefreshers keeps n goroutines standing by to run loads and
+// refreshes, rather than starting one afresh for each, so that a refresh
+// that falls due starts as promptly as it can. When they're all busy, loads
+// run in goroutines of their own as usual. Caches whose loads are run by
+// WithRefreshWorkers have no need of them.
+func WithStandbyRefreshers(n int) Option {
+	return func(c *cache) {
+		c.standby = n
+	}
+}
+
+// WithTracer has tracer follow each load the cache makes: those made for
+// readers, which are told which reader each is for, and those made in the
+// background. The calls to a BulkRefresher aren't traced. Given more than
+// once, each tracer follows the loads in turn, the first outermost.
+func WithTracer(tracer Tracer) Option {
+	return func(c *cache) {
+		if c.tracer != nil {
+			tracer = tracers{c.tracer, tracer}
+		}
+		c.tracer = tracer
+	}
+}
+
+// WithExpvar publishes the cache's Stats with expvar, as cache.name, so
+// that they show up on /debug/vars, until the cache is closed. With them is
+// the last error loading a key of each pattern, as pattern reckons it; with
+// a nil pattern, there's just the one, the last of all. Patterns should be
+// few: "user" or "order" for keys such as "user:42", say. As with
+// expvar.Publish, New panics if another cache open at the time has the name.
+func WithExpvar(name string, pattern func(Key) string) Option {
+	return func(c *cache) {
+		c.export = &exported{name: name, pattern: pattern}
+	}
+}
+
+// WithCanonicalKey keeps each key's entry under the key that canonical maps
+// it to, so that keys that are aliases of one another, such as "user:42"
+// and "USER:42", or URLs that differ only in how they're written, share an
+// entry, and one call to the refresher loads it for them all. The refresher,
+// hooks, Keys and the like see the canonical key. canonical is called on
+// every read, so should be cheap, and should map a canonical key to itself.
+func WithCanonicalKey(canonical func(Key) Key) Option {
+	return func(c *cache) {
+		c.canon = canonical
+	}
+}
+
+// WithExpiryHeap has New keep its entries as NewScheduled does, in a heap
+// ordered by when each is next refreshed, with workers goroutines to refresh
+// them as they fall due, rather than running a maintainer and a timer for
+// each key. It's for caches of millions of keys, whose goroutines' stacks
+// would otherwise take gigabytes between them. Refreshes are paced by the
+// positive and negative Backoffs, and WithErrorBackoffs and WithBackoffs,
+// as usual. Those made by Every, FromSchedule, Cron and the delay package
+// say in advance how long they'd wait; for any other, the heap looks in on
+// the entry from time to time until its delay is over, first when the last
+// one was. Otherwise, options take effect as they do for NewScheduled:
+// those to do with maintainers, such as WithJitter, WithAdaptiveRefresh and
+// WithEarlyRefresh, do not.
+func WithExpiryHeap(workers int) Option {
+	return func(c *cache) {
+		c.expiryHeap = workers
+	}
+}
+
+// WithPriority ranks entries for eviction, so that when a bounded cache
+// needs room it evicts from those of the lowest priority first, and only
+// then considers the rest; amongst those of equal priority, the eviction
+// policy chooses as usual. The priority function is called on each value
+// as it's loaded, set or updated, and may be PriorityOf for values that
+// rank themselves. Entries start, and errors stay, at priority zero.
+func WithPriority(priority func(key Key, value Value) int) Option {
+	return func(c *cache) {
+		c.priority = priority
+	}
+}
+
+// WithKeyLimit guards against keys without number, as when they come from
+// user input. It counts the distinct keys read that weren't already
+// resident, over successive windows of the given length; once there have
+// been limit of them in a window, reads of any others are refused with a
+// KeyLimitError if reject is set, or otherwise are loaded without being
+// kept. Hooks.OnTooManyKeys hears of the first such read in each window.
+func WithKeyLimit(limit int, window time.Duration, reject bool) Option {
+	return func(c *cache) {
+		c.cardinality = &cardinality{
+			limit:  limit,
+			window: window,
+			reject: reject,
+			seen:   map[Key]struct{}{},
+		}
+	}
+}
+
+// WithLazyMaintainers keeps a key, starting a maintainer for it, only once
+// it's read a second time within the given window, which is best made the
+// refresh interval or so. The first read loads it without keeping it, as
+// reads beyond WithMaxMaintainers do. This saves a goroutine and timers
+// for each of the keys that are read just once. Keys that are set, pinned
+// and so on are kept straight away, as usual.
+func WithLazyMaintainers(window time.Duration) Option {
+	return func(c *cache) {
+		c.lazy = &lazy{window: window}
+	}
+}
+
+// WithInterner has the cache keep the single copy of each string key that
+// the Interner holds, in its store and in the structures that track its
+// entries, rather than the copy it was first given, which may be part of
+// something larger. Caches that share an Interner share their copies, which
+// is worthwhile when they hold many of the same long keys.
+func WithInterner(in *Interner) Option {
+	return func(c *cache) {
+		c.interner = in
+	}
+}
+
+// WithShards divides the cache's entries between n shards (rounded up to
+// a power of two), by the hash of their keys, so that adding and removing
+// entries for different keys contends less. It's worth it when many keys
+// come and go at once; the cost is hashing each key as it's looked up. The
+// locks on other state kept by key, such as the uses of keys bound for the
+// eviction policy, are striped likewise. Stats.Contention and
+// Stats.EvictionContention count the waits for them, to show whether more
+// shards would help.
+func WithShards(n int) Option {
+	return func(c *cache) {
+		c.shards = n
+	}
+}
+
+// WithSnapshotMap keeps the cache's entries in copy-on-write maps, which
+// are read without locking or waiting at all. Each key that's added or
+// removed costs a copy of the map that holds it instead, so it suits caches
+// whose keys are read far more often than they come and go; refreshes don't
+// count, as they change an entry, not the map. WithShards divides the keys
+// between several maps, so that each copy is the smaller.
+func WithSnapshotMap() Option {
+	return func(c *cache) {
+		c.snapshotMap = true
+	}
+}
+
+// WithTimerResolution times the deadlines of each entry, such as when it's
+// next refreshed or when its value expires, to the given resolution rather
+// than exactly, rounding them up. Deadlines that fall in the same interval
+// share a timer, so a cache of many keys runs a handful of timers rather
+// than one or more for each key.
+func WithTimerResolution(resolution time.Duration) Option {
+	return func(c *cache) {
+		c.timerResolution = resolution
+	}
+}
+
+// WithScheduler has a cache made by New refresh each key when the given
+// Scheduler says, rather than when the key's own timer fires, so that a
+// timer wheel, a calendar or something outside the process can take their
+// place. Only refreshes are scheduled so; expiry and the like are still
+// timed for each key. A Backoff that keeps its own time, rather than being
+// made here or by the delay package, bypasses it. Other caches ignore it.
+func WithScheduler(scheduler Scheduler) Option {
+	return func(c *cache) {
+		c.scheduler = scheduler
+	}
+}
+
+// WithOffHeap keeps each value the cache loads or is given encoded by the
+// codec, in memory that's mapped for it apart from the heap, so that many
+// large values don't weigh on the garbage collector. Readers are handed a
+// *Blob in place of the value, which they decode on demand with its Decode
+// method, or look at the bytes of with View; Update is handed one too, and
+// what it returns is encoded in turn. A value that can't be encoded is
+// recorded as the error, or returned as the error of Update. The memory is
+// released once nothing refers to the Blob. Where memory can't be mapped,
+// the bytes are kept on the heap.
+func WithOffHeap(codec Codec) Option {
+	return func(c *cache) {
+		c.codec = codec
+	}
+}
+
+// WithColdStore demotes entries that are evicted to make room to the given
+// Store, such as a DiskStore, rather than discarding them. A read of a key
+// that's been demoted promotes it back, rather than calling the refresher;
+// thereafter it's refreshed as usual. Invalidate removes a key from the
+// store as well.
+func WithColdStore(store Store) Option {
+	return func(c *cache) {
+		c.coldStore = store
+	}
+}
+
+// WithSweeper runs a sweeper every interval that reaps entries whose values
+// have expired (as WithHardTTL arranges, say) or that are in quarantine,
+// rather than leaving them to their maintainers until they're next read.
+// For a cache made by NewOnDemand, it reaps entries that have gone stale.
+// Pinned entries are left be. Stats and Hooks.OnSweep report what it reaps.
+func WithSweeper(interval time.Duration) Option {
+	return func(c *cache) {
+		c.sweepEvery = interval
+	}
+}
+
+// WithMemoryPressure sheds entries as the process nears its memory limit,
+// as set by debug.SetMemoryLimit or GOMEMLIMIT, rather than only once the
+// cache's own bounds are reached. Every interval, if the memory the runtime
+// counts against the limit exceeds the given fraction of it (0.9, say), a
+// tenth of the entries are evicted, the coldest first as the eviction
+// policy sees it. Without a memory limit, it does nothing.
+func WithMemoryPressure(threshold float64, interval time.Duration) Option {
+	return func(c *cache) {
+		c.pressure = &pressure{
+			threshold: threshold,
+			interval:  interval,
+			limit:     memoryLimit,
+			inUse:     memoryInUse,
+		}
+	}
+}
+
+// WithQuotas bounds the entries of each namespace, as the namespace function
+// divides keys between them, so that one that takes on many keys can't
+// crowd out the others. A newcomer to a namespace that's over its quota
+// evicts another of the same namespace, as chosen by the eviction policy.
+// Namespaces without a quota are bounded only by the limits, if any, on the
+// cache as a whole. Quotas on weight need a Weigher, as given by
+// WithMaxWeight or WithMaxMemory, whose budget may be zero.
+func WithQuotas(namespace func(key Key) string, quotas map[string]Quota) Option {
+	return func(c *cache) {
+		c.namespace = namespace
+		c.quotas = quotas
+	}
+}
+
+// WithTinyLFU adds an admission filter to a cache bounded by WithMaxEntries.
+// It keeps a compact estimate of how often each key has been read recently,
+// and a key that isn't resident is only given room if it's been read more
+// often than the entry that would be evicted for it. Otherwise, Get and
+// GetOrLoad load it for the caller without keeping it. This stops a stream
+// of keys that are read once from flushing out those that are read often.
+func WithTinyLFU() Option {
+	return WithAdmission(AdmissionFunc(frequent))
+}
+
+// WithAdmission has the cache consult an Admission before giving an entry
+// to a key that isn't resident, with an estimate of how often the key has
+// been read and, if the cache is full, of how often the entry that would be
+// evicted for it has been. Keys it turns away are loaded for their readers
+// without being kept, as they are by WithTinyLFU, which this replaces. It
+// may keep only the keys that match some pattern, say, or a sample of them.
+// The Admission is called on the reader's goroutine, so should return
+// promptly.
+func WithAdmission(admission Admission) Option {
+	return func(c *cache) {
+		c.admission = admission
+	}
+}
+
+// WithBlackouts holds off background refreshes during the given periods,
+// such as an upstream's nightly maintenance. Refreshes that fall due are
+// postponed until the period is over, and values are served as they stand
+// in the meantime, even beyond WithHardTTL. Loads of keys that aren't
+// resident, and refreshes asked for by Refresh, go ahead regardless.
+func WithBlackouts(blackouts ...Blackout) Option {
+	return func(c *cache) {
+		c.blackouts = blackouts
+	}
+}
+
+// WithRateLimit rations the background refreshes of the whole cache by
+// the given Limiter, such as a *rate.Limiter, consulting it before each.
+// One that it refuses is put off for retry, and the value is served as it
+// stands in the meantime, even once it's expired. Loads of keys that have
+// no value to serve, and refreshes asked for by Refresh, go ahead
+// regardless, and aren't counted against it. Stats.Throttled counts the
+// refreshes put off.
+func WithRateLimit(limiter Limiter, retry time.Duration) Option {
+	return func(c *cache) {
+		c.limiter = limiter
+		c.limitRetry = retry
+	}
+}
+
+// WithQuarantine has the cache quarantine a key after the given number of
+// consecutive failed loads. Reads of a quarantined key fail straight away
+// with a QuarantineError, and it's neither refreshed nor dropped for want of
+// use. It's revived by a successful Refresh or Set, or by Invalidate; or, if
+// probation is non-zero, by a refresh attempted after that long. A failure
+// of any of those refreshes extends the quarantine.
+func WithQuarantine(failures int, probation time.Duration) Option {
+	return func(c *cache) {
+		c.quarantine = failures
+		c.probation = probation
+	}
+}
+
+// A GetOption adjusts the behaviour of an individual Get.
+type GetOption func(*getOptions)
+
+type getOptions struct {
+	forceRefresh bool
+	maxAge       time.Duration // Zero for no limit
+	allowStale   bool
+}
+
+// Apply GetOptions to the defaults given. The options escape to the heap,
+// so a Get given none should skip this.
+func (o getOptions) with(opts []GetOption) getOptions {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// ForceRefresh has Get refresh the value before returning it.
+func ForceRefresh() GetOption {
+	return func(o *getOptions) {
+		o.forceRefresh = true
+	}
+}
+
+// MaxAge has Get refresh a value that was loaded longer ago than the given
+// duration before returning it.
+func MaxAge(age time.Duration) GetOption {
+	return func(o *getOptions) {
+		o.maxAge = age
+	}
+}
+
+// AllowStale has Get return the current value immediately, even when
+// ForceRefresh or MaxAge call for a refresh; the refresh proceeds in the
+// background instead.
+func AllowStale() GetOption {
+	return func(o *getOptions) {
+		o.allowStale = true
+	}
+}
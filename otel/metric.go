@@ -0,0 +1,94 @@
+package otel
+
+import (
+	"context"
+	"time"
+
+	"github.com/jan-g/cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Metrics records a cache's activity with OpenTelemetry instruments, for
+// those who'd rather not use the Prometheus collector. As a cache.Tracer,
+// for cache.WithTracer, it records how long each load takes in a histogram;
+// once it's observing the cache, it reports the cache's Stats as well.
+type Metrics struct {
+	meter    metric.Meter
+	name     attribute.KeyValue
+	duration metric.Float64Histogram
+}
+
+// NewMetrics makes Metrics with instruments from meter, whose measurements
+// are labelled with cache=name, so that those of several caches can be told
+// apart.
+func NewMetrics(meter metric.Meter, name string) (*Metrics, error) {
+	duration, err := meter.Float64Histogram("cache.load.duration",
+		metric.WithUnit("s"), metric.WithDescription("How long loads took, successful or not."))
+	if err != nil {
+		return nil, err
+	}
+	return &Metrics{meter: meter, name: attribute.String("cache", name), duration: duration}, nil
+}
+
+func (m *Metrics) StartLoad(ctx context.Context, load cache.Load) (context.Context, func(cache.Value, error)) {
+	began := time.Now()
+	return ctx, func(_ cache.Value, err error) {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		m.duration.Record(ctx, time.Since(began).Seconds(),
+			metric.WithAttributes(m.name, attribute.String("cache.outcome", outcome)))
+	}
+}
+
+// Observe reports c's Stats each time the meter's readers collect: its
+// hits, misses, refreshes, refresh errors and evictions as counters, and
+// as gauges its hit ratio, how many entries it has, and how many loads
+// are queued for its refresh workers. Unregister the Registration to stop.
+func (m *Metrics) Observe(c cache.Cache) (metric.Registration, error) {
+	var counters [5]metric.Int64ObservableCounter
+	for i, desc := range [][2]string{
+		{"cache.hits", "Reads served from a loaded entry."},
+		{"cache.misses", "Reads that waited for a load."},
+		{"cache.refreshes", "Successful loads, initial or otherwise."},
+		{"cache.refresh_errors", "Failed loads."},
+		{"cache.evictions", "Entries dropped for want of use, after too many failures, or for room."},
+	} {
+		counter, err := m.meter.Int64ObservableCounter(desc[0], metric.WithDescription(desc[1]))
+		if err != nil {
+			return nil, err
+		}
+		counters[i] = counter
+	}
+	ratio, err := m.meter.Float64ObservableGauge("cache.hit_ratio",
+		metric.WithDescription("The share of reads that were hits."))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := m.meter.Int64ObservableGauge("cache.entries",
+		metric.WithDescription("Entries currently resident."))
+	if err != nil {
+		return nil, err
+	}
+	queued, err := m.meter.Int64ObservableGauge("cache.queued",
+		metric.WithDescription("Loads waiting for a refresh worker."))
+	if err != nil {
+		return nil, err
+	}
+
+	labelled := metric.WithAttributes(m.name)
+	return m.meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		s := c.Stats()
+		for i, n := range []uint64{s.Hits, s.Misses, s.Refreshes, s.RefreshErrors, s.Evictions} {
+			o.ObserveInt64(counters[i], int64(n), labelled)
+		}
+		if reads := s.Hits + s.Misses; reads > 0 {
+			o.ObserveFloat64(ratio, float64(s.Hits)/float64(reads), labelled)
+		}
+		o.ObserveInt64(entries, int64(s.Entries), labelled)
+		o.ObserveInt64(queued, int64(s.Queued), labelled)
+		return nil
+	}, counters[0], counters[1], counters[2], counters[3], counters[4], ratio, entries, queued)
+}
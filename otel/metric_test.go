@@ -0,0 +1,70 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jan-g/cache"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader := sdkmetric.NewManualReader()
+	m, err := NewMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test"), "test")
+	assert.Nil(t, err)
+	c := cache.New(ctx, func(ctx context.Context, key cache.Key) (cache.Value, error) {
+		if key == "bad" {
+			return nil, errors.New("boom")
+		}
+		return key, nil
+	}, cache.Every(time.Hour), cache.Every(time.Hour), cache.WithTracer(m))
+	registration, err := m.Observe(c)
+	assert.Nil(t, err)
+	defer registration.Unregister()
+
+	_, _ = c.Get(context.Background(), "a")
+	_, _ = c.Get(context.Background(), "a")
+	_, _ = c.Get(context.Background(), "bad")
+
+	var rm metricdata.ResourceMetrics
+	assert.Nil(t, reader.Collect(context.Background(), &rm))
+	values := map[string]float64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, metric := range sm.Metrics {
+			switch data := metric.Data.(type) {
+			case metricdata.Sum[int64]:
+				values[metric.Name] = float64(data.DataPoints[0].Value)
+			case metricdata.Gauge[int64]:
+				values[metric.Name] = float64(data.DataPoints[0].Value)
+			case metricdata.Gauge[float64]:
+				values[metric.Name] = data.DataPoints[0].Value
+			case metricdata.Histogram[float64]:
+				for _, p := range data.DataPoints {
+					outcome, _ := p.Attributes.Value("cache.outcome")
+					values[metric.Name+" "+outcome.AsString()] = float64(p.Count)
+					cache, _ := p.Attributes.Value(attribute.Key("cache"))
+					assert.Equal(t, "test", cache.AsString())
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"cache.hits":                1,
+		"cache.misses":              2,
+		"cache.refreshes":           1,
+		"cache.refresh_errors":      1,
+		"cache.evictions":           0,
+		"cache.hit_ratio":           1.0 / 3,
+		"cache.entries":             2,
+		"cache.queued":              0,
+		"cache.load.duration ok":    1,
+		"cache.load.duration error": 1,
+	}, values)
+}
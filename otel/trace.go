@@ -0,0 +1,114 @@
+// Package otel follows a cache with OpenTelemetry: its loads, and if
+// wanted its reads, as spans.
+//
+// It's a module of its own, github.com/jan-g/cache/otel, so that caches that
+// aren't followed with it needn't depend on OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jan-g/cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTracer makes a cache.Tracer, for cache.WithTracer, that starts a span
+// with tracer for each load. That made for a reader is a child of the
+// reader's span, if its context carries one, so that traces show what a
+// read was waiting for; one made in the background is a root. Each has the
+// key, whether it replaces a stale value and how old, and how it turned out,
+// as attributes.
+func NewTracer(tracer trace.Tracer) cache.Tracer {
+	return loadTracer{tracer}
+}
+
+type loadTracer struct {
+	tracer trace.Tracer
+}
+
+func (t loadTracer) StartLoad(ctx context.Context, load cache.Load) (context.Context, func(cache.Value, error)) {
+	attrs := []attribute.KeyValue{key(load.Key), attribute.Bool("cache.stale", load.Stale)}
+	if load.Stale {
+		attrs = append(attrs, attribute.Float64("cache.age_seconds", load.Age.Seconds()))
+	}
+	opts := []trace.SpanStartOption{trace.WithAttributes(attrs...)}
+	var parent trace.SpanContext
+	if load.Reader != nil {
+		parent = trace.SpanContextFromContext(load.Reader)
+	}
+	if parent.IsValid() {
+		ctx = trace.ContextWithSpanContext(ctx, parent)
+	} else {
+		// Not whatever span the cache was made in
+		opts = append(opts, trace.WithNewRoot())
+	}
+	ctx, span := t.tracer.Start(ctx, "cache.load", opts...)
+	return ctx, func(_ cache.Value, err error) {
+		end(span, err)
+	}
+}
+
+// Wrap c so that its reads are traced too, each with a span of its own that
+// the spans of loads made for it are children of.
+func Wrap(c cache.Cache, tracer trace.Tracer) cache.Cache {
+	return traced{Cache: c, tracer: tracer}
+}
+
+type traced struct {
+	cache.Cache
+	tracer trace.Tracer
+}
+
+func (c traced) start(ctx context.Context, name string, k cache.Key) (context.Context, trace.Span) {
+	return c.tracer.Start(ctx, name, trace.WithAttributes(key(k)))
+}
+
+func (c traced) Get(ctx context.Context, key cache.Key, opts ...cache.GetOption) (cache.Value, error) {
+	ctx, span := c.start(ctx, "cache.get", key)
+	value, err := c.Cache.Get(ctx, key, opts...)
+	end(span, err)
+	return value, err
+}
+
+func (c traced) GetOrLoad(ctx context.Context, key cache.Key, loader cache.Refresher) (cache.Value, error) {
+	ctx, span := c.start(ctx, "cache.get_or_load", key)
+	value, err := c.Cache.GetOrLoad(ctx, key, loader)
+	end(span, err)
+	return value, err
+}
+
+func (c traced) GetWithInfo(ctx context.Context, key cache.Key) (cache.Value, cache.Info, error) {
+	ctx, span := c.start(ctx, "cache.get_with_info", key)
+	value, info, err := c.Cache.GetWithInfo(ctx, key)
+	if !info.Refreshed.IsZero() {
+		span.SetAttributes(attribute.Float64("cache.age_seconds", info.Age.Seconds()))
+	}
+	end(span, err)
+	return value, info, err
+}
+
+func (c traced) RefreshAndGet(ctx context.Context, key cache.Key) (cache.Value, error) {
+	ctx, span := c.start(ctx, "cache.refresh_and_get", key)
+	value, err := c.Cache.RefreshAndGet(ctx, key)
+	end(span, err)
+	return value, err
+}
+
+func key(k cache.Key) attribute.KeyValue {
+	return attribute.String("cache.key", fmt.Sprint(k))
+}
+
+// End a span, recording how its operation turned out.
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("cache.outcome", "error"))
+	} else {
+		span.SetAttributes(attribute.String("cache.outcome", "ok"))
+	}
+	span.End()
+}
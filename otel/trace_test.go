@@ -0,0 +1,70 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jan-g/cache"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	c := Wrap(cache.New(ctx, func(ctx context.Context, key cache.Key) (cache.Value, error) {
+		if key == "bad" {
+			return nil, errors.New("boom")
+		}
+		return key, nil
+	}, cache.Every(100*time.Millisecond), cache.Every(time.Hour), cache.WithKeepUnused(), cache.WithTracer(NewTracer(tracer))), tracer)
+
+	request, span := tracer.Start(context.Background(), "request")
+	v, e := c.Get(request, "a")
+	assert.Nil(t, e)
+	assert.Equal(t, "a", v)
+	_, e = c.Get(request, "bad")
+	assert.NotNil(t, e)
+	span.End()
+
+	// The loads are children of the reads they're made for
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()+" "+attrs(s)["cache.key"].AsString()] = s
+	}
+	get, load := spans["cache.get a"], spans["cache.load a"]
+	assert.Equal(t, span.SpanContext().SpanID(), get.Parent().SpanID())
+	assert.Equal(t, get.SpanContext().SpanID(), load.Parent().SpanID())
+	assert.Equal(t, "ok", attrs(load)["cache.outcome"].AsString())
+	assert.False(t, attrs(load)["cache.stale"].AsBool())
+	bad := spans["cache.load bad"]
+	assert.Equal(t, codes.Error, bad.Status().Code)
+	assert.Equal(t, "error", attrs(bad)["cache.outcome"].AsString())
+
+	// A refresh in the background starts a trace of its own
+	assert.Eventually(t, func() bool {
+		for _, s := range recorder.Ended() {
+			if s.Name() == "cache.load" && attrs(s)["cache.stale"].AsBool() {
+				assert.False(t, s.Parent().IsValid())
+				assert.True(t, attrs(s)["cache.age_seconds"].AsFloat64() > 0)
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
+
+func attrs(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	m := map[attribute.Key]attribute.Value{}
+	for _, kv := range s.Attributes() {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
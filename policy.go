@@ -0,0 +1,496 @@
+package cache
+
+import (
+	"container/list"
+	"sort"
+)
+
+// A Policy chooses which entries to evict from a cache bounded by
+// WithMaxEntries or WithMaxWeight. The cache tells it of each key that
+// becomes resident, of uses of those keys, and of keys that go. Calls to it
+// are serialized.
+type Policy interface {
+	// Add notes a key that has become resident.
+	Add(key Key)
+	// Touch notes a use of a resident key.
+	Touch(key Key)
+	// Remove forgets a key that's no longer resident.
+	Remove(key Key)
+	// Victim chooses a resident key to evict, if there are any, passing
+	// over those that skip reports true for; skip may be nil. The keys
+	// passed over keep their places, and the cache may look without
+	// evicting the key chosen.
+	Victim(skip func(Key) bool) (Key, bool)
+	// Len counts the resident keys.
+	Len() int
+}
+
+type lru struct {
+	order    *list.List // Of Key, the most recently used at the front
+	elements map[Key]*list.Element
+}
+
+// LRU makes a Policy that evicts the least recently used key. It's the
+// policy used unless WithEvictionPolicy says otherwise.
+func LRU() Policy {
+	return &lru{
+		order:    list.New(),
+		elements: map[Key]*list.Element{},
+	}
+}
+
+func (p *lru) Add(key Key) {
+	if el, ok := p.elements[key]; ok {
+		p.order.MoveToFront(el)
+		return
+	}
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *lru) Touch(key Key) {
+	if el, ok := p.elements[key]; ok {
+		p.order.MoveToFront(el)
+	}
+}
+
+func (p *lru) Remove(key Key) {
+	if el, ok := p.elements[key]; ok {
+		p.order.Remove(el)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lru) Victim(skip func(Key) bool) (Key, bool) {
+	return last(p.order, skip)
+}
+
+func (p *lru) Len() int {
+	return p.order.Len()
+}
+
+// The keys used a given number of times, the most recently used first
+type frequency struct {
+	count int
+	keys  *list.List
+}
+
+// Where a key is to be found
+type lfuEntry struct {
+	bucket *list.Element // Of *frequency
+	el     *list.Element // Of Key, within the bucket
+}
+
+type lfu struct {
+	buckets *list.List // Of *frequency, in increasing order of count
+	entries map[Key]lfuEntry
+}
+
+// LFU makes a Policy that evicts the least frequently used key; of those
+// used equally often, the least recently used. It suits a small set of keys
+// that are read constantly, amongst others read now and then.
+func LFU() Policy {
+	return &lfu{
+		buckets: list.New(),
+		entries: map[Key]lfuEntry{},
+	}
+}
+
+func (p *lfu) Add(key Key) {
+	if _, ok := p.entries[key]; ok {
+		p.Touch(key)
+		return
+	}
+	first := p.buckets.Front()
+	if first == nil || first.Value.(*frequency).count != 1 {
+		first = p.buckets.PushFront(&frequency{count: 1, keys: list.New()})
+	}
+	p.entries[key] = lfuEntry{bucket: first, el: first.Value.(*frequency).keys.PushFront(key)}
+}
+
+func (p *lfu) Touch(key Key) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	f := entry.bucket.Value.(*frequency)
+	next := entry.bucket.Next()
+	if next == nil || next.Value.(*frequency).count != f.count+1 {
+		next = p.buckets.InsertAfter(&frequency{count: f.count + 1, keys: list.New()}, entry.bucket)
+	}
+	p.unlink(entry)
+	p.entries[key] = lfuEntry{bucket: next, el: next.Value.(*frequency).keys.PushFront(key)}
+}
+
+func (p *lfu) Remove(key Key) {
+	if entry, ok := p.entries[key]; ok {
+		p.unlink(entry)
+		delete(p.entries, key)
+	}
+}
+
+// Take a key out of its bucket, dropping the bucket if that empties it.
+func (p *lfu) unlink(entry lfuEntry) {
+	f := entry.bucket.Value.(*frequency)
+	f.keys.Remove(entry.el)
+	if f.keys.Len() == 0 {
+		p.buckets.Remove(entry.bucket)
+	}
+}
+
+func (p *lfu) Victim(skip func(Key) bool) (Key, bool) {
+	for b := p.buckets.Front(); b != nil; b = b.Next() {
+		if key, ok := last(b.Value.(*frequency).keys, skip); ok {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (p *lfu) Len() int {
+	return len(p.entries)
+}
+
+// A Policy that needs to know how many keys the cache may hold
+type bounded interface {
+	bound(max int)
+}
+
+// Where a key is to be found
+type arcEntry struct {
+	list *list.List
+	el   *list.Element
+}
+
+type arc struct {
+	max                 int
+	target              int        // How many of the resident keys should be recent, rather than frequent
+	recent, often       *list.List // Resident keys used once, and more than once; the most recent at the front
+	wasRecent, wasOften *list.List // Ghosts of keys evicted from each
+	entries             map[Key]arcEntry
+}
+
+// ARC makes a Policy for Adaptive Replacement: it divides the keys between
+// those used once recently and those used more often, and learns from the
+// keys it has evicted how best to balance the two. It copes with scans of
+// many keys, amongst reads of a hot set, better than LRU or LFU do.
+func ARC() Policy {
+	return &arc{
+		recent:    list.New(),
+		often:     list.New(),
+		wasRecent: list.New(),
+		wasOften:  list.New(),
+		entries:   map[Key]arcEntry{},
+	}
+}
+
+func (p *arc) bound(max int) {
+	p.max = max
+}
+
+func (p *arc) push(l *list.List, key Key) {
+	p.entries[key] = arcEntry{list: l, el: l.PushFront(key)}
+}
+
+func (p *arc) unlink(key Key) {
+	if entry, ok := p.entries[key]; ok {
+		entry.list.Remove(entry.el)
+		delete(p.entries, key)
+	}
+}
+
+func (p *arc) Add(key Key) {
+	entry, ok := p.entries[key]
+	switch {
+	case !ok:
+		p.push(p.recent, key)
+	case entry.list == p.wasRecent:
+		// We evicted a recent key too early: favour them
+		p.target = minInt(p.max, p.target+maxInt(p.wasOften.Len()/p.wasRecent.Len(), 1))
+		p.unlink(key)
+		p.push(p.often, key)
+	case entry.list == p.wasOften:
+		// Likewise a frequent one
+		p.target = maxInt(0, p.target-maxInt(p.wasRecent.Len()/p.wasOften.Len(), 1))
+		p.unlink(key)
+		p.push(p.often, key)
+	default:
+		p.Touch(key)
+		return
+	}
+	// Keep no more ghosts than there's room for
+	for p.recent.Len()+p.wasRecent.Len() > p.max && p.wasRecent.Len() > 0 {
+		p.unlink(p.wasRecent.Back().Value)
+	}
+	for p.recent.Len()+p.often.Len()+p.wasRecent.Len()+p.wasOften.Len() > 2*p.max && p.wasOften.Len() > 0 {
+		p.unlink(p.wasOften.Back().Value)
+	}
+}
+
+func (p *arc) Touch(key Key) {
+	if entry, ok := p.entries[key]; ok && (entry.list == p.recent || entry.list == p.often) {
+		p.unlink(key)
+		p.push(p.often, key)
+	}
+}
+
+func (p *arc) Remove(key Key) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	// A resident key leaves its ghost behind
+	switch entry.list {
+	case p.recent:
+		p.unlink(key)
+		p.push(p.wasRecent, key)
+	case p.often:
+		p.unlink(key)
+		p.push(p.wasOften, key)
+	}
+}
+
+func (p *arc) Victim(skip func(Key) bool) (Key, bool) {
+	first, second := p.often, p.recent
+	if p.recent.Len() > p.target || p.often.Len() == 0 {
+		first, second = p.recent, p.often
+	}
+	if key, ok := last(first, skip); ok {
+		return key, true
+	}
+	return last(second, skip)
+}
+
+func (p *arc) Len() int {
+	return p.recent.Len() + p.often.Len()
+}
+
+type s3fifo struct {
+	max          int
+	small, main  *list.List // Resident keys, the newest at the front
+	ghosts       *list.List // Keys evicted from small, likewise
+	entries      map[Key]*s3fifoEntry
+	ghostEntries map[Key]*list.Element
+}
+
+// Where a key is to be found, and how often it's been used since it got there
+type s3fifoEntry struct {
+	list *list.List
+	el   *list.Element
+	uses int
+}
+
+// S3FIFO makes a Policy that keeps keys in queues rather than reordering
+// them on each use. Newcomers go on probation in a small queue; those used
+// again while there move on to the main one, and the rest are evicted,
+// leaving a ghost behind so that they go straight to the main queue should
+// they return soon. Keys in the main queue that have been used since they
+// last reached its end go round again. It resists scans of one-off keys,
+// and for skewed workloads is often better than LRU as well as cheaper.
+func S3FIFO() Policy {
+	return &s3fifo{
+		max:          nominalEntries,
+		small:        list.New(),
+		main:         list.New(),
+		ghosts:       list.New(),
+		entries:      map[Key]*s3fifoEntry{},
+		ghostEntries: map[Key]*list.Element{},
+	}
+}
+
+func (p *s3fifo) bound(max int) {
+	p.max = max
+}
+
+func (p *s3fifo) push(l *list.List, key Key) {
+	p.entries[key] = &s3fifoEntry{list: l, el: l.PushFront(key)}
+}
+
+func (p *s3fifo) Add(key Key) {
+	if _, ok := p.entries[key]; ok {
+		p.Touch(key)
+		return
+	}
+	if el, ok := p.ghostEntries[key]; ok {
+		p.ghosts.Remove(el)
+		delete(p.ghostEntries, key)
+		p.push(p.main, key)
+		return
+	}
+	p.push(p.small, key)
+}
+
+func (p *s3fifo) Touch(key Key) {
+	if entry, ok := p.entries[key]; ok && entry.uses < 3 {
+		entry.uses++
+	}
+}
+
+func (p *s3fifo) Remove(key Key) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	entry.list.Remove(entry.el)
+	delete(p.entries, key)
+	if entry.list == p.small {
+		p.ghostEntries[key] = p.ghosts.PushFront(key)
+		for p.ghosts.Len() > p.max {
+			delete(p.ghostEntries, p.ghosts.Remove(p.ghosts.Back()))
+		}
+	}
+}
+
+// Choosing a victim moves the keys that have earned it along their queues,
+// bar those passed over.
+func (p *s3fifo) Victim(skip func(Key) bool) (Key, bool) {
+	for el := p.small.Back(); el != nil && (p.small.Len() > maxInt(p.max/10, 1) || p.main.Len() == 0); {
+		prev := el.Prev()
+		key := el.Value
+		switch entry := p.entries[key]; {
+		case skipped(skip, key):
+		case entry.uses == 0:
+			return key, true
+		default:
+			p.small.Remove(el)
+			p.push(p.main, key)
+		}
+		el = prev
+	}
+	// Round the main queue, for as long as that moves any key on
+	for moved := true; moved; {
+		moved = false
+		for el := p.main.Back(); el != nil; {
+			prev := el.Prev()
+			switch entry := p.entries[el.Value]; {
+			case skipped(skip, el.Value):
+			case entry.uses == 0:
+				return el.Value, true
+			default:
+				entry.uses--
+				p.main.MoveToFront(el)
+				moved = true
+			}
+			el = prev
+		}
+	}
+	return nil, false
+}
+
+func (p *s3fifo) Len() int {
+	return len(p.entries)
+}
+
+// Divides keys between policies by priority, evicting from the lowest
+// priority first. Keys start at priority zero.
+type prioritized struct {
+	policy func() Policy
+	max    int
+	levels []*level // In increasing order of priority
+	ranks  map[Key]*level
+}
+
+type level struct {
+	priority int
+	policy   Policy
+}
+
+func (p *prioritized) bound(max int) {
+	p.max = max
+	for _, l := range p.levels {
+		if b, ok := l.policy.(bounded); ok {
+			b.bound(max)
+		}
+	}
+}
+
+// The level for a priority, made if need be.
+func (p *prioritized) level(priority int) *level {
+	i := sort.Search(len(p.levels), func(i int) bool { return p.levels[i].priority >= priority })
+	if i < len(p.levels) && p.levels[i].priority == priority {
+		return p.levels[i]
+	}
+	l := &level{priority: priority, policy: p.policy()}
+	if b, ok := l.policy.(bounded); ok {
+		b.bound(p.max)
+	}
+	p.levels = append(p.levels, nil)
+	copy(p.levels[i+1:], p.levels[i:])
+	p.levels[i] = l
+	return l
+}
+
+// Move a key to another priority.
+func (p *prioritized) rank(key Key, priority int) {
+	l, ok := p.ranks[key]
+	if !ok || l.priority == priority {
+		return
+	}
+	l.policy.Remove(key)
+	l = p.level(priority)
+	l.policy.Add(key)
+	p.ranks[key] = l
+}
+
+func (p *prioritized) Add(key Key) {
+	l, ok := p.ranks[key]
+	if !ok {
+		l = p.level(0)
+		p.ranks[key] = l
+	}
+	l.policy.Add(key)
+}
+
+func (p *prioritized) Touch(key Key) {
+	if l, ok := p.ranks[key]; ok {
+		l.policy.Touch(key)
+	}
+}
+
+func (p *prioritized) Remove(key Key) {
+	if l, ok := p.ranks[key]; ok {
+		l.policy.Remove(key)
+		delete(p.ranks, key)
+	}
+}
+
+func (p *prioritized) Victim(skip func(Key) bool) (Key, bool) {
+	for _, l := range p.levels {
+		if key, ok := l.policy.Victim(skip); ok {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (p *prioritized) Len() int {
+	return len(p.ranks)
+}
+
+// Whether skip passes over a key.
+func skipped(skip func(Key) bool, key Key) bool {
+	return skip != nil && skip(key)
+}
+
+// The key nearest the back of a list that isn't passed over, if there is one.
+func last(l *list.List, skip func(Key) bool) (Key, bool) {
+	for el := l.Back(); el != nil; el = el.Prev() {
+		if !skipped(skip, el.Value) {
+			return el.Value, true
+		}
+	}
+	return nil, false
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Evict from the policy until it holds no more than n keys, reporting what's evicted
+func evictTo(p Policy, n int) []Key {
+	var victims []Key
+	for p.Len() > n {
+		victim, ok := p.Victim(nil)
+		if !ok {
+			break
+		}
+		p.Remove(victim)
+		victims = append(victims, victim)
+	}
+	return victims
+}
+
+func TestLRU(t *testing.T) {
+	p := LRU()
+	for _, key := range []string{"a", "b", "c"} {
+		p.Add(key)
+	}
+	p.Touch("a")
+	assert.Equal(t, []Key{"b", "c"}, evictTo(p, 1))
+
+	p.Remove("a")
+	_, ok := p.Victim(nil)
+	assert.False(t, ok)
+}
+
+func TestLFU(t *testing.T) {
+	p := LFU()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		p.Add(key)
+	}
+	p.Touch("a")
+	p.Touch("a")
+	p.Touch("c")
+	p.Touch("b")
+	// d was used least; of b and c, used as often as each other, c was used less recently
+	assert.Equal(t, []Key{"d", "c", "b"}, evictTo(p, 1))
+
+	// A newcomer has to earn its place
+	p.Add("e")
+	assert.Equal(t, []Key{"e"}, evictTo(p, 1))
+}
+
+func TestARC(t *testing.T) {
+	p := ARC()
+	p.(bounded).bound(2)
+	add := func(keys ...string) (victims []Key) {
+		for _, key := range keys {
+			if p.Len() >= 2 {
+				victims = append(victims, evictTo(p, 1)...)
+			}
+			p.Add(key)
+		}
+		return victims
+	}
+
+	// A key that's used again survives a scan
+	add("hot")
+	p.Touch("hot")
+	assert.Equal(t, []Key{"a", "b"}, add("a", "b", "c"))
+
+	// A key evicted too early comes back as a frequent one, and recent keys are given more room
+	assert.Equal(t, []Key{"c"}, add("b"))
+	assert.Equal(t, []Key{"hot"}, add("d"))
+	assert.Equal(t, []Key{"b"}, add("e"))
+}
+
+func TestS3FIFO(t *testing.T) {
+	p := S3FIFO()
+	p.(bounded).bound(10)
+	var victims []Key
+	add := func(key Key) {
+		if p.Len() >= 10 {
+			victims = append(victims, evictTo(p, 9)...)
+		}
+		p.Add(key)
+	}
+
+	// A key that's used again survives a scan
+	add("hot")
+	p.Touch("hot")
+	for i := 0; i < 20; i++ {
+		add(i)
+	}
+	assert.Equal(t, []Key{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, victims)
+
+	// One that's evicted on probation and soon returns goes straight to the main queue
+	victims = nil
+	add(0)
+	assert.Equal(t, []Key{11}, victims)
+	assert.Equal(t, []Key{12, 13, 14, 15, 16, 17, 18}, evictTo(p, 3))
+}
+
+func TestVictimSkips(t *testing.T) {
+	for name, policy := range map[string]func() Policy{"LRU": LRU, "LFU": LFU, "ARC": ARC, "S3FIFO": S3FIFO} {
+		t.Run(name, func(t *testing.T) {
+			p := policy()
+			if b, ok := p.(bounded); ok {
+				b.bound(10)
+			}
+			for _, key := range []string{"a", "b", "c", "d"} {
+				p.Add(key)
+			}
+			p.Touch("d")
+			first, ok := p.Victim(nil)
+			assert.True(t, ok)
+
+			// Passing over the first choice gives another, and leaves the first where it was
+			other, ok := p.Victim(func(key Key) bool { return key == first })
+			assert.True(t, ok)
+			assert.NotEqual(t, first, other)
+			assert.Equal(t, 4, p.Len())
+			victim, _ := p.Victim(nil)
+			assert.Equal(t, first, victim)
+
+			_, ok = p.Victim(func(Key) bool { return true })
+			assert.False(t, ok)
+			assert.Equal(t, 4, p.Len())
+			victim, _ = p.Victim(nil)
+			assert.Equal(t, first, victim)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Pools of the things made afresh for each call, so that a busy cache
+// doesn't keep making garbage. Each goes back only once nothing else can be
+// holding on to it.
+var replies = sync.Pool{New: func() interface{} { return make(chan r, 1) }}
+
+// A channel for a single reply, from the pool. It goes back once the reply
+// has been received, and not if the caller gives up on it.
+func newReply() chan r {
+	return replies.Get().(chan r)
+}
+
+func recycleReply(reply chan r) {
+	replies.Put(reply)
+}
+
+// Arm a timer to fire after d, reusing t if there is one; it must have been
+// stopped with stopTimer, or have fired and been read.
+func rearm(clock Clock, t Timer, d time.Duration) Timer {
+	if t == nil {
+		return clock.NewTimer(d)
+	}
+	t.Reset(d)
+	return t
+}
+
+// Stop a timer, discarding any firing that's gone unread, so that it can be
+// reset.
+func stopTimer(t Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C():
+		default:
+		}
+	}
+}
+
+// A timer from the cache's pool, armed to fire after d.
+func (cache *cache) timer(d time.Duration) Timer {
+	t, _ := cache.idleTimers.Get().(Timer)
+	return rearm(cache.clock, t, d)
+}
+
+// Stop a timer and put it back in the pool.
+func (cache *cache) recycleTimer(t Timer) {
+	stopTimer(t)
+	cache.idleTimers.Put(t)
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"time"
+)
+
+// Watches the memory the process has in use against its limit
+type pressure struct {
+	threshold float64 // The fraction of the limit past which entries are shed
+	interval  time.Duration
+	limit     func() int64  // The memory limit, math.MaxInt64 for none
+	inUse     func() uint64 // What counts against it
+}
+
+// The memory limit, as set by debug.SetMemoryLimit or GOMEMLIMIT.
+func memoryLimit() int64 {
+	return debug.SetMemoryLimit(-1)
+}
+
+// The memory the runtime counts against its limit: all it has mapped, bar
+// what it has returned to the system.
+func memoryInUse() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// Whether the process is near enough its limit to shed entries.
+func (p *pressure) high() bool {
+	limit := p.limit()
+	if limit <= 0 || limit == math.MaxInt64 {
+		return false
+	}
+	return float64(p.inUse()) > p.threshold*float64(limit)
+}
+
+// Periodically evict a tenth of the entries, least valuable first, for as
+// long as memory is short.
+func (cache *cache) shed() {
+	defer cache.running.Done()
+	timer := cache.clock.NewTimer(cache.pressure.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-cache.ctx.Done():
+			return
+		case <-timer.C():
+			timer.Reset(cache.pressure.interval)
+			if !cache.pressure.high() {
+				continue
+			}
+			n := cache.Len() / 10
+			if n < 1 {
+				n = 1
+			}
+			victims := cache.capacity.shed(n)
+			cache.debug("memory is short, shedding entries", "entries", len(victims))
+			cache.evictAll(victims)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package cache
+
+// A Limiter rations the calls a cache makes to its refresher, as
+// WithRateLimit arranges. A *rate.Limiter, from golang.org/x/time/rate, is
+// one.
+type Limiter interface {
+	// Allow reports whether a call may be made now, counting it if so.
+	Allow() bool
+}
+
+// Whether the rate limit allows a background refresh now; one that it
+// doesn't is counted as throttled.
+func (cache *cache) allowed() bool {
+	if cache.limiter == nil || cache.limiter.Allow() {
+		return true
+	}
+	cache.stats.throttled()
+	return false
+}
@@ -0,0 +1,237 @@
+package cache
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// NewScheduled constructs a cache that, like New's, refreshes its values in
+// the background and serves the current one while it does; but rather than
+// running a goroutine and timer per key, it keeps the entries of NewOnDemand
+// in order of when they're due, and refreshes them with a pool of workers.
+// That makes it affordable for hundreds of thousands of keys.
+//
+// Values are refreshed every period (or errors every errorPeriod), or after
+// their own TTL, from ValueWithTTL or an Expirer. As with New, an entry
+// that's gone unread since its last refresh is dropped when the next falls
+// due, unless WithKeepUnused or WithIdleTimeout says otherwise. No more than
+// workers refreshes are in flight at once; those that fall due meanwhile
+// wait their turn. Refreshes that fall due during a blackout are put off
+// until it's over, and those the rate limit refuses for a while. Given
+// WithBulkRefresher, those that fall due together are made in one call to
+// it. Otherwise, options take effect as they do for NewOnDemand.
+func NewScheduled(ctx context.Context, refresher Refresher, period, errorPeriod time.Duration, workers int, opts ...Option) Cache {
+	return scheduled(newCache(ctx, refresher, nil, nil, opts...), period, errorPeriod, workers)
+}
+
+// Schedule the refreshes of a cache that's been constructed, with workers to
+// make them, and start it.
+func scheduled(cache *cache, period, errorPeriod time.Duration, workers int) *onDemand {
+	c := &onDemand{
+		cache:       cache,
+		ttl:         period,
+		negativeTTL: errorPeriod,
+		sched:       &scheduler{wake: make(chan struct{}, 1), work: make(chan []due)},
+	}
+	// A stale value is served while it's refreshed, as a maintainer would
+	c.cache.staleWhileRevalidate = true
+	c.cache.evict = c.evict
+	c.cache.reap = c.reap
+	c.cache.publish(c)
+	c.cache.background()
+	c.cache.running.Add(1 + workers)
+	go c.schedule()
+	for i := 0; i < workers; i++ {
+		go c.work()
+	}
+	return c
+}
+
+// The entries of a cache made by NewScheduled, in order of when they fall due
+type scheduler struct {
+	mu    sync.Mutex
+	queue dues
+	wake  chan struct{} // Nudged when something's due sooner than before
+	work  chan []due    // Entries that are due, for the workers, one at a time or in batches
+}
+
+// When an entry falls due, in Unix nanoseconds. An entry that's rescheduled
+// leaves its old place in the queue, which is ignored when its time comes.
+type due struct {
+	key  Key
+	d    *demand
+	at   int64
+	turn uint32 // The entry's turn this place is for
+}
+
+// A heap of dues, the soonest first
+type dues []due
+
+func (q dues) Len() int            { return len(q) }
+func (q dues) Less(i, j int) bool  { return q[i].at < q[j].at }
+func (q dues) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *dues) Push(x interface{}) { *q = append(*q, x.(due)) }
+func (q *dues) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+func (s *scheduler) add(d due) {
+	s.mu.Lock()
+	heap.Push(&s.queue, d)
+	soonest := s.queue[0] == d
+	s.mu.Unlock()
+	if soonest {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Take the entries that are due by now, and say when the next one is, if
+// there is one.
+func (s *scheduler) take(now time.Time) ([]due, int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ready []due
+	for len(s.queue) > 0 && s.queue[0].at <= now.UnixNano() {
+		ready = append(ready, heap.Pop(&s.queue).(due))
+	}
+	if len(s.queue) == 0 {
+		return ready, 0, false
+	}
+	return ready, s.queue[0].at, true
+}
+
+// Schedule an entry's next refresh for when it falls due. The caller holds
+// d.mu.
+func (c *onDemand) reschedule(key Key, d *demand) {
+	if c.sched == nil || d.dropped {
+		return
+	}
+	c.queue(key, d, c.due(d))
+}
+
+// Put an entry in the queue for the given time, in Unix nanoseconds, in
+// place of wherever it was. The caller holds d.mu.
+func (c *onDemand) queue(key Key, d *demand, at int64) {
+	d.turn++
+	c.sched.add(due{key: key, d: d, at: at, turn: d.turn})
+}
+
+// Hand entries to the workers as they fall due.
+func (c *onDemand) schedule() {
+	defer c.cache.running.Done()
+	var timer Timer
+	for {
+		ready, next, ok := c.sched.take(c.cache.clock.Now())
+		for _, batch := range c.batches(ready) {
+			select {
+			case <-c.cache.ctx.Done():
+				return
+			case c.sched.work <- batch:
+			}
+		}
+		var wait <-chan time.Time
+		if ok {
+			// The one timer is reset each time round
+			timer = rearm(c.cache.clock, timer, time.Duration(next-c.cache.clock.Now().UnixNano()))
+			wait = timer.C()
+		}
+		select {
+		case <-c.cache.ctx.Done():
+		case <-c.sched.wake:
+		case <-wait:
+		}
+		if wait != nil {
+			stopTimer(timer)
+		}
+		if c.cache.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (c *onDemand) work() {
+	defer c.cache.running.Done()
+	for {
+		select {
+		case <-c.cache.ctx.Done():
+			return
+		case batch := <-c.sched.work:
+			if c.cache.bulk != nil {
+				c.refreshBulk(batch)
+			} else {
+				c.refreshDue(batch[0])
+			}
+		}
+	}
+}
+
+// Refresh an entry that's fallen due, and wait for it.
+func (c *onDemand) refreshDue(next due) {
+	if !c.claim(next) {
+		return
+	}
+	d := next.d
+	l := c.start(nil, next.key, d)
+	d.mu.Unlock()
+	<-l.done
+}
+
+// Claim an entry that's fallen due, reporting true, with d.mu held, if it
+// should be refreshed; or drop it, if it's gone unused, or put it off, if
+// there's a blackout or the rate limit refuses it.
+func (c *onDemand) claim(next due) bool {
+	key, d := next.key, next.d
+	d.mu.Lock()
+	if d.dropped || d.turn != next.turn || d.load != nil {
+		// It's gone, been rescheduled, or is being refreshed already
+		d.mu.Unlock()
+		return false
+	}
+	now := c.cache.clock.Now()
+	if c.waiting(key, d, now) {
+		d.mu.Unlock()
+		return false
+	}
+	if c.unused(key, d, now) {
+		value := d.result.Value
+		c.drop(key, d)
+		d.mu.Unlock()
+		c.cache.stats.evicted()
+		c.cache.hooks.evicted(key, value)
+		c.cache.hooks.removed(key, value, ReasonUnused)
+		return false
+	}
+	if wait := c.cache.blackout(); wait > 0 {
+		c.queue(key, d, nanos(now.Add(wait)))
+		d.mu.Unlock()
+		return false
+	}
+	if !c.cache.allowed() {
+		c.queue(key, d, nanos(now.Add(c.cache.limitRetry)))
+		d.mu.Unlock()
+		return false
+	}
+	d.touched = false
+	return true
+}
+
+// Whether an entry that's fallen due should be dropped rather than
+// refreshed. The caller holds d.mu.
+func (c *onDemand) unused(key Key, d *demand, now time.Time) bool {
+	d.prune()
+	if c.cache.keepUnused || c.cache.isPinned(key) || d.subscribed() {
+		return false
+	}
+	if c.cache.idleTimeout > 0 {
+		return time.Duration(now.UnixNano()-d.used) >= c.cache.idleTimeout
+	}
+	return !d.touched
+}
@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jan-g/delay"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var loads, running, most int32
+	clock := newFakeClock()
+	c := NewScheduled(ctx, func(ctx context.Context, key Key) (Value, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for m := atomic.LoadInt32(&most); n > m && !atomic.CompareAndSwapInt32(&most, m, n); m = atomic.LoadInt32(&most) {
+		}
+		<-clock.After(period / 20)
+		return int(atomic.AddInt32(&loads, 1)), nil
+	}, period, period, 2, WithClock(clock))
+
+	// Values are refreshed in the background for as long as they're read
+	v, e := getOn(clock, c, "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+	for i := 0; i < 25; i++ {
+		v, _ = c.GetIfPresent("foo")
+		clock.Sleep(period / 10)
+	}
+	assert.True(t, v.(int) >= 3)
+
+	// And dropped once they aren't
+	clock.Sleep(3 * period)
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, period, period/100)
+
+	// No more than the workers refresh at once
+	var keys []Key
+	for i := 0; i < 10; i++ {
+		keys = append(keys, fmt.Sprint("key", i))
+	}
+	clock.During(func() {
+		assert.Nil(t, c.Warm(context.Background(), keys...))
+	})
+	atomic.StoreInt32(&most, 0)
+	before := atomic.LoadInt32(&loads)
+	for i := 0; i < 20; i++ {
+		for _, key := range keys {
+			c.GetIfPresent(key)
+		}
+		clock.Sleep(period / 10)
+	}
+	assert.True(t, atomic.LoadInt32(&loads)-before >= 10)
+	assert.True(t, atomic.LoadInt32(&most) <= 2)
+	assert.Equal(t, 10, c.Len())
+
+	cancel()
+}
+
+func TestBulkRefresher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := newFakeClock()
+	boom := errors.New("boom")
+	var calls [][]Key
+	var mu sync.Mutex
+	c := NewScheduled(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key.(string) + "1", nil
+	}, time.Minute, time.Minute, 2, WithClock(clock), WithKeepUnused(), WithBulkRefresher(func(ctx context.Context, keys []Key) (map[Key]Value, map[Key]error) {
+		mu.Lock()
+		calls = append(calls, keys)
+		mu.Unlock()
+		values := map[Key]Value{}
+		for _, key := range keys {
+			if key != "missing" && key != "bad" {
+				values[key] = key.(string) + "2"
+			}
+		}
+		return values, map[Key]error{"bad": boom}
+	}, 0))
+
+	assert.Nil(t, c.Warm(context.Background(), "a", "b", "missing", "bad"))
+	v, _ := c.GetIfPresent("a")
+	assert.Equal(t, "a1", v)
+
+	// Once the scheduler is waiting, everything falls due at once, and is
+	// refreshed in one call
+	assert.Eventually(t, func() bool {
+		clock.mu.Lock()
+		defer clock.mu.Unlock()
+		return len(clock.timers) > 0
+	}, time.Second, time.Millisecond)
+	clock.Advance(time.Minute)
+	assert.Eventually(t, func() bool {
+		v, _ := c.GetIfPresent("b")
+		return v == "b2"
+	}, time.Second, time.Millisecond)
+	v, _ = c.GetIfPresent("a")
+	assert.Equal(t, "a2", v)
+	_, e := c.Get(context.Background(), "bad")
+	assert.ErrorIs(t, e, boom)
+	_, e = c.Get(context.Background(), "missing")
+	assert.ErrorIs(t, e, ErrNotFound)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, calls, 1)
+	assert.ElementsMatch(t, []Key{"a", "b", "missing", "bad"}, calls[0])
+}
+
+func TestExpiryHeap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := newFakeClock()
+	boom := errors.New("boom")
+	var mu sync.Mutex
+	loads := map[Key]int{}
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		loads[key]++
+		if key == "flaky" && loads[key] == 1 {
+			return nil, boom
+		}
+		return loads[key], nil
+	}, Every(time.Hour), Every(time.Minute), WithClock(clock), WithKeepUnused(), WithExpiryHeap(2))
+
+	// There's no maintainer per key
+	before := runtime.NumGoroutine()
+	keys := make([]Key, 1000)
+	for i := range keys {
+		keys[i] = i
+	}
+	assert.Nil(t, c.Warm(context.Background(), keys...))
+	assert.Less(t, runtime.NumGoroutine(), before+100)
+
+	// Values fall due as the positive backoff says, and errors as the negative
+	v, _ := c.Get(context.Background(), "a")
+	assert.Equal(t, 1, v)
+	_, e := c.Get(context.Background(), "flaky")
+	assert.ErrorIs(t, e, boom)
+	due := func(key Key) time.Duration {
+		v, _ := c.(*onDemand).cache.kv.Load(key)
+		d := v.(*demand)
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return time.Duration(d.expires - clock.Now().UnixNano())
+	}
+	assert.Equal(t, time.Hour, due("a"))
+	assert.Equal(t, time.Minute, due("flaky"))
+
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Second)
+		v, _ := c.GetIfPresent("flaky")
+		return v == 2
+	}, time.Second, time.Millisecond)
+	v, _ = c.GetIfPresent("a")
+	assert.Equal(t, 1, v)
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Minute)
+		v, _ := c.GetIfPresent("a")
+		return v == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestExpiryHeapDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var loads int32
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return int(atomic.AddInt32(&loads, 1)), nil
+	}, func() Backoff { return delay.New(period / 4) }, negative, WithExpiryHeap(1))
+
+	// A Delay can't say beforehand how long it'll wait, but its refreshes are
+	// made all the same, for as long as the key's read
+	for i := 0; i < 10; i++ {
+		_, e := c.Get(context.Background(), "foo")
+		assert.Nil(t, e)
+		time.Sleep(period / 10)
+	}
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&loads), int32(3))
+
+	// Without a goroutine for each key to wait out its delay
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		_, e := c.Get(context.Background(), i)
+		assert.Nil(t, e)
+	}
+	assert.Less(t, runtime.NumGoroutine(), goroutines+10)
+
+	// And they're dropped once they aren't
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, 2*period, period/20)
+}
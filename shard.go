@@ -0,0 +1,265 @@
+package cache
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// The store of a cache's entries, divided into shards by the hash of their
+// keys so that writers to different shards don't contend, as WithShards
+// arranges. Each shard counts its own entries. The shards are sync.Maps,
+// or, as WithSnapshotMap arranges, copy-on-write maps that are read without
+// locking and replaced whole by each writer.
+type shardedMap struct {
+	seed      maphash.Seed
+	shards    []shard
+	mask      uint64 // The number of shards, less one
+	snapshots bool   // Whether the shards are copy-on-write
+}
+
+type shard struct {
+	m    sync.Map
+	snap atomic.Pointer[frozen] // The current copy, if the shard is copy-on-write
+	mu   sync.Mutex             // Held by writers to it
+	n    int64                  // How many entries it holds, counted atomically
+	_    [48]byte               // Keeps the counts of neighbouring shards off the same cache line
+}
+
+// A copy of a shard's entries, frozen once it's been published
+type frozen map[interface{}]interface{}
+
+// Divide the map into n shards, rounded up to a power of two, and have them
+// copied on write if snapshots says so.
+func (s *shardedMap) init(n int, snapshots bool) {
+	size := 1
+	for size < n {
+		size *= 2
+	}
+	s.seed = maphash.MakeSeed()
+	s.shards = make([]shard, size)
+	s.mask = uint64(size - 1)
+	s.snapshots = snapshots
+}
+
+func (s *shardedMap) shard(key Key) *shard {
+	return &s.shards[s.index(key)]
+}
+
+// The index of a key's shard, by which its stripes of other state are
+// found too.
+func (s *shardedMap) index(key Key) int {
+	if s.mask == 0 {
+		return 0
+	}
+	return int(hashKey(s.seed, key) & s.mask)
+}
+
+func (s *shardedMap) Load(key Key) (interface{}, bool) {
+	sh := s.shard(key)
+	if s.snapshots {
+		value, ok := sh.snap.Load().get(key)
+		return value, ok
+	}
+	return sh.m.Load(key)
+}
+
+func (s *shardedMap) LoadOrStore(key Key, value interface{}) (interface{}, bool) {
+	sh := s.shard(key)
+	if s.snapshots {
+		return sh.loadOrStore(key, value)
+	}
+	actual, loaded := sh.m.LoadOrStore(key, value)
+	if !loaded {
+		atomic.AddInt64(&sh.n, 1)
+	}
+	return actual, loaded
+}
+
+func (s *shardedMap) Delete(key Key) {
+	sh := s.shard(key)
+	if s.snapshots {
+		sh.delete(key)
+		return
+	}
+	if _, loaded := sh.m.LoadAndDelete(key); loaded {
+		atomic.AddInt64(&sh.n, -1)
+	}
+}
+
+// Range calls f for each entry, a shard at a time, until it returns false.
+// A copy-on-write shard is ranged over as it was when its turn came.
+func (s *shardedMap) Range(f func(key, value interface{}) bool) {
+	more := true
+	for i := range s.shards {
+		sh := &s.shards[i]
+		if s.snapshots {
+			for key, value := range *sh.snap.Load().orEmpty() {
+				if more = f(key, value); !more {
+					return
+				}
+			}
+			continue
+		}
+		sh.m.Range(func(key, value interface{}) bool {
+			more = f(key, value)
+			return more
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+func (m *frozen) get(key Key) (interface{}, bool) {
+	if m == nil {
+		return nil, false
+	}
+	value, ok := (*m)[key]
+	return value, ok
+}
+
+func (m *frozen) orEmpty() *frozen {
+	if m == nil {
+		return &frozen{}
+	}
+	return m
+}
+
+// Store a key in a copy-on-write shard, unless it's there already, by
+// publishing a copy that includes it.
+func (sh *shard) loadOrStore(key Key, value interface{}) (interface{}, bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	old := sh.snap.Load()
+	if actual, ok := old.get(key); ok {
+		return actual, true
+	}
+	next := make(frozen, len(*old.orEmpty())+1)
+	for k, v := range *old.orEmpty() {
+		next[k] = v
+	}
+	next[key] = value
+	sh.snap.Store(&next)
+	atomic.AddInt64(&sh.n, 1)
+	return value, false
+}
+
+// Delete a key from a copy-on-write shard, by publishing a copy without it.
+func (sh *shard) delete(key Key) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	old := sh.snap.Load()
+	if _, ok := old.get(key); !ok {
+		return
+	}
+	next := make(frozen, len(*old)-1)
+	for k, v := range *old {
+		if k != key {
+			next[k] = v
+		}
+	}
+	sh.snap.Store(&next)
+	atomic.AddInt64(&sh.n, -1)
+}
+
+// Len counts the entries.
+func (s *shardedMap) Len() int {
+	var n int64
+	for i := range s.shards {
+		n += atomic.LoadInt64(&s.shards[i].n)
+	}
+	return int(n)
+}
+
+// Hash a key by its value, so that keys that are == hash alike: strings and
+// numbers by what they hold, with -0 taken as 0, pointers and channels by
+// their address, and arrays and structs by their elements.
+func hashKey(seed maphash.Seed, key Key) uint64 {
+	var h maphash.Hash
+	h.SetSeed(seed)
+	switch k := key.(type) {
+	case string:
+		h.WriteString(k)
+	case int:
+		writeUint(&h, uint64(k))
+	case int64:
+		writeUint(&h, uint64(k))
+	case int32:
+		writeUint(&h, uint64(k))
+	case uint64:
+		writeUint(&h, k)
+	case uint32:
+		writeUint(&h, uint64(k))
+	case float64:
+		writeFloat(&h, k)
+	case bool:
+		writeBool(&h, k)
+	default:
+		hashValue(&h, reflect.ValueOf(key))
+	}
+	return h.Sum64()
+}
+
+// Hash a value of any comparable kind, as hashKey does.
+func hashValue(h *maphash.Hash, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		h.WriteString(v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeUint(h, uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeUint(h, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		writeFloat(h, v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		writeFloat(h, real(c))
+		writeFloat(h, imag(c))
+	case reflect.Bool:
+		writeBool(h, v.Bool())
+	case reflect.Ptr, reflect.Chan, reflect.UnsafePointer:
+		writeUint(h, uint64(v.Pointer()))
+	case reflect.Interface:
+		if !v.IsNil() {
+			hashValue(h, v.Elem())
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			hashValue(h, v.Index(i))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			// Blank fields aren't compared
+			if t.Field(i).Name != "_" {
+				hashValue(h, v.Field(i))
+			}
+		}
+	}
+}
+
+func writeUint(h *maphash.Hash, n uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], n)
+	h.Write(b[:])
+}
+
+func writeFloat(h *maphash.Hash, f float64) {
+	if f == 0 {
+		// -0 == 0
+		f = 0
+	}
+	writeUint(h, math.Float64bits(f))
+}
+
+func writeBool(h *maphash.Hash, b bool) {
+	if b {
+		h.WriteByte(1)
+	} else {
+		h.WriteByte(0)
+	}
+}
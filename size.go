@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"reflect"
+)
+
+// A Sizer reports how many bytes it occupies, in place of the estimate that
+// EstimateSize would otherwise make of it.
+type Sizer interface {
+	Size() int64
+}
+
+// EstimateSize is a Weigher that reckons the bytes taken up by an entry's
+// key and value. Unless they're Sizers, it walks them by reflection,
+// counting what their pointers, slices, maps, strings and interfaces refer
+// to as well as the values themselves; memory that's shared is counted
+// once. It's an estimate: allocator overheads and the like are left out.
+func EstimateSize(key Key, value Value) int64 {
+	s := sizer{seen: map[uintptr]bool{}}
+	return s.of(key) + s.of(value)
+}
+
+// Walks values, remembering what's been counted already
+type sizer struct {
+	seen map[uintptr]bool
+}
+
+func (s *sizer) of(x interface{}) int64 {
+	if x == nil {
+		return 0
+	}
+	if sz, ok := x.(Sizer); ok {
+		return sz.Size()
+	}
+	v := reflect.ValueOf(x)
+	return int64(v.Type().Size()) + s.indirect(v)
+}
+
+// The first time memory at an address is seen; zero-sized things don't count.
+func (s *sizer) first(p uintptr) bool {
+	if p == 0 || s.seen[p] {
+		return false
+	}
+	s.seen[p] = true
+	return true
+}
+
+// The bytes that v refers to, beyond its own.
+func (s *sizer) indirect(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || !s.first(v.Pointer()) {
+			return 0
+		}
+		e := v.Elem()
+		return int64(e.Type().Size()) + s.indirect(e)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		e := v.Elem()
+		return int64(e.Type().Size()) + s.indirect(e)
+	case reflect.String:
+		if v.Len() == 0 {
+			return 0
+		}
+		// Strings can't be addressed, so shared ones are counted each time
+		return int64(v.Len())
+	case reflect.Slice:
+		if v.IsNil() || !s.first(v.Pointer()) {
+			return 0
+		}
+		n := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			n += s.indirect(v.Index(i))
+		}
+		return n
+	case reflect.Array:
+		var n int64
+		for i := 0; i < v.Len(); i++ {
+			n += s.indirect(v.Index(i))
+		}
+		return n
+	case reflect.Struct:
+		var n int64
+		for i := 0; i < v.NumField(); i++ {
+			n += s.indirect(v.Field(i))
+		}
+		return n
+	case reflect.Map:
+		if v.IsNil() || !s.first(v.Pointer()) {
+			return 0
+		}
+		// Roughly: the buckets hold a key and an element for each entry
+		t := v.Type()
+		n := int64(v.Len()) * int64(t.Key().Size()+t.Elem().Size())
+		iter := v.MapRange()
+		for iter.Next() {
+			n += s.indirect(iter.Key()) + s.indirect(iter.Value())
+		}
+		return n
+	}
+	return 0
+}
+
+// The size of a value, for SizeOf: its weight, if the cache weighs its
+// entries, or an estimate of its bytes.
+func (cache *cache) size(key Key, value Value) int64 {
+	if cache.weigher != nil {
+		return cache.weigher(key, value)
+	}
+	return EstimateSize(key, value)
+}
+
+// Size up the successfully loaded values of c.
+func sizes(c Cache, size Weigher) (map[Key]int64, int64) {
+	sizes := map[Key]int64{}
+	var total int64
+	c.Range(func(key Key, value Value, err error) bool {
+		if err == nil {
+			n := size(key, value)
+			sizes[key] = n
+			total += n
+		}
+		return true
+	})
+	return sizes, total
+}
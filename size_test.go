@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sized struct{}
+
+func (sized) Size() int64 {
+	return 1 << 20
+}
+
+func TestEstimateSize(t *testing.T) {
+	type pair struct {
+		name  string
+		value *int64
+	}
+	n := int64(1)
+	shared := &n
+
+	for _, test := range []struct {
+		key   Key
+		value Value
+		want  int64
+	}{
+		{nil, nil, 0},
+		{nil, int64(1), 8},
+		{"", "hello", 2*16 + 5},
+		{nil, []byte("hello"), 24 + 5},
+		{nil, make([]int32, 2, 10), 24 + 40},
+		{nil, pair{"foo", shared}, 24 + 3 + 8},
+		// What's shared is counted once
+		{nil, []pair{{"a", shared}, {"b", shared}}, 24 + 2*24 + 2 + 8},
+		{nil, map[string]int64{"ab": 1}, 8 + 24 + 2},
+		{nil, sized{}, 1 << 20},
+	} {
+		assert.Equal(t, test.want, EstimateSize(test.key, test.value), "%#v", test.value)
+	}
+}
+
+func TestSizeOf(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	load := func(ctx context.Context, key Key) (Value, error) {
+		if key == "bad" {
+			return nil, errors.New("an error")
+		}
+		return sized{}, nil
+	}
+	for _, c := range []Cache{
+		New(ctx, load, Every(period), Every(period)),
+		NewOnDemand(ctx, load, period, period),
+	} {
+		// The keys count too
+		const want = 1<<20 + 16 + 3
+		for _, key := range []Key{"foo", "bar"} {
+			_, e := c.Get(context.Background(), key)
+			assert.Nil(t, e)
+		}
+		_, e := c.Get(context.Background(), "bad")
+		assert.NotNil(t, e)
+
+		n, ok := c.SizeOf("foo")
+		assert.True(t, ok)
+		assert.Equal(t, int64(want), n)
+		_, ok = c.SizeOf("bad")
+		assert.False(t, ok)
+		_, ok = c.SizeOf("baz")
+		assert.False(t, ok)
+
+		sizes, total := c.Sizes()
+		assert.Equal(t, map[Key]int64{"foo": want, "bar": want}, sizes)
+		assert.Equal(t, int64(2*want), total)
+	}
+
+	// A weigher, if there is one, has the say
+	c := New(ctx, load, Every(period), Every(period), WithMaxWeight(100, func(key Key, value Value) int64 { return 3 }))
+	_, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	n, ok := c.SizeOf("foo")
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), n)
+
+	cancel()
+}
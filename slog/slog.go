@@ -0,0 +1,30 @@
+// Package slog adapts a log/slog logger to the cache's Logger, for
+// cache.WithLogger.
+//
+// It's a module of its own, github.com/jan-g/cache/slog, as log/slog needs
+// Go 1.21 while the cache itself needs only Go 1.19.
+package slog
+
+import (
+	"log/slog"
+
+	"github.com/jan-g/cache"
+)
+
+// New makes a Logger that logs to logger, with the cache's fields as its
+// attributes. The default logger, slog.Default(), will do.
+func New(logger *slog.Logger) cache.Logger {
+	return structured{logger}
+}
+
+type structured struct {
+	logger *slog.Logger
+}
+
+func (l structured) Debug(msg string, fields ...interface{}) {
+	l.logger.Debug(msg, fields...)
+}
+
+func (l structured) Warn(msg string, fields ...interface{}) {
+	l.logger.Warn(msg, fields...)
+}
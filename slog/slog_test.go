@@ -0,0 +1,29 @@
+package slog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jan-g/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := cache.New(ctx, func(ctx context.Context, key cache.Key) (cache.Value, error) {
+		return nil, errors.New("boom")
+	}, cache.Every(time.Hour), cache.Every(time.Hour), cache.WithLogger(New(logger)))
+	_, e := c.Get(context.Background(), "foo")
+	assert.NotNil(t, e)
+	assert.Nil(t, c.Close(context.Background()))
+
+	// The maintainer logs the refresh, with the key and error as attributes
+	assert.Contains(t, out.String(), `level=DEBUG msg="refreshed value" key=foo value=<nil> error=boom`)
+}
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are cumulative counts of cache activity.
+type Stats struct {
+	Hits               uint64        // Reads served from a loaded entry
+	Misses             uint64        // Reads that waited for a load
+	Refreshes          uint64        // Successful loads, initial or otherwise
+	RefreshErrors      uint64        // Failed loads
+	Evictions          uint64        // Entries dropped for want of use, after too many failures, or for room
+	Timeouts           uint64        // Refreshes abandoned for taking too long
+	Overflows          uint64        // Reads of keys beyond the limit set by WithKeyLimit
+	Demotions          uint64        // Evicted values kept in the cold store
+	Promotions         uint64        // Values brought back from it
+	Sweeps             uint64        // Passes of the sweeper
+	Swept              uint64        // Entries it reaped
+	Throttled          uint64        // Refreshes put off by the rate limit
+	Contention         uint64        // Waits for the locks striped by key, on loads and uses of keys, held by others
+	EvictionContention uint64        // Waits for the lock on the eviction policies, held by others
+	RefreshTime        time.Duration // The time that Refreshes and RefreshErrors took between them, retries and all
+	Entries            int           // Entries currently resident
+	Weight             int64         // Their total weight, if they're weighed
+	Maintainers        int           // Goroutines maintaining keys; none for caches that don't run one per key
+	Queued             int           // Loads waiting for a refresh worker, if WithRefreshWorkers limits them
+}
+
+// Counters, updated atomically
+type counters struct {
+	hits          uint64
+	misses        uint64
+	refreshes     uint64
+	refreshErrors uint64
+	evictions     uint64
+	timeouts      uint64
+	overflows     uint64
+	demotions     uint64
+	promotions    uint64
+	sweeps        uint64
+	reaped        uint64
+	throttles     uint64
+	refreshTime   uint64 // In nanoseconds
+}
+
+func (c *counters) read(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+func (c *counters) loaded(result r) {
+	if result.Err == nil {
+		atomic.AddUint64(&c.refreshes, 1)
+	} else {
+		atomic.AddUint64(&c.refreshErrors, 1)
+	}
+}
+
+func (c *counters) took(d time.Duration) {
+	atomic.AddUint64(&c.refreshTime, uint64(d))
+}
+
+func (c *counters) evicted() {
+	atomic.AddUint64(&c.evictions, 1)
+}
+
+func (c *counters) timedOut() {
+	atomic.AddUint64(&c.timeouts, 1)
+}
+
+func (c *counters) overflowed() {
+	atomic.AddUint64(&c.overflows, 1)
+}
+
+func (c *counters) demoted() {
+	atomic.AddUint64(&c.demotions, 1)
+}
+
+func (c *counters) promoted() {
+	atomic.AddUint64(&c.promotions, 1)
+}
+
+func (c *counters) swept(reaped int) {
+	atomic.AddUint64(&c.sweeps, 1)
+	atomic.AddUint64(&c.reaped, uint64(reaped))
+}
+
+func (c *counters) throttled() {
+	atomic.AddUint64(&c.throttles, 1)
+}
+
+func (cache *cache) Stats() Stats {
+	striped, eviction := cache.contention()
+	return Stats{
+		Hits:               atomic.LoadUint64(&cache.stats.hits),
+		Misses:             atomic.LoadUint64(&cache.stats.misses),
+		Refreshes:          atomic.LoadUint64(&cache.stats.refreshes),
+		RefreshErrors:      atomic.LoadUint64(&cache.stats.refreshErrors),
+		Evictions:          atomic.LoadUint64(&cache.stats.evictions),
+		Timeouts:           atomic.LoadUint64(&cache.stats.timeouts),
+		Overflows:          atomic.LoadUint64(&cache.stats.overflows),
+		Demotions:          atomic.LoadUint64(&cache.stats.demotions),
+		Promotions:         atomic.LoadUint64(&cache.stats.promotions),
+		Sweeps:             atomic.LoadUint64(&cache.stats.sweeps),
+		Swept:              atomic.LoadUint64(&cache.stats.reaped),
+		Throttled:          atomic.LoadUint64(&cache.stats.throttles),
+		Contention:         striped,
+		EvictionContention: eviction,
+		RefreshTime:        time.Duration(atomic.LoadUint64(&cache.stats.refreshTime)),
+		Entries:            cache.Len(),
+		Weight:             cache.weight(),
+		Maintainers:        int(atomic.LoadInt32(&cache.maintainers)),
+		Queued:             cache.workers.depth(),
+	}
+}
+
+// The sum of two sets of stats.
+func (s Stats) add(other Stats) Stats {
+	return Stats{
+		Hits:               s.Hits + other.Hits,
+		Misses:             s.Misses + other.Misses,
+		Refreshes:          s.Refreshes + other.Refreshes,
+		RefreshErrors:      s.RefreshErrors + other.RefreshErrors,
+		Evictions:          s.Evictions + other.Evictions,
+		Timeouts:           s.Timeouts + other.Timeouts,
+		Overflows:          s.Overflows + other.Overflows,
+		Demotions:          s.Demotions + other.Demotions,
+		Promotions:         s.Promotions + other.Promotions,
+		Sweeps:             s.Sweeps + other.Sweeps,
+		Swept:              s.Swept + other.Swept,
+		Throttled:          s.Throttled + other.Throttled,
+		Contention:         s.Contention + other.Contention,
+		EvictionContention: s.EvictionContention + other.EvictionContention,
+		RefreshTime:        s.RefreshTime + other.RefreshTime,
+		Entries:            s.Entries + other.Entries,
+		Weight:             s.Weight + other.Weight,
+		Maintainers:        s.Maintainers + other.Maintainers,
+		Queued:             s.Queued + other.Queued,
+	}
+}
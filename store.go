@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// A Store holds the entries a cache evicts to make room, as WithColdStore
+// arranges, so that they can be brought back without calling the refresher.
+// It should be safe for concurrent use.
+type Store interface {
+	// Put keeps a value for a key, replacing any it had.
+	Put(key Key, value Value) error
+	// Take removes and returns the value for a key, if there's one.
+	Take(key Key) (value Value, ok bool, err error)
+	// Delete removes any value for a key.
+	Delete(key Key) error
+}
+
+type diskStore struct {
+	dir string
+}
+
+// DiskStore makes a Store that keeps each value in a file of its own in the
+// given directory, encoded with encoding/gob. The concrete types of the keys
+// and values, if they're not built in, must be registered with gob.Register.
+func DiskStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &diskStore{dir: dir}, nil
+}
+
+// What's kept in each file: the key too, in case of a collision
+type record struct {
+	Key   Key
+	Value Value
+}
+
+func (s *diskStore) path(key Key) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%T\x00%v", key, key)))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *diskStore) Put(key Key, value Value) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&record{Key: key, Value: value}); err != nil {
+		return err
+	}
+	// Write it in full before it's seen
+	tmp, err := os.CreateTemp(s.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+func (s *diskStore) Take(key Key) (Value, bool, error) {
+	path := s.path(key)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	var rec record
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+		return nil, false, err
+	}
+	if rec.Key != key {
+		return nil, false, nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, err
+	}
+	return rec.Value, true, nil
+}
+
+func (s *diskStore) Delete(key Key) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Keep an evicted result in the cold store, if there's one. Errors aren't
+// worth keeping.
+func (cache *cache) demote(key Key, result r) {
+	if cache.coldStore == nil || result.Err != nil {
+		return
+	}
+	if err := cache.coldStore.Put(key, result.Value); err != nil {
+		cache.warn("failed to demote value", "key", key, "error", err)
+		return
+	}
+	cache.stats.demoted()
+}
+
+// Bring a key back from the cold store, if it's there.
+func (cache *cache) promote(key Key) (r, bool) {
+	if cache.coldStore == nil {
+		return r{}, false
+	}
+	value, ok, err := cache.coldStore.Take(key)
+	if err != nil {
+		cache.warn("failed to promote value", "key", key, "error", err)
+		return r{}, false
+	}
+	if !ok {
+		return r{}, false
+	}
+	cache.stats.promoted()
+	return r{Value: value}, true
+}
+
+// Forget a key in the cold store, if there's one.
+func (cache *cache) discard(key Key) {
+	if cache.coldStore == nil {
+		return
+	}
+	if err := cache.coldStore.Delete(key); err != nil {
+		cache.warn("failed to discard demoted value", "key", key, "error", err)
+	}
+}
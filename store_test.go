@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskStore(t *testing.T) {
+	s, err := DiskStore(t.TempDir())
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.Put("foo", 42))
+	assert.Nil(t, s.Put(1, "one"))
+	assert.Nil(t, s.Put("bar", "bar"))
+
+	// Keys are told apart by type as well as by value
+	_, ok, err := s.Take("1")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	v, ok, err := s.Take(1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "one", v)
+
+	// Taking a value removes it
+	v, ok, _ = s.Take("foo")
+	assert.True(t, ok)
+	assert.Equal(t, 42, v)
+	_, ok, _ = s.Take("foo")
+	assert.False(t, ok)
+
+	assert.Nil(t, s.Delete("bar"))
+	assert.Nil(t, s.Delete("bar"))
+	_, ok, _ = s.Take("bar")
+	assert.False(t, ok)
+}
+
+func TestColdStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := DiskStore(t.TempDir())
+	assert.Nil(t, err)
+	var loads int32
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		atomic.AddInt32(&loads, 1)
+		return key, nil
+	}, positive, negative, WithMaxEntries(1), WithColdStore(s))
+
+	for _, key := range []string{"foo", "bar", "foo"} {
+		v, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+		assert.Equal(t, key, v)
+	}
+
+	// The evicted key is brought back without being loaded again
+	assert.Equal(t, int32(2), atomic.LoadInt32(&loads))
+	assert.Equal(t, uint64(2), c.Stats().Demotions)
+	assert.Equal(t, uint64(1), c.Stats().Promotions)
+
+	// Unless it's been invalidated
+	assert.Nil(t, c.Invalidate(context.Background(), "bar"))
+	v, e := c.Get(context.Background(), "bar")
+	assert.Nil(t, e)
+	assert.Equal(t, "bar", v)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&loads))
+
+	cancel()
+}
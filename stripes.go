@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A mutex that counts the times it's found held and has to be waited for,
+// so that contention for it shows up in the stats.
+type meteredMutex struct {
+	sync.Mutex
+	waits uint64 // Counted atomically
+}
+
+func (m *meteredMutex) Lock() {
+	if !m.TryLock() {
+		atomic.AddUint64(&m.waits, 1)
+		m.Mutex.Lock()
+	}
+}
+
+func (m *meteredMutex) contention() uint64 {
+	return atomic.LoadUint64(&m.waits)
+}
+
+// The loads for readers that aren't given an entry, striped by the hash of
+// their keys as the entries are sharded, so that readers of different keys
+// seldom contend.
+type flightStripe struct {
+	meteredMutex
+	flights map[Key]*flight // Each shared by those reading its key
+	_       [40]byte        // Keeps neighbouring stripes off the same cache line
+}
+
+// The uses of keys, striped likewise, waiting to be noted by the eviction
+// policy. Readers add to them without taking the lock on the policy; they're
+// drained into it in batches, and before it's asked to choose a victim.
+type readStripe struct {
+	meteredMutex
+	keys []Key
+	_    [24]byte
+}
+
+// How many uses a stripe holds before they're drained
+const readBatch = 16
+
+// The contention for the cache's locks: the waits for its striped locks,
+// and for the lock on its eviction policies.
+func (cache *cache) contention() (striped, eviction uint64) {
+	for i := range cache.flights {
+		striped += cache.flights[i].contention()
+	}
+	if cache.capacity != nil {
+		policies, reads := cache.capacity.contention()
+		striped += reads
+		eviction = policies
+	}
+	return striped, eviction
+}
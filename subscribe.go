@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"context"
+)
+
+// A subscriber to the values of an entry. The maintainer feeds in until ctx
+// is done, then forgets the subscriber.
+type subscriber struct {
+	ctx   context.Context
+	in    chan Value
+	taken chan struct{} // Closed as the maintainer of one of New's entries takes it
+}
+
+func (cache *cache) Subscribe(ctx context.Context, key Key) (<-chan Value, error) {
+	key = cache.canonical(key)
+	sub := &subscriber{ctx: ctx, in: make(chan Value), taken: make(chan struct{})}
+	out := make(chan Value)
+	go relay(ctx, sub.in, out)
+	for {
+		e, _, err := cache.entryWith(ctx, key, nil, cache.refresher)
+		if err != nil {
+			close(sub.in)
+			return nil, err
+		}
+		if ok, err := e.send(ctx, sub, sub.taken); err != nil {
+			close(sub.in)
+			return nil, err
+		} else if ok {
+			return out, nil
+		}
+	}
+}
+
+// Relay values from in to out, queueing as many as necessary so that
+// whoever feeds in is never held up. out is closed once in has been closed
+// and drained, or as soon as ctx is done.
+func relay(ctx context.Context, in <-chan Value, out chan<- Value) {
+	defer close(out)
+	var queue []Value
+	for in != nil || len(queue) > 0 {
+		var send chan<- Value
+		var next Value
+		if len(queue) > 0 {
+			send, next = out, queue[0]
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case v, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue = append(queue, v)
+		case send <- next:
+			queue = queue[1:]
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package cache
+
+// Periodically reap the entries whose values have expired, or that are in
+// quarantine, whether or not anyone reads them.
+func (cache *cache) sweeper() {
+	defer cache.running.Done()
+	timer := cache.clock.NewTimer(cache.sweepEvery)
+	defer timer.Stop()
+	for {
+		select {
+		case <-cache.ctx.Done():
+			return
+		case <-timer.C():
+			b := cache.newBatch()
+			reaped := cache.reap(b)
+			cache.deliver(cache.ctx, b)
+			cache.debug("swept", "entries", reaped)
+			cache.stats.swept(reaped)
+			cache.hooks.swept(reaped)
+			timer.Reset(cache.sweepEvery)
+		}
+	}
+}
+
+// Stop the maintainers of entries that have had values and lost them, or
+// that are in quarantine, reporting their removals in the batch given.
+func (cache *cache) reapEntries(b *batch) int {
+	reaped := 0
+	cache.kv.Range(func(k, v interface{}) bool {
+		if cache.isPinned(k) {
+			return true
+		}
+		e := v.(*entry)
+		_, info, loaded := e.status()
+		var reason Reason
+		switch {
+		case info.Quarantined:
+			reason = ReasonFailure
+		case !loaded && (!info.Refreshed.IsZero() || info.Errors > 0):
+			reason = ReasonExpired
+		default:
+			return true
+		}
+		e.join(b)
+		e.stopFor(reason)
+		cache.stats.evicted()
+		cache.hooks.evicted(k, nil)
+		reaped++
+		return true
+	})
+	return reaped
+}
+
+// Drop the entries whose values have gone stale, bar those being loaded or
+// subscribed to, reporting their removals in the batch given.
+func (c *onDemand) reap(b *batch) int {
+	now := c.cache.clock.Now()
+	reaped := 0
+	c.cache.kv.Range(func(k, v interface{}) bool {
+		if c.cache.isPinned(k) {
+			return true
+		}
+		d := v.(*demand)
+		d.mu.Lock()
+		d.prune()
+		stale := d.loaded && now.UnixNano() >= d.expires && d.load == nil && !d.subscribed() && !d.dropped
+		value := d.result.Value
+		if stale {
+			c.drop(k, d)
+		}
+		d.mu.Unlock()
+		if stale {
+			c.cache.stats.evicted()
+			c.cache.hooks.evicted(k, value)
+			c.cache.removed(k, value, ReasonExpired, b)
+			reaped++
+		}
+		return true
+	})
+	return reaped
+}
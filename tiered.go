@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// A cache in two tiers: the keys read most often are maintained, and the
+// rest are loaded on demand
+type tiered struct {
+	hot  *cache
+	cold *onDemand
+}
+
+// NewTiered constructs a cache that keeps up to hot of its keys, those read
+// most often, in a hot tier that works as New's caches do, refreshing them
+// in the background with a maintainer each. The long tail of keys is kept
+// in a cold tier that works as NewOnDemand's caches do, running no
+// goroutine per key and reloading values once they're older than ttl (or
+// negativeTTL, for an error).
+//
+// A key is promoted to the hot tier once it's read more often than the hot
+// key that would make way for it, as WithTinyLFU reckons it, taking its value
+// with it. That key is demoted to the cold tier with its value in turn, and
+// is reported as evicted from the hot one. Keys that are set, updated and so
+// on stay in the tier they're in, or go to the cold one; those subscribed to
+// or pinned go to the hot one.
+//
+// The options apply to each tier, except that the hot tier is bounded by hot
+// alone, and keeps a maintainer per key regardless of WithExpiryHeap;
+// SetMaxEntries and SetMaxWeight change the bounds of the cold one.
+// Stats are those of the two tiers together, with the moves between them
+// counted as demotions and promotions.
+func NewTiered(ctx context.Context, refresher Refresher, positive func() Backoff, negative func() Backoff, ttl, negativeTTL time.Duration, hot int, opts ...Option) Cache {
+	cold := NewOnDemand(ctx, refresher, ttl, negativeTTL, opts...).(*onDemand)
+	opts = append(opts[:len(opts):len(opts)], WithMaxEntries(hot), WithTinyLFU(), WithColdStore(coldTier{cold}), WithExpiryHeap(0), func(c *cache) {
+		// Both tiers' errors are published together, under the one name
+		c.export = cold.cache.export
+	})
+	t := &tiered{
+		hot:  New(ctx, refresher, positive, negative, opts...).(*cache),
+		cold: cold,
+	}
+	// In place of either tier alone
+	t.hot.publish(t)
+	return t
+}
+
+// The cold tier, as the Store that the hot tier demotes keys to and
+// promotes them from
+type coldTier struct {
+	*onDemand
+}
+
+func (t coldTier) Put(key Key, value Value) error {
+	return t.Set(t.cache.ctx, key, value)
+}
+
+// Take a key out of the cold tier, with its value if that's still fresh.
+// One that's being loaded is left where it is, for the sake of those
+// waiting on it.
+func (t coldTier) Take(key Key) (Value, bool, error) {
+	v, ok := t.cache.kv.Load(key)
+	if !ok {
+		return nil, false, nil
+	}
+	d := v.(*demand)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.load != nil || !t.drop(key, d) {
+		return nil, false, nil
+	}
+	fresh := d.loaded && d.result.Err == nil && t.cache.clock.Now().UnixNano() < d.expires
+	return d.result.Value, fresh, nil
+}
+
+func (t coldTier) Delete(key Key) error {
+	if v, ok := t.cache.kv.Load(key); ok {
+		d := v.(*demand)
+		d.mu.Lock()
+		t.drop(key, d)
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+// Whether a key is in the hot tier.
+func (t *tiered) isHot(key Key) bool {
+	_, ok := t.hot.kv.Load(key)
+	return ok
+}
+
+// The tier to read a key from: the hot one, if it's there or is read often
+// enough to be promoted to it, and the cold one otherwise; or the error the
+// hot one turns the read away with. The read is counted as it's admitted, so
+// the hot tier doesn't count it again once it finds the key.
+func (t *tiered) read(key Key, loader Refresher) (Cache, error) {
+	key = t.hot.canonical(key)
+	if t.isHot(key) {
+		return t.hot, nil
+	}
+	refuse, err := t.hot.refuse(key)
+	if err != nil {
+		return nil, err
+	}
+	if refuse {
+		return t.cold, nil
+	}
+	// Start the key's maintainer, which takes its value from the cold tier
+	if e, started, err := t.hot.entryWith(nil, key, nil, loader); err == nil && started {
+		e.set(admittedFlag)
+	}
+	return t.hot, nil
+}
+
+// The tier a key is in, if it's resident: the hot one or, failing that, the
+// cold one.
+func (t *tiered) tier(key Key) Cache {
+	key = t.hot.canonical(key)
+	if t.isHot(key) {
+		return t.hot
+	}
+	return t.cold
+}
+
+func (t *tiered) Get(ctx context.Context, key Key, opts ...GetOption) (Value, error) {
+	c, err := t.read(key, t.hot.refresher)
+	if err != nil {
+		return nil, err
+	}
+	return c.Get(ctx, key, opts...)
+}
+
+func (t *tiered) GetIfPresent(key Key) (Value, bool) {
+	return t.tier(key).GetIfPresent(key)
+}
+
+func (t *tiered) GetOrLoad(ctx context.Context, key Key, loader Refresher) (Value, error) {
+	c, err := t.read(key, loader)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetOrLoad(ctx, key, loader)
+}
+
+func (t *tiered) GetWithInfo(ctx context.Context, key Key) (Value, Info, error) {
+	c, err := t.read(key, t.hot.refresher)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	return c.GetWithInfo(ctx, key)
+}
+
+func (t *tiered) Set(ctx context.Context, key Key, value Value) error {
+	return t.tier(key).Set(ctx, key, value)
+}
+
+func (t *tiered) SetWithError(ctx context.Context, key Key, value Value, err error) error {
+	return t.tier(key).SetWithError(ctx, key, value, err)
+}
+
+func (t *tiered) Update(ctx context.Context, key Key, fn func(old Value) (Value, error)) (Value, error) {
+	return t.tier(key).Update(ctx, key, fn)
+}
+
+func (t *tiered) Subscribe(ctx context.Context, key Key) (<-chan Value, error) {
+	return t.hot.Subscribe(ctx, key)
+}
+
+func (t *tiered) Warm(ctx context.Context, keys ...Key) error {
+	return warm(ctx, t, keys)
+}
+
+func (t *tiered) Invalidate(ctx context.Context, key Key) error {
+	if err := t.cold.Invalidate(ctx, key); err != nil {
+		return err
+	}
+	return t.hot.Invalidate(ctx, key)
+}
+
+func (t *tiered) Pin(ctx context.Context, key Key) error {
+	return t.hot.Pin(ctx, key)
+}
+
+func (t *tiered) Unpin(key Key) {
+	t.hot.Unpin(key)
+}
+
+func (t *tiered) Refresh(ctx context.Context, key Key) error {
+	return t.tier(key).Refresh(ctx, key)
+}
+
+func (t *tiered) RefreshAndGet(ctx context.Context, key Key) (Value, error) {
+	return t.tier(key).RefreshAndGet(ctx, key)
+}
+
+func (t *tiered) Purge() {
+	t.hot.Purge()
+	t.cold.Purge()
+}
+
+func (t *tiered) SetMaxEntries(n int) error {
+	return t.cold.SetMaxEntries(n)
+}
+
+func (t *tiered) SetMaxWeight(budget int64) error {
+	return t.cold.SetMaxWeight(budget)
+}
+
+func (t *tiered) Keys() []Key {
+	return append(t.hot.Keys(), t.cold.Keys()...)
+}
+
+func (t *tiered) Len() int {
+	return t.hot.Len() + t.cold.Len()
+}
+
+func (t *tiered) Range(f func(key Key, value Value, err error) bool) {
+	more := true
+	t.hot.Range(func(key Key, value Value, err error) bool {
+		more = f(key, value, err)
+		return more
+	})
+	if more {
+		t.cold.Range(f)
+	}
+}
+
+func (t *tiered) Snapshot() map[Key]Value {
+	return snapshot(t)
+}
+
+func (t *tiered) SizeOf(key Key) (int64, bool) {
+	return t.tier(key).SizeOf(key)
+}
+
+func (t *tiered) Sizes() (map[Key]int64, int64) {
+	return sizes(t, t.hot.size)
+}
+
+func (t *tiered) Stats() Stats {
+	return t.hot.Stats().add(t.cold.Stats())
+}
+
+func (t *tiered) Close(ctx context.Context) error {
+	hotErr := t.hot.Close(ctx)
+	coldErr := t.cold.Close(ctx)
+	if hotErr != nil {
+		return hotErr
+	}
+	return coldErr
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTiered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var loads int32
+	c := NewTiered(ctx, func(ctx context.Context, key Key) (Value, error) {
+		atomic.AddInt32(&loads, 1)
+		return key, nil
+	}, positive, negative, time.Hour, time.Hour, 2)
+	tiers := c.(*tiered)
+	get := func(key string) {
+		v, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+		assert.Equal(t, key, v)
+	}
+
+	// The hot tier takes keys while it has room; the rest go to the cold one.
+	// Those in the hot tier are read twice, so that a newcomer's first read
+	// can't outweigh them even if the doorkeeper mistakes it for a second.
+	for _, key := range []string{"foo", "foo", "bar", "bar", "baz"} {
+		get(key)
+	}
+	assert.ElementsMatch(t, []Key{"foo", "bar"}, tiers.hot.Keys())
+	assert.Equal(t, []Key{"baz"}, tiers.cold.Keys())
+	assert.Equal(t, 3, c.Len())
+
+	// A cold key that's read often enough is promoted, taking its value with
+	// it, and a hot one is demoted to make way
+	for i := 0; i < 4; i++ {
+		get("baz")
+	}
+	assert.Contains(t, tiers.hot.Keys(), "baz")
+	assert.Eventually(t, func() bool { return tiers.hot.Len() == 2 }, period, period/10)
+	assert.Equal(t, []Key{"foo"}, tiers.cold.Keys())
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Promotions)
+	assert.Equal(t, uint64(1), stats.Demotions)
+	assert.Equal(t, 3, stats.Entries)
+
+	// The demoted key is served from the cold tier without a reload
+	get("foo")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&loads))
+
+	// Keys are invalidated in whichever tier they're in
+	assert.Nil(t, c.Invalidate(context.Background(), "foo"))
+	assert.Nil(t, c.Invalidate(context.Background(), "baz"))
+	assert.Eventually(t, func() bool { return c.Len() == 1 }, period, period/10)
+	assert.Equal(t, []Key{"bar"}, c.Keys())
+
+	cancel()
+}
+
+func TestTieredCountsReadsOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewTiered(ctx, func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, time.Hour, time.Hour, 1)
+	tiers := c.(*tiered)
+	reads := func() int {
+		capacity := tiers.hot.capacity
+		capacity.mu.Lock()
+		defer capacity.mu.Unlock()
+		capacity.drain()
+		return capacity.filter.reads
+	}
+
+	// A read is counted once, whether it's admitted to the hot tier, sent to
+	// the cold one, or finds the key hot already
+	for i, key := range []string{"foo", "bar", "foo", "bar"} {
+		_, e := c.Get(context.Background(), key)
+		assert.Nil(t, e)
+		assert.Equal(t, i+1, reads())
+	}
+}
+
+func TestTieredExpvar(t *testing.T) {
+	c := NewTiered(context.Background(), func(ctx context.Context, key Key) (Value, error) {
+		return key, nil
+	}, positive, negative, time.Hour, time.Hour, 1, WithExpvar("tiered", nil))
+	_, _ = c.Get(context.Background(), "foo")
+	_, _ = c.Get(context.Background(), "bar")
+
+	// The tiers are published as one
+	exported := expvar.Get("cache").(*expvar.Map)
+	var published struct{ Misses uint64 }
+	assert.Nil(t, json.Unmarshal([]byte(exported.Get("tiered").String()), &published))
+	assert.Equal(t, uint64(2), published.Misses)
+
+	assert.Nil(t, c.Close(context.Background()))
+	assert.Nil(t, exported.Get("tiered"))
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"hash/maphash"
+)
+
+// A TinyLFU admission filter: it estimates how often each key has been
+// read recently, so that a newcomer only displaces a resident key that's
+// read less often than it is. A doorkeeper (a Bloom filter) absorbs the
+// first read of each key, so that the many keys read just once don't crowd
+// the frequency sketch.
+type tinyLFU struct {
+	seed       maphash.Seed
+	sketch     [4][]uint8 // A count-min sketch; each row is indexed by a different hash
+	doorkeeper []uint64   // Bitset
+	mask       uint64     // Width of the rows and the doorkeeper, less one
+	reads      int        // Since counts were last halved
+	sample     int        // How many reads to take between halvings
+}
+
+func newTinyLFU(max int) *tinyLFU {
+	width := uint64(64)
+	for width < uint64(4*max) {
+		width *= 2
+	}
+	f := &tinyLFU{
+		seed:       maphash.MakeSeed(),
+		doorkeeper: make([]uint64, width/64),
+		mask:       width - 1,
+		sample:     10 * max,
+	}
+	for i := range f.sketch {
+		f.sketch[i] = make([]uint8, width)
+	}
+	return f
+}
+
+func (f *tinyLFU) hash(key Key) uint64 {
+	return hashKey(f.seed, key)
+}
+
+// The position in each row of the sketch, or of the doorkeeper's bits, for a
+// hash. Each is mixed afresh, so that keys that share one position needn't
+// share the others too; those of the doorkeeper follow those of the rows.
+func (f *tinyLFU) index(h uint64, i int) uint64 {
+	h += uint64(i+1) * 0x9e3779b97f4a7c15
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h & f.mask
+}
+
+// Note a read of a key.
+func (f *tinyLFU) record(key Key) {
+	h := f.hash(key)
+	if !f.admitted(h) {
+		// The doorkeeper lets a key past once it has been seen before
+		for i := len(f.sketch); i < len(f.sketch)+2; i++ {
+			bit := f.index(h, i)
+			f.doorkeeper[bit/64] |= 1 << (bit % 64)
+		}
+	} else {
+		for i := range f.sketch {
+			if c := &f.sketch[i][f.index(h, i)]; *c < 15 {
+				*c++
+			}
+		}
+	}
+	if f.reads++; f.reads >= f.sample {
+		f.age()
+	}
+}
+
+func (f *tinyLFU) admitted(h uint64) bool {
+	for i := len(f.sketch); i < len(f.sketch)+2; i++ {
+		bit := f.index(h, i)
+		if f.doorkeeper[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Estimate how often a key has been read recently.
+func (f *tinyLFU) estimate(key Key) int {
+	h := f.hash(key)
+	if !f.admitted(h) {
+		return 0
+	}
+	n := uint8(15)
+	for i := range f.sketch {
+		if c := f.sketch[i][f.index(h, i)]; c < n {
+			n = c
+		}
+	}
+	return int(n) + 1
+}
+
+// Halve the counts, and clear the doorkeeper, so that old reads count for less.
+func (f *tinyLFU) age() {
+	f.reads = 0
+	for i := range f.sketch {
+		for j := range f.sketch[i] {
+			f.sketch[i][j] /= 2
+		}
+	}
+	for i := range f.doorkeeper {
+		f.doorkeeper[i] = 0
+	}
+}
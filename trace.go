@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// A Tracer follows the cache's loads, as WithTracer arranges: with the spans
+// of OpenTelemetry, say, as the otel package does.
+type Tracer interface {
+	// StartLoad is called as a load begins, with the context that the
+	// refresher is to be called with. It returns the context to call it
+	// with instead, and a function to call with the outcome once the load,
+	// retries and all, is over.
+	StartLoad(ctx context.Context, load Load) (context.Context, func(value Value, err error))
+}
+
+// What a Tracer is told of a load.
+type Load struct {
+	Key Key
+	// Reader is the context of the caller the load was made for, such as a
+	// reader waiting on it or one that called Refresh, or nil for a refresh
+	// made in the background. Loads are shared, so others may be waiting
+	// on it too, and most go on should the reader give up.
+	Reader context.Context
+	// Stale says whether the load replaces a value that's gone stale, one
+	// that's Age old; if not, it's the key's first, or follows an error.
+	Stale bool
+	Age   time.Duration
+}
+
+// Two Tracers, the outer first
+type tracers [2]Tracer
+
+func (t tracers) StartLoad(ctx context.Context, load Load) (context.Context, func(Value, error)) {
+	ctx, outer := t[0].StartLoad(ctx, load)
+	ctx, inner := t[1].StartLoad(ctx, load)
+	return ctx, func(value Value, err error) {
+		inner(value, err)
+		outer(value, err)
+	}
+}
+
+// The reader and age of a load, carried by its context to the Tracer
+type traceKey struct{}
+
+// Note the reader a load is made for, and the age of the value it replaces
+// (if refreshed is non-zero), for the Tracer.
+func (cache *cache) traceFor(ctx, reader context.Context, refreshed time.Time) context.Context {
+	if cache.tracer == nil {
+		return ctx
+	}
+	load := Load{Reader: reader, Stale: !refreshed.IsZero()}
+	if load.Stale {
+		load.Age = cache.since(refreshed)
+	}
+	return context.WithValue(ctx, traceKey{}, load)
+}
+
+// Start tracing a load, if there's a Tracer.
+func (cache *cache) trace(ctx context.Context, key Key) (context.Context, func(Value, error)) {
+	if cache.tracer == nil {
+		return ctx, nil
+	}
+	load, _ := ctx.Value(traceKey{}).(Load)
+	load.Key = key
+	return cache.tracer.StartLoad(ctx, load)
+}
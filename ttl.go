@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// A value that dictates when it should next be refreshed
+type ttlValue struct {
+	Value
+	ttl time.Duration
+}
+
+// ValueWithTTL wraps a value returned from a refresher (or passed to Set) so
+// that the next refresh happens after the given interval, rather than
+// whenever the positive backoff would have it. Readers see only the value.
+func ValueWithTTL(value Value, ttl time.Duration) Value {
+	return ttlValue{Value: value, ttl: ttl}
+}
+
+// A TTLRefresher is a Refresher that reports how long each value is good for.
+type TTLRefresher func(ctx context.Context, key Key) (value Value, ttl time.Duration, err error)
+
+// FromTTLRefresher adapts a TTLRefresher to a Refresher. A zero ttl leaves
+// the positive backoff to schedule the next refresh.
+func FromTTLRefresher(refresher TTLRefresher) Refresher {
+	return func(ctx context.Context, key Key) (Value, error) {
+		value, ttl, err := refresher(ctx, key)
+		if err != nil || ttl == 0 {
+			return value, err
+		}
+		return ValueWithTTL(value, ttl), nil
+	}
+}
+
+// An Expirer is a value that carries its own expiry time, such as a
+// certificate or a token. When a refresher returns one, the next refresh is
+// scheduled for when it expires, rather than by the positive backoff. One
+// that has already expired leaves the positive backoff in charge.
+type Expirer interface {
+	ExpiresAt() time.Time
+}
+
+// Package up a result, unwrapping any TTL that comes with the value, and
+// moving it off the heap if it's to be kept there.
+func (cache *cache) result(value Value, err error) r {
+	if t, ok := value.(ttlValue); ok {
+		return cache.stow(r{Value: t.Value, Err: err, ttl: t.ttl})
+	}
+	if x, ok := value.(Expirer); ok && err == nil {
+		if ttl := x.ExpiresAt().Sub(cache.clock.Now()); ttl > 0 {
+			return cache.stow(r{Value: value, ttl: ttl})
+		}
+	}
+	return cache.stow(r{Value: value, Err: err})
+}
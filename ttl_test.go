@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTLRefresher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	i := 0
+	clock := newFakeClock()
+	c := New(ctx, FromTTLRefresher(func(ctx context.Context, key Key) (Value, time.Duration, error) {
+		i++
+		// Each value is good for less time than the last
+		return i, time.Duration(4-i) * period, nil
+	}), positive, negative, WithClock(clock))
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	clock.Sleep(5 * period / 2)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	clock.Sleep(period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v)
+
+	clock.Sleep(2 * period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 3, v)
+
+	cancel()
+}
+
+func TestSetWithTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	c := New(ctx, (&refresher{}).refresh, positive, negative, WithClock(clock))
+
+	assert.Nil(t, c.Set(context.Background(), "foo", ValueWithTTL(42, period)))
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 42, v)
+
+	clock.Sleep(3 * period / 2)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v)
+
+	cancel()
+}
+
+type token struct {
+	n       int
+	expires time.Time
+}
+
+func (t token) ExpiresAt() time.Time {
+	return t.expires
+}
+
+func TestExpirer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	i := 0
+	clock := newFakeClock()
+	c := New(ctx, func(ctx context.Context, key Key) (Value, error) {
+		i++
+		return token{n: i, expires: clock.Now().Add(3 * period / 2)}, nil
+	}, Every(10*period), Every(10*period), WithClock(clock))
+
+	v, e := c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v.(token).n)
+
+	// The token is refreshed as it expires, well before the positive backoff would have it
+	clock.Sleep(period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 1, v.(token).n)
+
+	clock.Sleep(period)
+	v, e = c.Get(context.Background(), "foo")
+	assert.Nil(t, e)
+	assert.Equal(t, 2, v.(token).n)
+
+	cancel()
+}
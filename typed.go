@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"context"
+)
+
+// Typed is a Cache whose keys and values carry their static types, so
+// callers don't need to type-assert the results of Get.
+type Typed[K comparable, V any] interface {
+	Get(ctx context.Context, key K, opts ...GetOption) (V, error)
+	GetOrLoad(ctx context.Context, key K, loader func(ctx context.Context, key K) (V, error)) (V, error)
+	GetIfPresent(K) (V, bool)
+	GetWithInfo(ctx context.Context, key K) (V, Info, error)
+	Set(ctx context.Context, key K, value V) error
+	SetWithError(ctx context.Context, key K, value V, err error) error
+	Update(ctx context.Context, key K, fn func(old V) (V, error)) (V, error)
+	Subscribe(ctx context.Context, key K) (<-chan V, error)
+	Warm(ctx context.Context, keys ...K) error
+	Invalidate(ctx context.Context, key K) error
+	Pin(ctx context.Context, key K) error
+	Unpin(key K)
+	Refresh(ctx context.Context, key K) error
+	RefreshAndGet(ctx context.Context, key K) (V, error)
+	Purge()
+	SetMaxEntries(n int) error
+	SetMaxWeight(budget int64) error
+	Keys() []K
+	Len() int
+	Range(f func(key K, value V, err error) bool)
+	Snapshot() map[K]V
+	SizeOf(key K) (int64, bool)
+	Sizes() (sizes map[K]int64, total int64)
+	Stats() Stats
+	Close(ctx context.Context) error
+}
+
+type typed[K comparable, V any] struct {
+	cache Cache
+}
+
+// NewTyped constructs a Typed cache around the given refresher. The
+// backoffs and options behave as they do for New.
+func NewTyped[K comparable, V any](ctx context.Context, refresher func(ctx context.Context, key K) (V, error), positive func() Backoff, negative func() Backoff, opts ...Option) Typed[K, V] {
+	return &typed[K, V]{
+		cache: New(ctx, untyped(refresher), positive, negative, opts...),
+	}
+}
+
+// untyped adapts a typed refresher to the Refresher signature.
+func untyped[K comparable, V any](refresher func(ctx context.Context, key K) (V, error)) Refresher {
+	return func(ctx context.Context, key Key) (Value, error) {
+		return refresher(ctx, key.(K))
+	}
+}
+
+func (t *typed[K, V]) Get(ctx context.Context, key K, opts ...GetOption) (V, error) {
+	v, err := t.cache.Get(ctx, key, opts...)
+	return value[V](v), err
+}
+
+func (t *typed[K, V]) GetOrLoad(ctx context.Context, key K, loader func(ctx context.Context, key K) (V, error)) (V, error) {
+	v, err := t.cache.GetOrLoad(ctx, key, untyped(loader))
+	return value[V](v), err
+}
+
+func (t *typed[K, V]) GetIfPresent(key K) (V, bool) {
+	v, ok := t.cache.GetIfPresent(key)
+	return value[V](v), ok
+}
+
+func (t *typed[K, V]) GetWithInfo(ctx context.Context, key K) (V, Info, error) {
+	v, info, err := t.cache.GetWithInfo(ctx, key)
+	return value[V](v), info, err
+}
+
+func (t *typed[K, V]) Set(ctx context.Context, key K, value V) error {
+	return t.cache.Set(ctx, key, value)
+}
+
+func (t *typed[K, V]) SetWithError(ctx context.Context, key K, value V, err error) error {
+	return t.cache.SetWithError(ctx, key, value, err)
+}
+
+func (t *typed[K, V]) Update(ctx context.Context, key K, fn func(old V) (V, error)) (V, error) {
+	v, err := t.cache.Update(ctx, key, func(old Value) (Value, error) {
+		return fn(value[V](old))
+	})
+	return value[V](v), err
+}
+
+func (t *typed[K, V]) Subscribe(ctx context.Context, key K) (<-chan V, error) {
+	values, err := t.cache.Subscribe(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan V)
+	go func() {
+		defer close(out)
+		for v := range values {
+			select {
+			case out <- value[V](v):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (t *typed[K, V]) Warm(ctx context.Context, keys ...K) error {
+	untyped := make([]Key, len(keys))
+	for i, k := range keys {
+		untyped[i] = k
+	}
+	return t.cache.Warm(ctx, untyped...)
+}
+
+func (t *typed[K, V]) Invalidate(ctx context.Context, key K) error {
+	return t.cache.Invalidate(ctx, key)
+}
+
+func (t *typed[K, V]) Pin(ctx context.Context, key K) error {
+	return t.cache.Pin(ctx, key)
+}
+
+func (t *typed[K, V]) Unpin(key K) {
+	t.cache.Unpin(key)
+}
+
+func (t *typed[K, V]) Refresh(ctx context.Context, key K) error {
+	return t.cache.Refresh(ctx, key)
+}
+
+func (t *typed[K, V]) RefreshAndGet(ctx context.Context, key K) (V, error) {
+	v, err := t.cache.RefreshAndGet(ctx, key)
+	return value[V](v), err
+}
+
+func (t *typed[K, V]) Purge() {
+	t.cache.Purge()
+}
+
+func (t *typed[K, V]) SetMaxEntries(n int) error {
+	return t.cache.SetMaxEntries(n)
+}
+
+func (t *typed[K, V]) SetMaxWeight(budget int64) error {
+	return t.cache.SetMaxWeight(budget)
+}
+
+func (t *typed[K, V]) Keys() []K {
+	var keys []K
+	for _, k := range t.cache.Keys() {
+		keys = append(keys, k.(K))
+	}
+	return keys
+}
+
+func (t *typed[K, V]) Len() int {
+	return t.cache.Len()
+}
+
+func (t *typed[K, V]) Range(f func(key K, value V, err error) bool) {
+	t.cache.Range(func(k Key, v Value, err error) bool {
+		return f(k.(K), value[V](v), err)
+	})
+}
+
+func (t *typed[K, V]) Snapshot() map[K]V {
+	snapshot := map[K]V{}
+	for k, v := range t.cache.Snapshot() {
+		snapshot[k.(K)] = value[V](v)
+	}
+	return snapshot
+}
+
+func (t *typed[K, V]) SizeOf(key K) (int64, bool) {
+	return t.cache.SizeOf(key)
+}
+
+func (t *typed[K, V]) Sizes() (map[K]int64, int64) {
+	untyped, total := t.cache.Sizes()
+	sizes := map[K]int64{}
+	for k, n := range untyped {
+		sizes[k.(K)] = n
+	}
+	return sizes, total
+}
+
+func (t *typed[K, V]) Stats() Stats {
+	return t.cache.Stats()
+}
+
+func (t *typed[K, V]) Close(ctx context.Context) error {
+	return t.cache.Close(ctx)
+}
+
+// value unboxes a Value; a nil Value (typically accompanying an error)
+// becomes the zero V.
+func value[V any](v Value) V {
+	tv, _ := v.(V)
+	return tv
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"context"
+)
+
+// The readers waiting for an entry to have a value share a gate, which is
+// opened for all of them at once as the value is published. None waits on
+// another, so however many there are, each is released as soon as the
+// scheduler gets to it.
+type gate struct {
+	open    chan struct{} // Closed once result is in
+	result  r
+	waiting int // Readers that have come to it; guarded by the entry's mu
+}
+
+// Come to the gate of readers waiting for the entry to have a value; or, if
+// it has one already, report false.
+func (e *entry) await() (*gate, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.loaded() {
+		return nil, false
+	}
+	if e.gate == nil {
+		e.gate = &gate{open: make(chan struct{})}
+	}
+	e.gate.waiting++
+	return e.gate, true
+}
+
+// Release the waiting readers with the result just published.
+func (e *entry) release(result r) {
+	e.mu.Lock()
+	g := e.gate
+	e.gate = nil
+	e.mu.Unlock()
+	if g != nil {
+		g.result = result
+		close(g.open)
+	}
+}
+
+// Wait at the gate for the entry's value, reporting false if the maintainer
+// exits first.
+func (cache *cache) queue(ctx context.Context, e *entry, g *gate) (r, bool, error) {
+	select {
+	case <-g.open:
+	case <-ctx.Done():
+		return r{}, false, ctx.Err()
+	case <-e.done:
+		// It may have been released on the way out
+		select {
+		case <-g.open:
+		default:
+			return r{}, false, nil
+		}
+	}
+	cache.touch(e)
+	cache.stats.read(false)
+	return g.result, true, nil
+}
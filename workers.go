@@ -0,0 +1,233 @@
+package cache
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The loads waiting for one of a bounded pool of workers, as
+// WithRefreshWorkers arranges, those of the keys read most first. With
+// WithAdaptiveRefreshWorkers, how many of the workers may run loads at once
+// follows how the refresher is faring.
+type workQueue struct {
+	mu     sync.Mutex
+	jobs   jobs
+	queued uint64        // Counts jobs, to keep those of equal heat in order
+	closed bool          // Once the workers have gone, jobs run by themselves
+	ready  chan struct{} // Nudged when there's a job for a worker
+
+	limit    int           // How many jobs may run at once
+	max      int           // The most that may ever
+	active   int           // How many are running
+	adaptive bool          // Whether the limit adapts
+	latency  time.Duration // How long a healthy load may take; zero for any time
+	gained   int           // Healthy loads since the limit was last raised
+	epoch    uint64        // Counts cuts to the limit
+}
+
+type job struct {
+	run   func() (healthy bool)
+	heat  int // How often its key has been read of late
+	seq   uint64
+	epoch uint64 // The epoch it was taken in
+}
+
+// A heap of jobs, the hottest first, and otherwise the first queued
+type jobs []job
+
+func (q jobs) Len() int { return len(q) }
+func (q jobs) Less(i, j int) bool {
+	if q[i].heat != q[j].heat {
+		return q[i].heat > q[j].heat
+	}
+	return q[i].seq < q[j].seq
+}
+func (q jobs) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *jobs) Push(x interface{}) { *q = append(*q, x.(job)) }
+func (q *jobs) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	old[len(old)-1] = job{}
+	*q = old[:len(old)-1]
+	return x
+}
+
+func newWorkQueue(n int, adaptive bool, latency time.Duration) *workQueue {
+	return &workQueue{
+		ready:    make(chan struct{}, 1),
+		limit:    n,
+		max:      n,
+		adaptive: adaptive,
+		latency:  latency,
+	}
+}
+
+// How many jobs are waiting; none, if there's no queue.
+func (q *workQueue) depth() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+func (q *workQueue) add(run func() bool, heat int) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		go run()
+		return
+	}
+	q.queued++
+	heap.Push(&q.jobs, job{run: run, heat: heat, seq: q.queued})
+	q.mu.Unlock()
+	q.nudge()
+}
+
+func (q *workQueue) nudge() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Take the next job, if there is one and the limit allows it, nudging
+// another worker if there are more.
+func (q *workQueue) take() (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.jobs) == 0 || q.active >= q.limit {
+		return job{}, false
+	}
+	next := heap.Pop(&q.jobs).(job)
+	next.epoch = q.epoch
+	q.active++
+	if len(q.jobs) > 0 && q.active < q.limit {
+		q.nudge()
+	}
+	return next, true
+}
+
+// Finish a job, adapting the limit AIMD-style if it should: it's halved
+// when a load fails or is slow, unless it's been cut since that load began,
+// and raised by one once as many loads as it allows have been healthy.
+func (q *workQueue) done(j job, healthy bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.active--
+	switch {
+	case !q.adaptive:
+	case !healthy:
+		if j.epoch == q.epoch {
+			q.limit = maxInt(q.limit/2, 1)
+			q.gained = 0
+			q.epoch++
+		}
+	case q.limit < q.max:
+		if q.gained++; q.gained >= q.limit {
+			q.limit++
+			q.gained = 0
+		}
+	}
+	if len(q.jobs) > 0 && q.active < q.limit {
+		q.nudge()
+	}
+}
+
+// Take what jobs are left, for good.
+func (q *workQueue) close() jobs {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	left := q.jobs
+	q.jobs, q.closed = nil, true
+	return left
+}
+
+// Run loads until the cache is closed, and then those still waiting, which
+// find themselves abandoned.
+func (cache *cache) work() {
+	defer cache.running.Done()
+	for {
+		if j, ok := cache.workers.take(); ok {
+			cache.workers.done(j, j.run())
+			continue
+		}
+		select {
+		case <-cache.ctx.Done():
+			for _, left := range cache.workers.close() {
+				left.run()
+			}
+			return
+		case <-cache.workers.ready:
+		}
+	}
+}
+
+// Run the loads handed to a goroutine standing by, as WithStandbyRefreshers
+// arranges, until the cache is closed.
+func (cache *cache) standBy() {
+	defer cache.running.Done()
+	for {
+		select {
+		case <-cache.ctx.Done():
+			return
+		case run := <-cache.standingBy:
+			run()
+		}
+	}
+}
+
+// Load a key in the background, handing the outcome to land: on a worker,
+// if their number is bounded, or else on a goroutine standing by or one of
+// its own. Workers
+// take the loads of the keys with the most heat, the reads of them of late,
+// first. A load whose context is done before a worker gets to it lands its
+// error rather than calling the refresher.
+func (cache *cache) spawn(ctx context.Context, heat int, load func() r, land func(r)) {
+	cache.running.Add(1)
+	if cache.workers == nil {
+		run := func() {
+			defer cache.running.Done()
+			land(load())
+		}
+		// A goroutine standing by takes it, if one's idle
+		select {
+		case cache.standingBy <- run:
+		default:
+			go run()
+		}
+		return
+	}
+	cache.workers.add(func() bool {
+		defer cache.running.Done()
+		if err := ctx.Err(); err != nil {
+			land(r{Err: err})
+			return true
+		}
+		began := cache.clock.Now()
+		outcome := load()
+		slow := cache.workers.latency > 0 && cache.since(began) > cache.workers.latency
+		land(outcome)
+		// Loads that are abandoned say nothing of the refresher
+		return ctx.Err() != nil || (outcome.Err == nil && !slow)
+	}, heat)
+}
+
+// Note a read of an entry, for the order of its refreshes, if they're queued.
+func (cache *cache) heatUp(e *entry) {
+	if cache.workers != nil {
+		atomic.AddInt32(&e.heat, 1)
+	}
+}
+
+// The reads of an entry of late, halving them as a refresh begins, so that
+// those before count for less than those after.
+func (e *entry) cool() int {
+	heat := atomic.LoadInt32(&e.heat)
+	atomic.AddInt32(&e.heat, -heat/2)
+	return int(heat)
+}